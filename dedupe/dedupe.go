@@ -71,6 +71,31 @@ func (f *Deduper) Contains(content []byte) (bool, error) {
 	return false, nil
 }
 
+/*
+Exists determines whether the content has been recorded, without recording it.
+Use it with Add to only record content once it has been processed, so that
+content whose processing fails (or never completes) isn't seen as a duplicate.
+*/
+func (f *Deduper) Exists(content []byte) (bool, error) {
+	key, _ := f.getKey(content)
+	if key == "" {
+		return false, ErrorUnknownType
+	}
+	return f.Storage.Exists(key)
+}
+
+/*
+Add records the content, so that it is subsequently seen as a duplicate.
+Returns ErrorKeyExistsOnWrite if it has already been recorded.
+*/
+func (f *Deduper) Add(content []byte) error {
+	key, value := f.getKey(content)
+	if key == "" {
+		return ErrorUnknownType
+	}
+	return f.Storage.Add(key, value)
+}
+
 func (f *Deduper) Remove(content []byte) error {
 
 	key := ""
@@ -88,6 +113,21 @@ func (f *Deduper) Remove(content []byte) error {
 	}
 }
 
+// getKey returns the storage key and value for the content, or an empty key for an unknown type
+func (f *Deduper) getKey(content []byte) (string, string) {
+	if f.Type == "revbloom" {
+		h := md5.New()
+		h.Write(content)
+		return f.getRevKey(content), hex.EncodeToString(h.Sum(nil))
+	}
+
+	if f.Type == "hashmap" {
+		return f.getHashKey(content), "1"
+	}
+
+	return "", ""
+}
+
 func (f *Deduper) getRevKey(content []byte) string {
 	checksum := int(adler32.Checksum(content))
 	index := checksum % f.Size
@@ -0,0 +1,154 @@
+package memcache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mc "github.com/HailoOSS/gomemcache/memcache"
+	"github.com/HailoOSS/platform/util"
+
+	hsync "github.com/HailoOSS/service/sync"
+)
+
+const (
+	// maxRateLimitKeyLength is a little below memcache's limit, to leave room for our window suffixes
+	maxRateLimitKeyLength = 200
+	// maxCASAttempts is how many times we retry an update which races with another
+	maxCASAttempts = 3
+)
+
+// RateLimitBackend is an implementation of sync.RateLimitBackend which counts events in memcache. Token buckets are
+// updated with compare-and-swap, and sliding windows are approximated from per-window counters.
+type RateLimitBackend struct {
+}
+
+func (b *RateLimitBackend) Take(key string, alg hsync.RateLimitAlgorithm, l hsync.RateLimit) (bool, time.Duration, error) {
+	if len(key) > maxRateLimitKeyLength {
+		key = "ratelimit:" + util.GetMD5Hash([]byte(key))
+	}
+	if alg == hsync.SlidingWindow {
+		return b.slidingWindow(key, l)
+	}
+	return b.tokenBucket(key, l)
+}
+
+func (b *RateLimitBackend) tokenBucket(key string, l hsync.RateLimit) (bool, time.Duration, error) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		now := time.Now()
+		item, err := Get(key)
+		if err == mc.ErrCacheMiss {
+			tokens, allowed, wait := l.TakeToken(float64(l.Capacity()), now, now)
+			err = Add(&mc.Item{
+				Key:        key,
+				Value:      encodeBucket(tokens, now),
+				Expiration: rateLimitExpiration(l),
+			})
+			if err == mc.ErrNotStored {
+				// someone else created it first
+				continue
+			} else if err != nil {
+				return false, 0, err
+			}
+			return allowed, wait, nil
+		} else if err != nil {
+			return false, 0, err
+		}
+
+		tokens, last := decodeBucket(item.Value, now, l)
+		tokens, allowed, wait := l.TakeToken(tokens, last, now)
+		item.Value = encodeBucket(tokens, now)
+		item.Expiration = rateLimitExpiration(l)
+		err = CompareAndSwap(item)
+		if err == mc.ErrCASConflict || err == mc.ErrNotStored || err == mc.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			return false, 0, err
+		}
+		return allowed, wait, nil
+	}
+
+	// heavily contended, so we are very probably over the limit
+	return false, l.Per / time.Duration(l.Limit), nil
+}
+
+func (b *RateLimitBackend) slidingWindow(key string, l hsync.RateLimit) (bool, time.Duration, error) {
+	index, offset := l.Window(time.Now())
+	curKey := fmt.Sprintf("%s:%d", key, index)
+	prevKey := fmt.Sprintf("%s:%d", key, index-1)
+
+	cur, err := b.increment(curKey, l)
+	if err != nil {
+		return false, 0, err
+	}
+	var prev int64
+	item, err := Get(prevKey)
+	if err == nil {
+		prev, _ = strconv.ParseInt(string(item.Value), 10, 64)
+	} else if err != mc.ErrCacheMiss {
+		return false, 0, err
+	}
+
+	allowed, wait := l.AllowWindow(prev, cur, offset)
+	if !allowed {
+		// rejected events do not count against the limit
+		Decrement(curKey, 1)
+	}
+	return allowed, wait, nil
+}
+
+// increment the counter at `key`, creating it if necessary
+func (b *RateLimitBackend) increment(key string, l hsync.RateLimit) (int64, error) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		n, err := Increment(key, 1)
+		if err == nil {
+			return int64(n), nil
+		} else if err != mc.ErrCacheMiss {
+			return 0, err
+		}
+
+		err = Add(&mc.Item{
+			Key:        key,
+			Value:      []byte("1"),
+			Expiration: rateLimitExpiration(l),
+		})
+		if err == nil {
+			return 1, nil
+		} else if err != mc.ErrNotStored {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("Failed to increment '%s' after %d attempts", key, maxCASAttempts)
+}
+
+// rateLimitExpiration returns a memcache expiry (in seconds) long enough to cover the current and next window, or for
+// a token bucket to refill
+func rateLimitExpiration(l hsync.RateLimit) int32 {
+	d := 2 * l.Per
+	if refill := l.Per * time.Duration(l.Capacity()) / time.Duration(l.Limit); refill > d {
+		d = refill
+	}
+	return int32(d/time.Second) + 1
+}
+
+func encodeBucket(tokens float64, last time.Time) []byte {
+	return []byte(fmt.Sprintf("%f:%d", tokens, last.UnixNano()))
+}
+
+// decodeBucket reads a token bucket, treating unreadable ones as full
+func decodeBucket(b []byte, now time.Time, l hsync.RateLimit) (float64, time.Time) {
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return float64(l.Capacity()), now
+	}
+	tokens, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return float64(l.Capacity()), now
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return float64(l.Capacity()), now
+	}
+	return tokens, time.Unix(0, last)
+}
@@ -0,0 +1,344 @@
+package nsq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// AdaptiveOptions bound and steer adaptive concurrency (see DefaultSubscriber.EnableAdaptive)
+type AdaptiveOptions struct {
+	// MinConcurrency and MaxConcurrency bound how many messages are handled at once
+	MinConcurrency int
+	MaxConcurrency int
+	// MinMaxInFlight and MaxMaxInFlight bound the max in flight we ask NSQ for
+	MinMaxInFlight int
+	MaxMaxInFlight int
+	// TargetLatency and MaxErrorRate: we back off when the mean handler latency, or the fraction of messages which fail,
+	// exceeds them
+	TargetLatency time.Duration
+	MaxErrorRate  float64
+	// HighDepth: we scale up while the depth of the channel, across all nsqds, exceeds it
+	HighDepth int
+	// Interval is how often we tune
+	Interval time.Duration
+
+	// BreakerErrorRate opens the circuit breaker, pausing consumption for BreakerCooldown, when the fraction of messages
+	// failing due to a dependency reaches it (given at least BreakerMinMessages were handled)
+	BreakerErrorRate   float64
+	BreakerMinMessages int
+	BreakerCooldown    time.Duration
+	// IsDependencyFailure decides which errors count towards the circuit breaker (default all)
+	IsDependencyFailure func(err error) bool
+}
+
+// AdaptiveOptionsFromConfig reads adaptive options from config, under hailo.service.nsq.adaptive
+func AdaptiveOptionsFromConfig() AdaptiveOptions {
+	return AdaptiveOptions{
+		MinConcurrency:     config.AtPath("hailo", "service", "nsq", "adaptive", "minConcurrency").AsInt(1),
+		MaxConcurrency:     config.AtPath("hailo", "service", "nsq", "adaptive", "maxConcurrency").AsInt(24),
+		MinMaxInFlight:     config.AtPath("hailo", "service", "nsq", "adaptive", "minMaxInFlight").AsInt(1),
+		MaxMaxInFlight:     config.AtPath("hailo", "service", "nsq", "adaptive", "maxMaxInFlight").AsInt(48),
+		TargetLatency:      config.AtPath("hailo", "service", "nsq", "adaptive", "targetLatency").AsDuration("500ms"),
+		MaxErrorRate:       config.AtPath("hailo", "service", "nsq", "adaptive", "maxErrorRate").AsFloat64(0.1),
+		HighDepth:          config.AtPath("hailo", "service", "nsq", "adaptive", "highDepth").AsInt(100),
+		Interval:           config.AtPath("hailo", "service", "nsq", "adaptive", "interval").AsDuration("10s"),
+		BreakerErrorRate:   config.AtPath("hailo", "service", "nsq", "adaptive", "breakerErrorRate").AsFloat64(0.5),
+		BreakerMinMessages: config.AtPath("hailo", "service", "nsq", "adaptive", "breakerMinMessages").AsInt(10),
+		BreakerCooldown:    config.AtPath("hailo", "service", "nsq", "adaptive", "breakerCooldown").AsDuration("30s"),
+	}
+}
+
+func (o AdaptiveOptions) withDefaults() AdaptiveOptions {
+	if o.MinConcurrency <= 0 {
+		o.MinConcurrency = 1
+	}
+	if o.MaxConcurrency < o.MinConcurrency {
+		o.MaxConcurrency = o.MinConcurrency
+	}
+	if o.MinMaxInFlight <= 0 {
+		o.MinMaxInFlight = 1
+	}
+	if o.MaxMaxInFlight < o.MinMaxInFlight {
+		o.MaxMaxInFlight = o.MinMaxInFlight
+	}
+	if o.TargetLatency <= 0 {
+		o.TargetLatency = 500 * time.Millisecond
+	}
+	if o.MaxErrorRate <= 0 {
+		o.MaxErrorRate = 0.1
+	}
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.BreakerErrorRate <= 0 {
+		o.BreakerErrorRate = 0.5
+	}
+	if o.BreakerMinMessages <= 0 {
+		o.BreakerMinMessages = 10
+	}
+	if o.BreakerCooldown <= 0 {
+		o.BreakerCooldown = 30 * time.Second
+	}
+	if o.IsDependencyFailure == nil {
+		o.IsDependencyFailure = func(err error) bool { return true }
+	}
+	return o
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// adaptiveDecision is what the tuner wants: how many messages to handle at once, and how many to have in flight
+type adaptiveDecision struct {
+	concurrency int
+	maxInFlight int
+	paused      bool
+}
+
+// adaptiveTuner observes handled messages and periodically decides on concurrency and max in flight. It scales up
+// additively while the channel is backed up, and backs off multiplicatively when handlers are slow or failing.
+type adaptiveTuner struct {
+	opts AdaptiveOptions
+	gate *concurrencyGate
+
+	mtx sync.Mutex
+	// observed since we last tuned
+	handled          int
+	failed           int
+	dependencyFailed int
+	latency          time.Duration
+	// current decision
+	concurrency int
+	maxInFlight int
+	state       breakerState
+	openUntil   time.Time
+}
+
+func newAdaptiveTuner(opts AdaptiveOptions, maxInFlight int) *adaptiveTuner {
+	opts = opts.withDefaults()
+	return &adaptiveTuner{
+		opts:        opts,
+		gate:        newConcurrencyGate(opts.MinConcurrency),
+		concurrency: opts.MinConcurrency,
+		maxInFlight: clamp(maxInFlight, opts.MinMaxInFlight, opts.MaxMaxInFlight),
+	}
+}
+
+// wrap limits a handler to the tuner's concurrency, and observes how it does
+func (t *adaptiveTuner) wrap(handler nsqlib.Handler) nsqlib.Handler {
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		t.gate.acquire()
+		defer t.gate.release()
+
+		startTime := time.Now()
+		err := handler.HandleMessage(msg)
+		t.observe(time.Since(startTime), err)
+		return err
+	})
+}
+
+func (t *adaptiveTuner) observe(d time.Duration, err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.handled++
+	t.latency += d
+	if err != nil {
+		t.failed++
+		if t.opts.IsDependencyFailure(err) {
+			t.dependencyFailed++
+		}
+	}
+}
+
+// tune decides on concurrency and max in flight given what has been observed since it was last called, and the depth
+// of the channel (or -1 if unknown)
+func (t *adaptiveTuner) tune(now time.Time, depth int) adaptiveDecision {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	handled, failed, dependencyFailed, latency := t.handled, t.failed, t.dependencyFailed, t.latency
+	t.handled, t.failed, t.dependencyFailed, t.latency = 0, 0, 0, 0
+	tripped := handled >= t.opts.BreakerMinMessages &&
+		float64(dependencyFailed)/float64(handled) >= t.opts.BreakerErrorRate
+
+	switch t.state {
+	case breakerOpen:
+		if now.Before(t.openUntil) {
+			return t.decision()
+		}
+		// let a trickle of messages through to see if things have recovered
+		t.state = breakerHalfOpen
+		t.concurrency, t.maxInFlight = t.opts.MinConcurrency, t.opts.MinMaxInFlight
+		return t.decision()
+	case breakerHalfOpen:
+		if handled == 0 {
+			return t.decision()
+		}
+		if !tripped && dependencyFailed == 0 {
+			t.state = breakerClosed
+		}
+	}
+
+	switch {
+	case tripped || (t.state == breakerHalfOpen && dependencyFailed > 0):
+		t.state = breakerOpen
+		t.openUntil = now.Add(t.opts.BreakerCooldown)
+		inst.Counter(1.0, "nsq.adaptive.breaker.open")
+	case handled > 0 && (float64(failed)/float64(handled) > t.opts.MaxErrorRate ||
+		latency/time.Duration(handled) > t.opts.TargetLatency):
+		t.concurrency = clamp(t.concurrency/2, t.opts.MinConcurrency, t.opts.MaxConcurrency)
+		t.maxInFlight = clamp(t.maxInFlight/2, t.opts.MinMaxInFlight, t.opts.MaxMaxInFlight)
+	case depth > t.opts.HighDepth:
+		// keep max in flight roughly in proportion to concurrency
+		step := t.opts.MaxMaxInFlight / t.opts.MaxConcurrency
+		if step < 1 {
+			step = 1
+		}
+		t.concurrency = clamp(t.concurrency+1, t.opts.MinConcurrency, t.opts.MaxConcurrency)
+		t.maxInFlight = clamp(t.maxInFlight+step, t.opts.MinMaxInFlight, t.opts.MaxMaxInFlight)
+	}
+	return t.decision()
+}
+
+func (t *adaptiveTuner) decision() adaptiveDecision {
+	t.gate.setLimit(t.concurrency)
+	return adaptiveDecision{
+		concurrency: t.concurrency,
+		maxInFlight: t.maxInFlight,
+		paused:      t.state == breakerOpen,
+	}
+}
+
+// concurrencyGate limits how many goroutines may hold it at once. The limit may be changed at any time.
+type concurrencyGate struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newConcurrencyGate(limit int) *concurrencyGate {
+	g := &concurrencyGate{limit: limit}
+	g.cond = sync.NewCond(&g.mtx)
+	return g
+}
+
+func (g *concurrencyGate) acquire() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for g.active >= g.limit {
+		g.cond.Wait()
+	}
+	g.active++
+}
+
+func (g *concurrencyGate) release() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.active--
+	g.cond.Signal()
+}
+
+func (g *concurrencyGate) setLimit(n int) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if n != g.limit {
+		g.limit = n
+		g.cond.Broadcast()
+	}
+}
+
+// EnableAdaptive turns on adaptive concurrency: rather than a fixed number of handlers and max in flight, these are
+// tuned between the given limits according to handler latency, error rate and channel depth. A circuit breaker pauses
+// consumption entirely while handlers are failing due to a dependency. This must be called before AddHandlers, which
+// then starts enough handlers for the maximum concurrency.
+func (s *DefaultSubscriber) EnableAdaptive(opts AdaptiveOptions) {
+	s.adaptive = newAdaptiveTuner(opts, s.cfg.MaxInFlight)
+	s.cfg.MaxInFlight = s.adaptive.maxInFlight
+}
+
+// adaptiveLoop tunes concurrency and max in flight until we are disconnected
+func (s *DefaultSubscriber) adaptiveLoop() {
+	tick := time.NewTicker(s.adaptive.opts.Interval)
+	defer tick.Stop()
+
+	prefix := fmt.Sprintf("nsq.adaptive.%s.%s.", s.topic, s.channel)
+	last := adaptiveDecision{maxInFlight: s.cfg.MaxInFlight}
+	for {
+		select {
+		case <-tick.C:
+		case <-s.stop:
+			return
+		}
+
+		d := s.adaptive.tune(time.Now(), channelDepth(s.topic, s.channel))
+		maxInFlight := d.maxInFlight
+		if d.paused {
+			// no messages will be sent our way until we raise this again
+			maxInFlight = 0
+		}
+		if d.paused != last.paused {
+			if d.paused {
+				log.Warnf("Circuit breaker open: pausing consumption of %s/%s", s.topic, s.channel)
+			} else {
+				log.Infof("Resuming consumption of %s/%s", s.topic, s.channel)
+			}
+		}
+		if d != last {
+			log.Debugf("Tuned %s/%s to concurrency %d, max in flight %d", s.topic, s.channel, d.concurrency,
+				maxInFlight)
+			s.consumer.ChangeMaxInFlight(maxInFlight)
+		}
+		last = d
+
+		inst.Gauge(1.0, prefix+"concurrency", d.concurrency)
+		inst.Gauge(1.0, prefix+"maxinflight", maxInFlight)
+	}
+}
+
+// channelDepth sums the depth of a channel across all nsqds, returning -1 if it cannot be found
+func channelDepth(topic, channel string) int {
+	total := 0
+	found := false
+	for _, addr := range getHosts(4150, "hailo", "service", "nsq", "subHosts") {
+		addr = strings.Replace(addr, "4150", "4151", -1)
+		stats, err := getStats(addr, topic, channel)
+		if err != nil {
+			log.Debugf("Failed to get NSQ stats from %s: %v", addr, err)
+			continue
+		}
+		depth, err := getChannelDepth(stats, topic, channel)
+		if err != nil {
+			continue
+		}
+		found = true
+		total += depth
+	}
+	if !found {
+		return -1
+	}
+	return total
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
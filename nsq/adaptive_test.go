@@ -0,0 +1,127 @@
+package nsq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testAdaptiveOptions() AdaptiveOptions {
+	return AdaptiveOptions{
+		MinConcurrency:     1,
+		MaxConcurrency:     4,
+		MinMaxInFlight:     2,
+		MaxMaxInFlight:     8,
+		TargetLatency:      100 * time.Millisecond,
+		MaxErrorRate:       0.2,
+		HighDepth:          10,
+		BreakerErrorRate:   0.5,
+		BreakerMinMessages: 4,
+		BreakerCooldown:    time.Minute,
+	}
+}
+
+func TestAdaptiveTunerScaling(t *testing.T) {
+	tuner := newAdaptiveTuner(testAdaptiveOptions(), 1)
+	now := time.Now()
+
+	// scale up while the channel is backed up, up to the limits
+	for i := 0; i < 10; i++ {
+		tuner.observe(time.Millisecond, nil)
+		tuner.tune(now, 100)
+	}
+	d := tuner.tune(now, 100)
+	if d.concurrency != 4 || d.maxInFlight != 8 || d.paused {
+		t.Errorf("Expected to scale up to the limits, Got %+v", d)
+	}
+
+	// hold steady once it has caught up
+	if d2 := tuner.tune(now, 0); d2 != d {
+		t.Errorf("Expected %+v with no backlog, Got %+v", d, d2)
+	}
+
+	// back off when handlers are slow, even with a backlog
+	tuner.observe(time.Second, nil)
+	d = tuner.tune(now, 100)
+	if d.concurrency != 2 || d.maxInFlight != 4 {
+		t.Errorf("Expected to back off with slow handlers, Got %+v", d)
+	}
+
+	// ... or failing
+	tuner.observe(time.Millisecond, nil)
+	tuner.observe(time.Millisecond, errors.New("boom"))
+	d = tuner.tune(now, 100)
+	if d.concurrency != 1 || d.maxInFlight != 2 || d.paused {
+		t.Errorf("Expected to back off with failing handlers, Got %+v", d)
+	}
+	if tuner.gate.limit != 1 {
+		t.Errorf("Expected gate limit to follow concurrency, Got %d", tuner.gate.limit)
+	}
+}
+
+func TestAdaptiveTunerCircuitBreaker(t *testing.T) {
+	dependency := errors.New("downstream unavailable")
+	opts := testAdaptiveOptions()
+	opts.IsDependencyFailure = func(err error) bool { return err == dependency }
+	tuner := newAdaptiveTuner(opts, 4)
+	now := time.Now()
+
+	// failures which aren't down to a dependency do not trip the breaker
+	for i := 0; i < 4; i++ {
+		tuner.observe(time.Millisecond, errors.New("bad message"))
+	}
+	if d := tuner.tune(now, 0); d.paused {
+		t.Errorf("Expected breaker to stay closed, Got %+v", d)
+	}
+
+	for i := 0; i < 4; i++ {
+		tuner.observe(time.Millisecond, dependency)
+	}
+	if d := tuner.tune(now, 0); !d.paused {
+		t.Errorf("Expected breaker to open, Got %+v", d)
+	}
+	if d := tuner.tune(now.Add(30*time.Second), 100); !d.paused {
+		t.Errorf("Expected breaker to stay open during cooldown, Got %+v", d)
+	}
+
+	// after the cooldown a trickle is let through, and any dependency failure reopens it
+	d := tuner.tune(now.Add(time.Minute), 0)
+	if d.paused || d.concurrency != 1 || d.maxInFlight != 2 {
+		t.Errorf("Expected breaker to half open, Got %+v", d)
+	}
+	tuner.observe(time.Millisecond, dependency)
+	if d := tuner.tune(now.Add(time.Minute), 0); !d.paused {
+		t.Errorf("Expected breaker to reopen, Got %+v", d)
+	}
+
+	// until it recovers
+	tuner.tune(now.Add(2*time.Minute), 0)
+	tuner.observe(time.Millisecond, nil)
+	if d := tuner.tune(now.Add(2*time.Minute), 0); d.paused || tuner.state != breakerClosed {
+		t.Errorf("Expected breaker to close, Got %+v", d)
+	}
+}
+
+func TestConcurrencyGate(t *testing.T) {
+	g := newConcurrencyGate(1)
+	g.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		g.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Expected gate to block beyond its limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// raising the limit lets it through
+	g.setLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected gate to let through once the limit was raised")
+	}
+}
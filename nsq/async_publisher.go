@@ -0,0 +1,319 @@
+package nsq
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	defaultAsyncBatchSize  = 100
+	defaultAsyncBatchBytes = 1024 * 1024
+	defaultAsyncLatency    = 10 * time.Millisecond
+	defaultAsyncMaxPending = 10000
+)
+
+var (
+	ErrPublisherClosed = errors.New("NSQ publisher is closed")
+)
+
+// AsyncOptions configures an AsyncPublisher; zero values take the defaults
+type AsyncOptions struct {
+	// MaxBatchSize is the number of messages at which a batch is sent (default 100)
+	MaxBatchSize int
+	// MaxBatchBytes is the total message size at which a batch is sent (default 1MB)
+	MaxBatchBytes int
+	// MaxLatency is how long a message may wait for its batch to fill before it is sent anyway (default 10ms)
+	MaxLatency time.Duration
+	// MaxPending bounds the number of messages buffered or being sent, beyond which publishing blocks (default 10000)
+	MaxPending int
+}
+
+// PublishFuture is the eventual result of an asynchronous publish
+type PublishFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newPublishFuture() *PublishFuture {
+	return &PublishFuture{
+		done: make(chan struct{}),
+	}
+}
+
+func (f *PublishFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done returns a channel which is closed once the message has been sent (or has failed to be)
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the result of publishing, once Done
+func (f *PublishFuture) Err() error {
+	<-f.done
+	return f.err
+}
+
+// Wait waits for the result of publishing, or until the context is done
+func (f *PublishFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AsyncPublisher is a Publisher which buffers messages per topic, and sends them as MultiPublish batches via an
+// underlying publisher once a batch is big enough or has waited long enough. Batches for a topic are sent in order,
+// one at a time. Consistency is that of the underlying publisher: with a HostpoolPublisher a batch only succeeds once
+// PUBbed to as many NSQs as writeCl requires.
+type AsyncPublisher struct {
+	publisher Publisher
+	opts      AsyncOptions
+	// slots applies back-pressure, bounding the number of messages in flight
+	slots chan struct{}
+
+	mtx    sync.Mutex
+	topics map[string]*asyncTopic
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type asyncTopic struct {
+	name string
+	// pending is the batch being filled, if any
+	pending *asyncBatch
+	// ready batches are sent in order by the topic's worker
+	ready chan *asyncBatch
+	// last is the future of the last message dispatched
+	last *PublishFuture
+}
+
+type asyncBatch struct {
+	body    [][]byte
+	futures []*PublishFuture
+	bytes   int
+	timer   *time.Timer
+}
+
+// NewAsyncPublisher returns an AsyncPublisher which sends batches via `p` (or DefaultPublisher if nil)
+func NewAsyncPublisher(p Publisher, opts AsyncOptions) *AsyncPublisher {
+	if p == nil {
+		p = DefaultPublisher
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = defaultAsyncBatchSize
+	}
+	if opts.MaxBatchBytes <= 0 {
+		opts.MaxBatchBytes = defaultAsyncBatchBytes
+	}
+	if opts.MaxLatency <= 0 {
+		opts.MaxLatency = defaultAsyncLatency
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultAsyncMaxPending
+	}
+
+	return &AsyncPublisher{
+		publisher: p,
+		opts:      opts,
+		slots:     make(chan struct{}, opts.MaxPending),
+		topics:    make(map[string]*asyncTopic),
+	}
+}
+
+// PublishAsync buffers a message for publishing, returning a future for the result. If too many messages are already
+// pending this blocks until there is room, or the context is done.
+func (p *AsyncPublisher) PublishAsync(ctx context.Context, topic string, body []byte) (*PublishFuture, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		inst.Counter(1.0, "nsq.async.publish.blocked")
+		return nil, ctx.Err()
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		<-p.slots
+		return nil, ErrPublisherClosed
+	}
+
+	t := p.topic(topic)
+	if t.pending != nil && t.pending.bytes+len(body) > p.opts.MaxBatchBytes {
+		p.dispatch(t)
+	}
+	if t.pending == nil {
+		b := &asyncBatch{}
+		b.timer = time.AfterFunc(p.opts.MaxLatency, func() {
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			if !p.closed && t.pending == b {
+				p.dispatch(t)
+			}
+		})
+		t.pending = b
+	}
+
+	f := newPublishFuture()
+	b := t.pending
+	b.body = append(b.body, body)
+	b.futures = append(b.futures, f)
+	b.bytes += len(body)
+	if len(b.body) >= p.opts.MaxBatchSize || b.bytes >= p.opts.MaxBatchBytes {
+		p.dispatch(t)
+	}
+
+	return f, nil
+}
+
+// Publish buffers a message and waits for it to be sent as part of a batch
+func (p *AsyncPublisher) Publish(topic string, body []byte) error {
+	return p.MultiPublish(topic, [][]byte{body})
+}
+
+// MultiPublish buffers messages and waits for them all to be sent, returning the first error encountered
+func (p *AsyncPublisher) MultiPublish(topic string, body [][]byte) error {
+	if len(body) <= 0 {
+		return ErrEmptyBody
+	}
+
+	futures := make([]*PublishFuture, 0, len(body))
+	for _, b := range body {
+		f, err := p.PublishAsync(context.Background(), topic, b)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+
+	var firstErr error
+	for _, f := range futures {
+		if err := f.Err(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Flush sends everything buffered now, and waits for it (and anything held by the underlying publisher) to be sent, or
+// until the context is done
+func (p *AsyncPublisher) Flush(ctx context.Context) error {
+	p.mtx.Lock()
+	var last []*PublishFuture
+	for _, t := range p.topics {
+		p.dispatch(t)
+		if t.last != nil {
+			last = append(last, t.last)
+		}
+	}
+	p.mtx.Unlock()
+
+	// batches for a topic are sent in order, so once the last is done so are the rest
+	for _, f := range last {
+		select {
+		case <-f.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if f, ok := p.publisher.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// Close stops accepting messages, and waits for everything buffered to be sent, or until the context is done (in which
+// case sending continues in the background)
+func (p *AsyncPublisher) Close(ctx context.Context) error {
+	p.mtx.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, t := range p.topics {
+			p.dispatch(t)
+			close(t.ready)
+		}
+	}
+	p.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warnf("Gave up waiting for async publisher to close: %v", ctx.Err())
+		return ctx.Err()
+	}
+
+	if f, ok := p.publisher.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// topic returns the state for a topic, starting its worker if required. The caller must hold the lock.
+func (p *AsyncPublisher) topic(name string) *asyncTopic {
+	t, ok := p.topics[name]
+	if !ok {
+		t = &asyncTopic{
+			name: name,
+			// every batch holds at least one slot, so this can never fill
+			ready: make(chan *asyncBatch, p.opts.MaxPending),
+		}
+		p.topics[name] = t
+		p.wg.Add(1)
+		go p.worker(t)
+	}
+	return t
+}
+
+// dispatch hands the pending batch for a topic (if any) to its worker. The caller must hold the lock.
+func (p *AsyncPublisher) dispatch(t *asyncTopic) {
+	if t.pending == nil {
+		return
+	}
+	t.pending.timer.Stop()
+	t.last = t.pending.futures[len(t.pending.futures)-1]
+	t.ready <- t.pending
+	t.pending = nil
+	inst.Gauge(1.0, "nsq.async.pending", len(p.slots))
+}
+
+// worker sends batches for a topic, in order, until the publisher is closed
+func (p *AsyncPublisher) worker(t *asyncTopic) {
+	defer p.wg.Done()
+
+	for b := range t.ready {
+		startTime := time.Now()
+		err := p.publisher.MultiPublish(t.name, b.body)
+		inst.Timing(1.0, "nsq.async.publish", time.Since(startTime))
+		inst.Gauge(1.0, "nsq.async.batch", len(b.body))
+
+		if err != nil {
+			log.Warnf("Failed to publish batch of %d messages to %s: %v", len(b.body), t.name, err)
+			inst.Counter(1.0, "nsq.async.publish.failure", len(b.body))
+		} else {
+			inst.Counter(1.0, "nsq.async.publish.success", len(b.body))
+		}
+
+		for _, f := range b.futures {
+			f.complete(err)
+			<-p.slots
+		}
+	}
+}
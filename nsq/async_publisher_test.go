@@ -0,0 +1,121 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// batchRecorder is a Publisher which records the batches it is asked to send
+type batchRecorder struct {
+	sync.Mutex
+	batches [][]string
+	err     error
+	block   chan struct{}
+}
+
+func (r *batchRecorder) MultiPublish(topic string, body [][]byte) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.Lock()
+	defer r.Unlock()
+	batch := make([]string, 0, len(body))
+	for _, b := range body {
+		batch = append(batch, string(b))
+	}
+	r.batches = append(r.batches, batch)
+	return r.err
+}
+
+func (r *batchRecorder) Publish(topic string, body []byte) error {
+	return r.MultiPublish(topic, [][]byte{body})
+}
+
+func (r *batchRecorder) sent() [][]string {
+	r.Lock()
+	defer r.Unlock()
+	return r.batches
+}
+
+func TestAsyncPublisherBatchesBySize(t *testing.T) {
+	r := &batchRecorder{}
+	p := NewAsyncPublisher(r, AsyncOptions{MaxBatchSize: 3, MaxLatency: time.Hour})
+
+	var futures []*PublishFuture
+	for i := 0; i < 7; i++ {
+		f, err := p.PublishAsync(context.Background(), "foo", []byte(fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures[:6] {
+		if err := f.Err(); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	select {
+	case <-futures[6].Done():
+		t.Error("Expected partial batch to wait")
+	default:
+	}
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if err := futures[6].Err(); err != nil {
+		t.Errorf("Expected partial batch to be sent on close, Got %v", err)
+	}
+	want := "[[0 1 2] [3 4 5] [6]]"
+	if got := fmt.Sprint(r.sent()); got != want {
+		t.Errorf("Want %s, Got %s", want, got)
+	}
+
+	if _, err := p.PublishAsync(context.Background(), "foo", []byte("x")); err != ErrPublisherClosed {
+		t.Errorf("Want %v, Got %v", ErrPublisherClosed, err)
+	}
+}
+
+func TestAsyncPublisherBatchesByLatency(t *testing.T) {
+	r := &batchRecorder{err: errors.New("nsq down")}
+	p := NewAsyncPublisher(r, AsyncOptions{MaxLatency: time.Millisecond})
+	defer p.Close(context.Background())
+
+	if err := p.Publish("foo", []byte("a")); err != r.err {
+		t.Errorf("Want %v, Got %v", r.err, err)
+	}
+	if len(r.sent()) != 1 {
+		t.Errorf("Want 1 batch, Got %v", r.sent())
+	}
+}
+
+func TestAsyncPublisherBackPressure(t *testing.T) {
+	r := &batchRecorder{block: make(chan struct{})}
+	p := NewAsyncPublisher(r, AsyncOptions{MaxBatchSize: 1, MaxPending: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.PublishAsync(context.Background(), "foo", []byte("a")); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.PublishAsync(ctx, "foo", []byte("b")); err != context.DeadlineExceeded {
+		t.Errorf("Want %v, Got %v", context.DeadlineExceeded, err)
+	}
+
+	close(r.block)
+	if err := p.Flush(context.Background()); err != nil {
+		t.Errorf("Failed to flush: %v", err)
+	}
+	if _, err := p.PublishAsync(context.Background(), "foo", []byte("c")); err != nil {
+		t.Errorf("Expected room once sent, Got %v", err)
+	}
+	p.Close(context.Background())
+}
@@ -0,0 +1,110 @@
+package nsq
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+
+	"github.com/HailoOSS/protobuf/proto"
+)
+
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/x-msgpack"
+)
+
+var (
+	codecs = map[string]Codec{
+		ContentTypeProtobuf: protobufCodec{},
+		ContentTypeJSON:     jsonCodec{},
+		ContentTypeMsgpack:  msgpackCodec{},
+	}
+	codecsMtx sync.RWMutex
+)
+
+// Codec encodes and decodes message bodies of a particular content type
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// RegisterCodec registers a codec for its content type, replacing any already registered
+func RegisterCodec(c Codec) {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	codecs[c.ContentType()] = c
+}
+
+// CodecFor returns the codec registered for a content type
+func CodecFor(contentType string) (Codec, error) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	c, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("No codec registered for content type '%s'", contentType)
+	}
+	return c, nil
+}
+
+// defaultContentType is the content type we use for a value when none is given: protobuf for protobuf messages,
+// otherwise JSON
+func defaultContentType(v interface{}) string {
+	if _, ok := v.(proto.Message); ok {
+		return ContentTypeProtobuf
+	}
+	return ContentTypeJSON
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("Cannot encode %T as protobuf", v)
+	}
+	return proto.Marshal(pb)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Cannot decode protobuf into %T", v)
+	}
+	return proto.Unmarshal(data, pb)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,55 @@
+package nsq
+
+import (
+	log "github.com/cihub/seelog"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	"github.com/HailoOSS/service/dedupe"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// DedupeHandler wraps a handler so that messages which have already been processed are skipped (and finished), using
+// `d` to remember which have been seen. Messages are identified by their envelope ID, or by their content if they were
+// not published within an envelope. Messages are only remembered once handled successfully, so one whose handler
+// fails, crashes or times out is handled again when redelivered; the flip side is that duplicates delivered at the
+// same time may both be handled.
+//
+// Storage errors are logged and the message handled anyway, as handling a message twice is better than losing it.
+func DedupeHandler(d *dedupe.Deduper, h nsqlib.Handler) nsqlib.Handler {
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		key := dedupeKey(msg)
+
+		seen, err := d.Exists(key)
+		if err != nil {
+			log.Warnf("Failed to check whether message %x is a duplicate: %v", msg.ID, err)
+			inst.Counter(1.0, "nsq.dedupe.error")
+			return h.HandleMessage(msg)
+		}
+		if seen {
+			log.Debugf("Skipping duplicate message %x", msg.ID)
+			inst.Counter(1.0, "nsq.dedupe.duplicate")
+			return nil
+		}
+		inst.Counter(1.0, "nsq.dedupe.unique")
+
+		if err := h.HandleMessage(msg); err != nil {
+			return err
+		}
+		if err := d.Add(key); err != nil && err != dedupe.ErrorKeyExistsOnWrite {
+			log.Warnf("Failed to remember message %x, so it may be handled again if redelivered: %v", msg.ID, err)
+			inst.Counter(1.0, "nsq.dedupe.error")
+		}
+		return nil
+	})
+}
+
+// dedupeKey returns what identifies a message: its envelope ID if it has one, otherwise its body (which the deduper
+// hashes)
+func dedupeKey(msg *nsqlib.Message) []byte {
+	if IsEnvelope(msg.Body) {
+		if e, err := UnmarshalEnvelope(msg.Body); err == nil && e.Id != "" {
+			return []byte("envelope:" + e.Id)
+		}
+	}
+	return msg.Body
+}
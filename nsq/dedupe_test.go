@@ -0,0 +1,95 @@
+package nsq
+
+import (
+	"errors"
+	"testing"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	"github.com/HailoOSS/service/dedupe"
+)
+
+type memoryDedupeStorage map[string]string
+
+func (s memoryDedupeStorage) Exists(key string) (bool, error) {
+	_, ok := s[key]
+	return ok, nil
+}
+
+func (s memoryDedupeStorage) Add(key, value string) error {
+	if _, ok := s[key]; ok {
+		return dedupe.ErrorKeyExistsOnWrite
+	}
+	s[key] = value
+	return nil
+}
+
+func (s memoryDedupeStorage) Remove(key string) error {
+	delete(s, key)
+	return nil
+}
+
+func TestDedupeHandler(t *testing.T) {
+	d := &dedupe.Deduper{Type: "hashmap", Prefix: "test:", Storage: memoryDedupeStorage{}}
+	failure := errors.New("boom")
+	fail := true
+	handled := 0
+	h := DedupeHandler(d, nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		handled++
+		if fail {
+			return failure
+		}
+		return nil
+	}))
+
+	e := NewEnvelope([]byte("a"))
+	b1, _ := e.Marshal()
+	// the same message, republished (eg: from the deadletter queue) with a different timestamp
+	e.SetHeader("republished", "true")
+	b2, _ := e.Marshal()
+
+	// failures aren't remembered, so the retry is handled
+	if err := h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, b1)); err != failure {
+		t.Errorf("Want %v, Got %v", failure, err)
+	}
+	fail = false
+	for _, b := range [][]byte{b1, b2} {
+		if err := h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, b)); err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if handled != 2 {
+		t.Errorf("Want 2 attempts to handle the message, Got %d", handled)
+	}
+
+	// legacy messages are identified by content
+	for i := 0; i < 2; i++ {
+		h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, []byte("raw")))
+	}
+	if handled != 3 {
+		t.Errorf("Expected duplicate legacy message to be skipped, handled %d", handled)
+	}
+}
+
+func TestDedupeHandlerCrash(t *testing.T) {
+	d := &dedupe.Deduper{Type: "hashmap", Prefix: "test:", Storage: memoryDedupeStorage{}}
+	crash := true
+	handled := 0
+	h := DedupeHandler(d, nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		handled++
+		if crash {
+			panic("crash")
+		}
+		return nil
+	}))
+
+	// a handler which never completes leaves the message to be handled when redelivered
+	func() {
+		defer func() { recover() }()
+		h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, []byte("a")))
+	}()
+	crash = false
+	h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, []byte("a")))
+	if handled != 2 {
+		t.Errorf("Expected redelivered message to be handled, handled %d", handled)
+	}
+}
@@ -0,0 +1,121 @@
+// Command nsq-dlq inspects the deadletter queue of a topic/channel, and republishes selected messages to the original
+// topic. For example, to see what would be replayed:
+//
+//	nsq-dlq -topic foo -channel bar -error "timeout" -since 2h -dry-run
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	"github.com/HailoOSS/service/config"
+	"github.com/HailoOSS/service/config/service_loader"
+	"github.com/HailoOSS/service/nsq/dlq"
+)
+
+const serviceName = "com.HailoOSS.tool.nsq-dlq"
+
+var (
+	topic        = flag.String("topic", "", "Topic whose deadletters to replay")
+	channel      = flag.String("channel", "", "Channel whose deadletters to replay")
+	consumeOn    = flag.String("consume-channel", dlq.DefaultChannel, "Channel to consume the deadletter queue on")
+	configFile   = flag.String("config", "", "Load config from this file, rather than the config service")
+	dryRun       = flag.Bool("dry-run", false, "Report what would be republished, but leave everything on the deadletter queue")
+	errContains  = flag.String("error", "", "Only select messages whose failure contains this")
+	bodyContains = flag.String("body", "", "Only select messages whose body contains this")
+	header       = flag.String("header", "", "Only select messages with this envelope header, as key=value")
+	since        = flag.Duration("since", 0, "Only select messages which failed within this long")
+	sample       = flag.Float64("sample", 1, "Fraction of matching messages to select")
+	limit        = flag.Int("limit", 0, "Stop after selecting this many messages")
+	rate         = flag.Int("rate", 0, "Maximum messages republished per second")
+	idle         = flag.Duration("idle", 5*time.Second, "Stop once no new messages have been seen for this long")
+	timeout      = flag.Duration("timeout", time.Hour, "Give up after this long")
+	quiet        = flag.Bool("quiet", false, "Do not print each message")
+)
+
+func main() {
+	flag.Parse()
+	defer log.Flush()
+
+	if *topic == "" || *channel == "" {
+		fmt.Fprintln(os.Stderr, "Both -topic and -channel are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *configFile != "" {
+		if err := config.LoadFromFile(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		service_loader.Init(serviceName)
+	}
+
+	filters := []dlq.Filter{}
+	if *errContains != "" {
+		filters = append(filters, dlq.ErrorContains(*errContains))
+	}
+	if *bodyContains != "" {
+		filters = append(filters, dlq.BodyContains(*bodyContains))
+	}
+	if *header != "" {
+		kv := strings.SplitN(*header, "=", 2)
+		if len(kv) != 2 {
+			fmt.Fprintln(os.Stderr, "-header must be of the form key=value")
+			os.Exit(2)
+		}
+		filters = append(filters, dlq.HeaderEquals(kv[0], kv[1]))
+	}
+	if *since > 0 {
+		filters = append(filters, dlq.FailedBetween(time.Now().Add(-*since), time.Time{}))
+	}
+
+	r := &dlq.Replayer{
+		Topic:          *topic,
+		Channel:        *channel,
+		ConsumeChannel: *consumeOn,
+		Filter:         dlq.All(filters...),
+		SampleRate:     *sample,
+		Limit:          *limit,
+		Rate:           *rate,
+		DryRun:         *dryRun,
+		IdleTimeout:    *idle,
+	}
+	if !*quiet {
+		r.OnMessage = printMessage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	stats, err := r.Run(ctx)
+
+	fmt.Printf("Seen %d, selected %d, republished %d, failed %d\n", stats.Seen, stats.Selected, stats.Republished,
+		stats.Failed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay stopped: %v\n", err)
+		os.Exit(1)
+	}
+	if stats.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printMessage(m *dlq.Message, selected bool) {
+	mark := " "
+	if selected {
+		mark = "*"
+	}
+	body := string(m.Envelope.Body)
+	if len(body) > 200 {
+		body = body[:200] + "..."
+	}
+	fmt.Printf("%s %s %s attempts=%d error=%q body=%q\n", mark, m.FailedAt.Format(time.RFC3339), m.Topic, m.Attempts,
+		m.Error, body)
+}
@@ -0,0 +1,258 @@
+// Package dlq reads back messages which have been sent to a deadletter queue, so that they can be inspected and
+// republished to the topic they came from
+package dlq
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	inst "github.com/HailoOSS/service/instrumentation"
+	"github.com/HailoOSS/service/nsq"
+)
+
+const (
+	// DefaultChannel is the channel we consume deadletter queues on
+	DefaultChannel = "dlq-replay"
+
+	defaultIdleTimeout = 5 * time.Second
+)
+
+// Message is a deadlettered message
+type Message struct {
+	// Envelope is the deadletter as published (messages deadlettered with nsq.PublishDeadLetter are given an envelope
+	// of their own)
+	Envelope *nsq.Envelope
+	// Topic and Body are what we would republish: the original topic, and the message as originally published
+	Topic string
+	Body  []byte
+	// Error, Attempts and FailedAt describe the failure, if known
+	Error    string
+	Attempts int
+	FailedAt time.Time
+}
+
+// Decode decodes a deadlettered message. The original topic is taken from its deadletter headers, falling back to
+// `topic` for messages deadlettered without any.
+func Decode(msg *nsqlib.Message, topic string) (*Message, error) {
+	e, err := nsq.MessageEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{
+		Envelope: e,
+		Error:    e.Header(nsq.HeaderDeadLetterError),
+	}
+	m.Attempts, _ = strconv.Atoi(e.Header(nsq.HeaderDeadLetterAttempts))
+	m.FailedAt, _ = time.Parse(time.RFC3339, e.Header(nsq.HeaderDeadLetterFailed))
+	if m.FailedAt.IsZero() {
+		m.FailedAt = e.Timestamp
+	}
+
+	m.Topic, m.Body, err = nsq.OriginalMessage(e)
+	if err == nsq.ErrDeadLetterHeaders {
+		m.Topic, m.Body = topic, msg.Body
+	} else if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Stats counts what a Replayer has done
+type Stats struct {
+	Seen        int
+	Selected    int
+	Republished int
+	Failed      int
+}
+
+// Replayer consumes a deadletter queue, republishing the messages selected by its filter (and sample rate) to their
+// original topics
+type Replayer struct {
+	// Topic and Channel are those whose deadletter queue we consume
+	Topic   string
+	Channel string
+	// ConsumeChannel is the channel we consume the deadletter queue on (default DefaultChannel)
+	ConsumeChannel string
+
+	// Filter selects messages (default all)
+	Filter Filter
+	// SampleRate is the fraction of messages passing the filter which are selected (default 1)
+	SampleRate float64
+	// Limit stops the replay once this many messages have been selected (default unlimited)
+	Limit int
+	// Rate limits the number of messages republished per second (default unlimited)
+	Rate int
+	// DryRun reports what would be republished, but leaves everything on the deadletter queue
+	DryRun bool
+	// IdleTimeout stops the replay once no new messages have been seen for this long (default 5s)
+	IdleTimeout time.Duration
+	// RequeueDelay is how long messages which are not republished are put back on the deadletter queue for, so that we
+	// do not keep seeing them during the replay. It defaults to IdleTimeout, so that they are back on the queue by the
+	// time the replay ends (eg: for a real run after a dry run); any longer and they are hidden from replays until then.
+	RequeueDelay time.Duration
+
+	// Publisher republishes messages (default nsq.DefaultPublisher, a HostpoolPublisher)
+	Publisher nsq.Publisher
+	// OnMessage is called for every message seen, with whether it was selected, eg: to print it
+	OnMessage func(m *Message, selected bool)
+
+	once          sync.Once
+	mtx           sync.Mutex
+	stats         Stats
+	seen          map[nsqlib.MessageID]bool
+	lastSeen      time.Time
+	lastPublished time.Time
+}
+
+func (r *Replayer) setup() {
+	r.seen = make(map[nsqlib.MessageID]bool)
+	if r.Filter == nil {
+		r.Filter = All()
+	}
+	if r.SampleRate <= 0 || r.SampleRate > 1 {
+		r.SampleRate = 1
+	}
+	if r.IdleTimeout <= 0 {
+		r.IdleTimeout = defaultIdleTimeout
+	}
+	if r.RequeueDelay <= 0 {
+		r.RequeueDelay = r.IdleTimeout
+	}
+	if r.ConsumeChannel == "" {
+		r.ConsumeChannel = DefaultChannel
+	}
+	if r.Publisher == nil {
+		r.Publisher = nsq.DefaultPublisher
+	}
+	r.lastSeen = time.Now()
+}
+
+// Stats returns what the replayer has done so far
+func (r *Replayer) Stats() Stats {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.stats
+}
+
+// Run consumes the deadletter queue until it has been idle for IdleTimeout, the limit is reached, or the context is
+// done
+func (r *Replayer) Run(ctx context.Context) (Stats, error) {
+	r.once.Do(r.setup)
+
+	dlq := nsq.DeadLetterTopic(r.Topic, r.Channel)
+	log.Infof("Replaying deadletter queue %s (dry run: %v)", dlq, r.DryRun)
+
+	sub, err := nsq.NewDefaultSubscriber(dlq, r.ConsumeChannel)
+	if err != nil {
+		return r.Stats(), err
+	}
+	sub.AddHandler(r)
+	if err := sub.Connect(); err != nil {
+		return r.Stats(), err
+	}
+	defer sub.Disconnect()
+
+	tick := time.NewTicker(r.IdleTimeout / 10)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return r.Stats(), ctx.Err()
+		}
+		if r.done() {
+			return r.Stats(), nil
+		}
+	}
+}
+
+// done reports whether we are idle, or have selected as many messages as we were asked to
+func (r *Replayer) done() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return time.Since(r.lastSeen) > r.IdleTimeout || (r.Limit > 0 && r.stats.Selected >= r.Limit)
+}
+
+// HandleMessage implements nsqlib.Handler. Selected messages are republished and finished; everything else is requeued.
+func (r *Replayer) HandleMessage(msg *nsqlib.Message) error {
+	r.once.Do(r.setup)
+
+	m, selected := r.selectMessage(msg)
+	if !selected || r.DryRun {
+		msg.RequeueWithoutBackoff(r.RequeueDelay)
+		return nil
+	}
+
+	r.throttle()
+	err := r.Publisher.Publish(m.Topic, m.Body)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		log.Errorf("Failed to republish message %x to %s: %v", msg.ID, m.Topic, err)
+		inst.Counter(1.0, "nsq.dlq.republish.failure")
+		r.stats.Failed++
+		msg.RequeueWithoutBackoff(r.RequeueDelay)
+		return nil
+	}
+	inst.Counter(1.0, "nsq.dlq.republish.success")
+	r.stats.Republished++
+	msg.Finish()
+	return nil
+}
+
+// selectMessage decodes a message and decides whether it is selected. Messages we have already seen during this
+// replay are never selected.
+func (r *Replayer) selectMessage(msg *nsqlib.Message) (*Message, bool) {
+	m, err := Decode(msg, r.Topic)
+
+	r.mtx.Lock()
+	if r.seen[msg.ID] {
+		r.mtx.Unlock()
+		return nil, false
+	}
+	r.seen[msg.ID] = true
+	r.lastSeen = time.Now()
+	r.stats.Seen++
+	selected := err == nil && (r.Limit <= 0 || r.stats.Selected < r.Limit) && r.Filter(m) &&
+		rand.Float64() < r.SampleRate
+	if selected {
+		r.stats.Selected++
+	}
+	r.mtx.Unlock()
+
+	if err != nil {
+		log.Warnf("Skipping undecodable message %x: %v", msg.ID, err)
+		return nil, false
+	}
+	if r.OnMessage != nil {
+		r.OnMessage(m, selected)
+	}
+	return m, selected
+}
+
+// throttle waits until we may republish another message, if we are rate limited
+func (r *Replayer) throttle() {
+	if r.Rate <= 0 {
+		return
+	}
+	interval := time.Second / time.Duration(r.Rate)
+
+	r.mtx.Lock()
+	next := r.lastPublished.Add(interval)
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	r.lastPublished = next
+	r.mtx.Unlock()
+
+	time.Sleep(next.Sub(now))
+}
@@ -0,0 +1,171 @@
+package dlq
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	"github.com/HailoOSS/service/nsq"
+)
+
+type recordingPublisher struct {
+	sync.Mutex
+	published map[string][]string
+	err       error
+}
+
+func (p *recordingPublisher) MultiPublish(topic string, body [][]byte) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if p.published == nil {
+		p.published = make(map[string][]string)
+	}
+	for _, b := range body {
+		p.published[topic] = append(p.published[topic], string(b))
+	}
+	return nil
+}
+
+func (p *recordingPublisher) Publish(topic string, body []byte) error {
+	return p.MultiPublish(topic, [][]byte{body})
+}
+
+// deadLetters returns messages as RetryHandler would have deadlettered them
+func deadLetters(t *testing.T, bodies ...string) []*nsqlib.Message {
+	p := &recordingPublisher{}
+	h := nsq.RetryHandler("foo", "bar", nsq.RetryPolicy{MaxAttempts: 1, Publisher: p},
+		nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+			return errors.New("failed " + string(msg.Body))
+		}))
+	for _, b := range bodies {
+		msg := nsqlib.NewMessage(nsqlib.MessageID{}, []byte(b))
+		msg.Attempts = 1
+		h.HandleMessage(msg)
+	}
+
+	dl := p.published[nsq.DeadLetterTopic("foo", "bar")]
+	msgs := make([]*nsqlib.Message, len(dl))
+	for i, b := range dl {
+		msgs[i] = nsqlib.NewMessage(nsqlib.MessageID{byte(i + 1)}, []byte(b))
+	}
+	return msgs
+}
+
+func TestDecode(t *testing.T) {
+	msg := deadLetters(t, "a")[0]
+	m, err := Decode(msg, "other")
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if m.Topic != "foo" || string(m.Body) != "a" || m.Error != "failed a" || m.Attempts != 1 ||
+		time.Since(m.FailedAt) > time.Minute {
+		t.Errorf("Unexpected message %+v", m)
+	}
+
+	// messages deadlettered by PublishDeadLetter are raw
+	m, err = Decode(nsqlib.NewMessage(nsqlib.MessageID{}, []byte("raw")), "other")
+	if err != nil || m.Topic != "other" || string(m.Body) != "raw" {
+		t.Errorf("Unexpected raw message %+v (%v)", m, err)
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	p := &recordingPublisher{}
+	var seen []string
+	r := &Replayer{
+		Topic:     "foo",
+		Channel:   "bar",
+		Filter:    All(ErrorContains("failed"), BodyContains("keep")),
+		Publisher: p,
+		OnMessage: func(m *Message, selected bool) {
+			if selected {
+				seen = append(seen, string(m.Body))
+			}
+		},
+	}
+
+	msgs := deadLetters(t, "keep-1", "drop", "keep-2")
+	for _, msg := range msgs {
+		r.HandleMessage(msg)
+	}
+	// redelivery of a message we skipped
+	r.HandleMessage(msgs[1])
+
+	if got := p.published["foo"]; len(got) != 2 || got[0] != "keep-1" || got[1] != "keep-2" {
+		t.Errorf("Unexpected republished messages %v", got)
+	}
+	if s := r.Stats(); s.Seen != 3 || s.Selected != 2 || s.Republished != 2 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected to be told about selected messages, Got %v", seen)
+	}
+}
+
+func TestReplayerDryRunAndLimit(t *testing.T) {
+	p := &recordingPublisher{}
+	r := &Replayer{Topic: "foo", Channel: "bar", Publisher: p, DryRun: true, Limit: 1}
+
+	for _, msg := range deadLetters(t, "a", "b") {
+		r.HandleMessage(msg)
+	}
+	if len(p.published) != 0 {
+		t.Errorf("Expected nothing to be republished on a dry run, Got %v", p.published)
+	}
+	if s := r.Stats(); s.Seen != 2 || s.Selected != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if !r.done() {
+		t.Error("Expected replay to be done once the limit is reached")
+	}
+}
+
+func TestReplayerDryRunThenRun(t *testing.T) {
+	b := nsq.NewFakeBroker()
+	dlq := nsq.DeadLetterTopic("foo", "bar")
+	for _, msg := range deadLetters(t, "a", "b") {
+		b.Publish(dlq, msg.Body)
+	}
+
+	// a dry run leaves everything on the deadletter queue...
+	dry := &Replayer{Topic: "foo", Channel: "bar", Publisher: b, DryRun: true}
+	sub := b.NewSubscriber(dlq, DefaultChannel)
+	sub.AddHandler(dry)
+	sub.Connect()
+	b.Process()
+	sub.Disconnect()
+	if s := dry.Stats(); s.Seen != 2 || s.Selected != 2 || s.Republished != 0 {
+		t.Errorf("Unexpected dry run stats %+v", s)
+	}
+
+	// ...for a real run once the dry run has gone idle
+	b.Advance(defaultIdleTimeout)
+	r := &Replayer{Topic: "foo", Channel: "bar", Publisher: b}
+	sub = b.NewSubscriber(dlq, DefaultChannel)
+	sub.AddHandler(r)
+	sub.Connect()
+	b.Process()
+	if s := r.Stats(); s.Seen != 2 || s.Republished != 2 {
+		t.Errorf("Expected real run to republish everything the dry run saw, got %+v", s)
+	}
+	if got := b.Published("foo"); len(got) != 2 {
+		t.Errorf("Expected 2 messages to be republished, Got %d", len(got))
+	}
+}
+
+func TestReplayerRateLimit(t *testing.T) {
+	r := &Replayer{Topic: "foo", Channel: "bar", Publisher: &recordingPublisher{}, Rate: 100}
+
+	start := time.Now()
+	for _, msg := range deadLetters(t, "a", "b", "c", "d", "e") {
+		r.HandleMessage(msg)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected republishing to be rate limited, took %v", elapsed)
+	}
+}
@@ -0,0 +1,55 @@
+package dlq
+
+import (
+	"strings"
+	"time"
+)
+
+// Filter selects deadlettered messages
+type Filter func(m *Message) bool
+
+// All selects messages which pass all of the given filters (so with none, all messages)
+func All(filters ...Filter) Filter {
+	return func(m *Message) bool {
+		for _, f := range filters {
+			if !f(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ErrorContains selects messages whose failure contains `s`
+func ErrorContains(s string) Filter {
+	return func(m *Message) bool {
+		return strings.Contains(m.Error, s)
+	}
+}
+
+// FailedBetween selects messages which failed within a time range. Either bound may be zero.
+func FailedBetween(from, to time.Time) Filter {
+	return func(m *Message) bool {
+		if !from.IsZero() && m.FailedAt.Before(from) {
+			return false
+		}
+		if !to.IsZero() && m.FailedAt.After(to) {
+			return false
+		}
+		return true
+	}
+}
+
+// HeaderEquals selects messages with the given envelope header
+func HeaderEquals(key, value string) Filter {
+	return func(m *Message) bool {
+		return m.Envelope.Header(key) == value
+	}
+}
+
+// BodyContains selects messages whose body contains `s`
+func BodyContains(s string) Filter {
+	return func(m *Message) bool {
+		return strings.Contains(string(m.Body), s)
+	}
+}
@@ -0,0 +1,189 @@
+package nsq
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+const (
+	envelopeFormatVersion = 1
+	// magic, format version, header length
+	envelopePreambleLen = 4 + 1 + 4
+)
+
+var (
+	// envelopeMagic prefixes enveloped messages. Neither JSON nor protobuf messages can begin with a zero byte, so it
+	// cannot be confused with a legacy message.
+	envelopeMagic = []byte{0x00, 'E', 'N', 'V'}
+
+	ErrInvalidEnvelope = errors.New("Invalid message envelope")
+)
+
+// Envelope wraps a message body with metadata, so that it does not need to be reinvented within every message format
+type Envelope struct {
+	// Id uniquely identifies the message (and is kept if it is republished, eg: from a deadletter queue)
+	Id string `json:"id"`
+	// Timestamp is when the message was created
+	Timestamp time.Time `json:"timestamp"`
+	// TraceId and SpanId tie the message to the request which caused it
+	TraceId string `json:"traceId,omitempty"`
+	SpanId  string `json:"spanId,omitempty"`
+	// ContentType describes the encoding of the body, eg: "application/json"
+	ContentType string `json:"contentType,omitempty"`
+	// SchemaVersion is the version of the body's schema, allowing consumers to handle old and new messages
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+	// Headers holds anything else
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the message itself
+	Body []byte `json:"-"`
+	// Legacy is set on envelopes made for messages which were not published within one
+	Legacy bool `json:"-"`
+}
+
+// NewEnvelope returns an envelope for `body` with a new ID and the current time
+func NewEnvelope(body []byte) *Envelope {
+	return &Envelope{
+		Id:        newMessageId(),
+		Timestamp: time.Now(),
+		Headers:   make(map[string]string),
+		Body:      body,
+	}
+}
+
+func newMessageId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Header returns a header, or an empty string if it is not set
+func (e *Envelope) Header(key string) string {
+	return e.Headers[key]
+}
+
+// SetHeader sets a header
+func (e *Envelope) SetHeader(key, value string) {
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.Headers[key] = value
+}
+
+// Marshal encodes the envelope as: magic, format version, the (32 bit) length of the JSON encoded metadata, the
+// metadata, then the body
+func (e *Envelope) Marshal() ([]byte, error) {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, envelopePreambleLen, envelopePreambleLen+len(meta)+len(e.Body))
+	copy(buf, envelopeMagic)
+	buf[4] = envelopeFormatVersion
+	binary.BigEndian.PutUint32(buf[5:], uint32(len(meta)))
+	buf = append(buf, meta...)
+	buf = append(buf, e.Body...)
+	return buf, nil
+}
+
+// IsEnvelope reports whether a message body was published within an envelope
+func IsEnvelope(b []byte) bool {
+	return len(b) >= envelopePreambleLen && bytes.Equal(b[:len(envelopeMagic)], envelopeMagic)
+}
+
+// UnmarshalEnvelope decodes a message body published within an envelope
+func UnmarshalEnvelope(b []byte) (*Envelope, error) {
+	if !IsEnvelope(b) || b[4] != envelopeFormatVersion {
+		return nil, ErrInvalidEnvelope
+	}
+	metaLen := int(binary.BigEndian.Uint32(b[5:]))
+	if len(b) < envelopePreambleLen+metaLen {
+		return nil, ErrInvalidEnvelope
+	}
+
+	e := &Envelope{}
+	if err := json.Unmarshal(b[envelopePreambleLen:envelopePreambleLen+metaLen], e); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	e.Body = b[envelopePreambleLen+metaLen:]
+	return e, nil
+}
+
+// MessageEnvelope returns the envelope of a message. Legacy messages, which were not published within an envelope,
+// are given one holding their body, with the ID and timestamp assigned by NSQ.
+func MessageEnvelope(msg *nsqlib.Message) (*Envelope, error) {
+	if IsEnvelope(msg.Body) {
+		return UnmarshalEnvelope(msg.Body)
+	}
+	return &Envelope{
+		Id:        hex.EncodeToString(msg.ID[:]),
+		Timestamp: time.Unix(0, msg.Timestamp),
+		Body:      msg.Body,
+		Legacy:    true,
+	}, nil
+}
+
+// PublishEnvelope wraps PublishEnvelopeVia for DefaultPublisher
+func PublishEnvelope(topic string, e *Envelope) error {
+	return PublishEnvelopeVia(DefaultPublisher, topic, e)
+}
+
+// PublishEnvelopeVia publishes a message within its envelope, using the given publisher
+func PublishEnvelopeVia(p Publisher, topic string, e *Envelope) error {
+	b, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	return p.Publish(topic, b)
+}
+
+// EnvelopeHandler handles messages along with their envelope
+type EnvelopeHandler interface {
+	HandleEnvelope(msg *nsqlib.Message, e *Envelope) error
+}
+
+// EnvelopeHandlerFunc is a convenience type to avoid having to declare a struct to implement EnvelopeHandler
+type EnvelopeHandlerFunc func(msg *nsqlib.Message, e *Envelope) error
+
+// HandleEnvelope implements EnvelopeHandler
+func (f EnvelopeHandlerFunc) HandleEnvelope(msg *nsqlib.Message, e *Envelope) error {
+	return f(msg, e)
+}
+
+// HandleEnvelopes adapts an EnvelopeHandler for use with a Subscriber. Legacy messages are passed through in an
+// envelope of their own (see MessageEnvelope), and messages with an invalid envelope fail.
+func HandleEnvelopes(h EnvelopeHandler) nsqlib.Handler {
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		e, err := MessageEnvelope(msg)
+		if err != nil {
+			return err
+		}
+		return h.HandleEnvelope(msg, e)
+	})
+}
+
+// UnwrapEnvelopes adapts a plain handler to receive message bodies with any envelope removed, so that publishers can
+// begin to use envelopes before their consumers understand them. Legacy messages are passed through unchanged.
+func UnwrapEnvelopes(h nsqlib.Handler) nsqlib.Handler {
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		if !IsEnvelope(msg.Body) {
+			return h.HandleMessage(msg)
+		}
+		e, err := UnmarshalEnvelope(msg.Body)
+		if err != nil {
+			return err
+		}
+		// the message itself must be passed on, as it tracks whether it has been responded to
+		body := msg.Body
+		msg.Body = e.Body
+		defer func() { msg.Body = body }()
+		return h.HandleMessage(msg)
+	})
+}
@@ -0,0 +1,76 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	e := NewEnvelope([]byte(`{"foo":"bar"}`))
+	e.TraceId = "trace"
+	e.SpanId = "span"
+	e.ContentType = "application/json"
+	e.SchemaVersion = 2
+	e.SetHeader("origin", "test")
+
+	b, err := e.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	if !IsEnvelope(b) {
+		t.Fatal("Expected marshalled envelope to be recognised")
+	}
+
+	got, err := UnmarshalEnvelope(b)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if got.Id != e.Id || !got.Timestamp.Equal(e.Timestamp) || got.TraceId != "trace" || got.SpanId != "span" ||
+		got.ContentType != "application/json" || got.SchemaVersion != 2 || got.Header("origin") != "test" {
+		t.Errorf("Want %+v, Got %+v", e, got)
+	}
+	if string(got.Body) != `{"foo":"bar"}` || got.Legacy {
+		t.Errorf("Unexpected body %q (legacy %v)", got.Body, got.Legacy)
+	}
+
+	if _, err := UnmarshalEnvelope(b[:len(b)-len(e.Body)-1]); err != ErrInvalidEnvelope {
+		t.Errorf("Want %v for truncated envelope, Got %v", ErrInvalidEnvelope, err)
+	}
+}
+
+func TestLegacyMessages(t *testing.T) {
+	for _, body := range []string{`{"foo":"bar"}`, "\x08\x96\x01", ""} {
+		if IsEnvelope([]byte(body)) {
+			t.Errorf("Expected %q not to be recognised as an envelope", body)
+		}
+	}
+
+	msg := nsqlib.NewMessage(nsqlib.MessageID{'a'}, []byte("raw"))
+	msg.Timestamp = time.Now().UnixNano()
+	e, err := MessageEnvelope(msg)
+	if err != nil || !e.Legacy || string(e.Body) != "raw" || e.Timestamp.UnixNano() != msg.Timestamp {
+		t.Errorf("Unexpected legacy envelope %+v (%v)", e, err)
+	}
+}
+
+func TestUnwrapEnvelopes(t *testing.T) {
+	var got []string
+	h := UnwrapEnvelopes(nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		got = append(got, string(msg.Body))
+		return nil
+	}))
+
+	b, _ := NewEnvelope([]byte("wrapped")).Marshal()
+	wrapped := nsqlib.NewMessage(nsqlib.MessageID{}, b)
+	h.HandleMessage(wrapped)
+	h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, []byte("raw")))
+
+	if len(got) != 2 || got[0] != "wrapped" || got[1] != "raw" {
+		t.Errorf("Unexpected bodies %q", got)
+	}
+	if string(wrapped.Body) != string(b) {
+		t.Error("Expected message body to be restored after handling")
+	}
+}
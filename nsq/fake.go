@@ -0,0 +1,504 @@
+package nsq
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+const (
+	// as go-nsq: failed messages are requeued for this long per attempt, up to fakeMaxRequeueDelay
+	fakeRequeueDelay    = 90 * time.Second
+	fakeMaxRequeueDelay = 15 * time.Minute
+	// as nsqd: messages which have not been responded to within this long are requeued
+	fakeMsgTimeout = 60 * time.Second
+
+	ephemeralSuffix = "#ephemeral"
+)
+
+// FakeBroker is an in-memory NSQ, for use in unit tests. It implements Publisher, and provides Subscribers which
+// behave as they would against nsqd: every channel of a topic gets its own copy of each message, messages published
+// before a topic has any channels are kept for the first, failed messages are requeued with a delay and their attempts
+// counted, and #ephemeral channels disappear along with their last subscriber.
+//
+// Delivery is deterministic: nothing is handled until Process is called, which runs handlers on the calling
+// goroutine, and time only passes (eg: for requeue delays) when Advance is called. For example:
+//
+//	b := nsq.NewFakeBroker()
+//	nsq.DefaultPublisher = b
+//	sub := b.NewSubscriber("foo", "bar")
+//	sub.AddHandler(handler)
+//	sub.Connect()
+//	nsq.Publish("foo", body)
+//	b.Process()
+type FakeBroker struct {
+	mtx    sync.Mutex
+	now    time.Time
+	nextId uint64
+	topics map[string]*fakeTopic
+}
+
+type fakeTopic struct {
+	channels  map[string]*fakeChannel
+	buffered  []*fakeMessage
+	published [][]byte
+}
+
+// fakeChannel acts as the nsqlib.MessageDelegate of the messages it delivers
+type fakeChannel struct {
+	b           *FakeBroker
+	topic, name string
+	subscribers []*FakeSubscriber
+	next        int
+	ready       []*fakeMessage
+	deferred    []*fakeMessage
+	inFlight    map[*nsqlib.Message]*fakeMessage
+	stats       FakeChannelStats
+}
+
+type fakeMessage struct {
+	id        nsqlib.MessageID
+	body      []byte
+	timestamp int64
+	attempts  uint16
+	// when it is due to be requeued (if in flight) or delivered (if deferred), and who has it
+	due time.Time
+	sub *FakeSubscriber
+}
+
+type fakeMessagesById []*fakeMessage
+
+func (m fakeMessagesById) Len() int           { return len(m) }
+func (m fakeMessagesById) Less(i, j int) bool { return string(m[i].id[:]) < string(m[j].id[:]) }
+func (m fakeMessagesById) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// FakeChannelStats describes the state of a channel on a FakeBroker
+type FakeChannelStats struct {
+	Depth    int
+	InFlight int
+	Deferred int
+	Finished int
+	Requeued int
+	TimedOut int
+}
+
+// NewFakeBroker returns a broker with no topics, whose clock starts at the current time
+func NewFakeBroker() *FakeBroker {
+	return &FakeBroker{
+		now:    time.Now(),
+		topics: make(map[string]*fakeTopic),
+	}
+}
+
+// Now returns the broker's clock
+func (b *FakeBroker) Now() time.Time {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.now
+}
+
+// Advance moves the broker's clock on, and processes any messages which are then due
+func (b *FakeBroker) Advance(d time.Duration) int {
+	b.mtx.Lock()
+	b.now = b.now.Add(d)
+	b.mtx.Unlock()
+	return b.Process()
+}
+
+// Process delivers messages to connected subscribers until there are none ready (including any published or requeued
+// without delay by the handlers themselves), returning how many were delivered
+func (b *FakeBroker) Process() int {
+	n := 0
+	for {
+		sub, handler, msg := b.nextDelivery()
+		if msg == nil {
+			return n
+		}
+		sub.deliver(handler, msg)
+		n++
+	}
+}
+
+func (b *FakeBroker) Publish(topic string, body []byte) error {
+	return b.MultiPublish(topic, [][]byte{body})
+}
+
+func (b *FakeBroker) MultiPublish(topic string, body [][]byte) error {
+	if len(topic) == 0 {
+		return fmt.Errorf("Invalid topic name '%s'", topic)
+	}
+	for _, msg := range body {
+		if len(msg) == 0 {
+			return fmt.Errorf("Cannot publish an empty message to '%s'", topic)
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	t := b.topic(topic)
+	for _, msg := range body {
+		msg = append([]byte(nil), msg...)
+		t.published = append(t.published, msg)
+
+		b.nextId++
+		m := &fakeMessage{body: msg, timestamp: b.now.UnixNano()}
+		copy(m.id[:], fmt.Sprintf("%016x", b.nextId))
+		if len(t.channels) == 0 {
+			t.buffered = append(t.buffered, m)
+			continue
+		}
+		for _, c := range t.channels {
+			copied := *m
+			c.ready = append(c.ready, &copied)
+		}
+	}
+	return nil
+}
+
+// PublishFederated publishes to the federated counterpart of a topic, as if the message had been published in another
+// region (see NewGlobalSubscriber)
+func (b *FakeBroker) PublishFederated(topic string, body []byte) error {
+	return b.Publish(topic+federatedExt, body)
+}
+
+// Published returns every message published to a topic, in order
+func (b *FakeBroker) Published(topic string) [][]byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil
+	}
+	return append([][]byte(nil), t.published...)
+}
+
+// Channels returns the names of a topic's channels
+func (b *FakeBroker) Channels(topic string) []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(t.channels))
+	for name := range t.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ChannelStats returns the state of a channel, which is zero if it does not exist
+func (b *FakeBroker) ChannelStats(topic, channel string) FakeChannelStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return FakeChannelStats{}
+	}
+	c, ok := t.channels[channel]
+	if !ok {
+		return FakeChannelStats{}
+	}
+	stats := c.stats
+	stats.Depth = len(c.ready)
+	stats.InFlight = len(c.inFlight)
+	stats.Deferred = len(c.deferred)
+	return stats
+}
+
+// NewSubscriber returns a subscriber to a topic and channel on this broker
+func (b *FakeBroker) NewSubscriber(topic, channel string) *FakeSubscriber {
+	return &FakeSubscriber{
+		b:       b,
+		topic:   topic,
+		channel: channel,
+		cfg:     nsqlib.NewConfig(),
+	}
+}
+
+// NewGlobalSubscriber returns a DefaultGlobalSubscriber to a topic and its federated counterpart on this broker
+func (b *FakeBroker) NewGlobalSubscriber(topic, channel string) Subscriber {
+	return &DefaultGlobalSubscriber{
+		localSubscriber:     b.NewSubscriber(topic, channel),
+		federatedSubscriber: b.NewSubscriber(topic+federatedExt, channel),
+	}
+}
+
+// topic returns a topic, creating it if need be. The broker must be locked.
+func (b *FakeBroker) topic(name string) *fakeTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &fakeTopic{channels: make(map[string]*fakeChannel)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// channel returns a channel, creating it if need be. The first channel of a topic gets all the messages published to
+// the topic so far. The broker must be locked.
+func (b *FakeBroker) channel(topic, name string) *fakeChannel {
+	t := b.topic(topic)
+	c, ok := t.channels[name]
+	if !ok {
+		c = &fakeChannel{
+			b:        b,
+			topic:    topic,
+			name:     name,
+			inFlight: make(map[*nsqlib.Message]*fakeMessage),
+		}
+		if len(t.channels) == 0 {
+			c.ready, t.buffered = t.buffered, nil
+		}
+		t.channels[name] = c
+	}
+	return c
+}
+
+// nextDelivery takes the next message which is ready for a connected subscriber, or returns a nil message if there are
+// none. Topics and channels are visited in name order, and subscribers (and their handlers) take turns.
+func (b *FakeBroker) nextDelivery() (*FakeSubscriber, nsqlib.Handler, *nsqlib.Message) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	topics := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		topics = append(topics, name)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		t := b.topics[topic]
+		channels := make([]string, 0, len(t.channels))
+		for name := range t.channels {
+			channels = append(channels, name)
+		}
+		sort.Strings(channels)
+		for _, channel := range channels {
+			c := t.channels[channel]
+			c.promote(b.now)
+			if len(c.ready) == 0 {
+				continue
+			}
+			sub, handler := c.nextHandler()
+			if handler == nil {
+				continue
+			}
+
+			m := c.ready[0]
+			c.ready = c.ready[1:]
+			m.attempts++
+			m.due = b.now.Add(fakeMsgTimeout)
+			m.sub = sub
+
+			msg := nsqlib.NewMessage(m.id, m.body)
+			msg.Timestamp = m.timestamp
+			msg.Attempts = m.attempts
+			msg.Delegate = c
+			c.inFlight[msg] = m
+			return sub, handler, msg
+		}
+	}
+	return nil, nil, nil
+}
+
+// promote readies deferred messages which are due, and requeues in flight messages which have timed out
+func (c *fakeChannel) promote(now time.Time) {
+	for len(c.deferred) > 0 && !c.deferred[0].due.After(now) {
+		c.ready = append(c.ready, c.deferred[0])
+		c.deferred = c.deferred[1:]
+	}
+
+	c.stats.TimedOut += c.requeueInFlight(func(m *fakeMessage) bool {
+		return !m.due.After(now)
+	})
+}
+
+// requeueInFlight readies the in flight messages selected, in the order they were published
+func (c *fakeChannel) requeueInFlight(selected func(m *fakeMessage) bool) int {
+	var requeued fakeMessagesById
+	for msg, m := range c.inFlight {
+		if selected(m) {
+			delete(c.inFlight, msg)
+			requeued = append(requeued, m)
+		}
+	}
+	sort.Sort(requeued)
+	c.ready = append(c.ready, requeued...)
+	return len(requeued)
+}
+
+// nextHandler chooses a handler of the channel's subscribers, in turn
+func (c *fakeChannel) nextHandler() (*FakeSubscriber, nsqlib.Handler) {
+	total := 0
+	for _, sub := range c.subscribers {
+		total += len(sub.handlers)
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	n := c.next % total
+	c.next++
+	for _, sub := range c.subscribers {
+		if n < len(sub.handlers) {
+			return sub, sub.handlers[n]
+		}
+		n -= len(sub.handlers)
+	}
+	return nil, nil
+}
+
+func (c *fakeChannel) OnFinish(msg *nsqlib.Message) {
+	c.b.mtx.Lock()
+	defer c.b.mtx.Unlock()
+	if _, ok := c.inFlight[msg]; ok {
+		delete(c.inFlight, msg)
+		c.stats.Finished++
+	}
+}
+
+func (c *fakeChannel) OnRequeue(msg *nsqlib.Message, delay time.Duration, backoff bool) {
+	c.b.mtx.Lock()
+	defer c.b.mtx.Unlock()
+	m, ok := c.inFlight[msg]
+	if !ok {
+		return
+	}
+	delete(c.inFlight, msg)
+	c.stats.Requeued++
+
+	if delay < 0 {
+		delay = fakeRequeueDelay * time.Duration(m.attempts)
+		if delay > fakeMaxRequeueDelay {
+			delay = fakeMaxRequeueDelay
+		}
+	}
+	if delay == 0 {
+		c.ready = append(c.ready, m)
+		return
+	}
+	// keep deferred messages in the order they are due
+	m.due = c.b.now.Add(delay)
+	i := sort.Search(len(c.deferred), func(i int) bool {
+		return c.deferred[i].due.After(m.due)
+	})
+	c.deferred = append(c.deferred, nil)
+	copy(c.deferred[i+1:], c.deferred[i:])
+	c.deferred[i] = m
+}
+
+func (c *fakeChannel) OnTouch(msg *nsqlib.Message) {
+	c.b.mtx.Lock()
+	defer c.b.mtx.Unlock()
+	if m, ok := c.inFlight[msg]; ok {
+		m.due = c.b.now.Add(fakeMsgTimeout)
+	}
+}
+
+// FakeSubscriber is a Subscriber to a FakeBroker
+type FakeSubscriber struct {
+	b              *FakeBroker
+	topic, channel string
+	cfg            *nsqlib.Config
+	handlers       []nsqlib.Handler
+	connected      bool
+}
+
+func (s *FakeSubscriber) AddHandler(handler nsqlib.Handler) {
+	s.handlers = append(s.handlers, handler)
+}
+
+// AddHandlers adds a single handler, as messages are handled one at a time anyway
+func (s *FakeSubscriber) AddHandlers(handler nsqlib.Handler) {
+	s.AddHandler(handler)
+}
+
+// AddTypedHandler deadletters messages which cannot be decoded to the broker
+func (s *FakeSubscriber) AddTypedHandler(factory func() interface{}, handler TypedHandlerFunc) {
+	s.AddHandler(TypedHandlerVia(s.b, s.topic, s.channel, factory, handler))
+}
+
+func (s *FakeSubscriber) SetMaxInFlight(v int) {
+	s.cfg.MaxInFlight = v
+}
+
+// EnableAdaptive does nothing, as messages are handled one at a time
+func (s *FakeSubscriber) EnableAdaptive(opts AdaptiveOptions) {}
+
+func (s *FakeSubscriber) IsStarved() bool {
+	return false
+}
+
+func (s *FakeSubscriber) SetConfig(option string, value interface{}) error {
+	return s.cfg.Set(option, value)
+}
+
+// Connect joins the channel, creating it if need be
+func (s *FakeSubscriber) Connect() error {
+	s.b.mtx.Lock()
+	defer s.b.mtx.Unlock()
+	if s.connected {
+		return nsqlib.ErrAlreadyConnected
+	}
+	c := s.b.channel(s.topic, s.channel)
+	c.subscribers = append(c.subscribers, s)
+	s.connected = true
+	return nil
+}
+
+// Disconnect leaves the channel, requeuing any messages we have not responded to. Ephemeral channels are deleted
+// along with their last subscriber.
+func (s *FakeSubscriber) Disconnect() {
+	s.b.mtx.Lock()
+	defer s.b.mtx.Unlock()
+	if !s.connected {
+		return
+	}
+	s.connected = false
+
+	t := s.b.topic(s.topic)
+	c := t.channels[s.channel]
+	for i, sub := range c.subscribers {
+		if sub == s {
+			c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+			break
+		}
+	}
+	c.stats.Requeued += c.requeueInFlight(func(m *fakeMessage) bool {
+		return m.sub == s
+	})
+	if len(c.subscribers) == 0 && strings.HasSuffix(s.channel, ephemeralSuffix) {
+		delete(t.channels, s.channel)
+	}
+}
+
+// Drain disconnects: as handlers run within Process, none can be in flight
+func (s *FakeSubscriber) Drain(ctx context.Context) error {
+	s.Disconnect()
+	return nil
+}
+
+// deliver handles a message as go-nsq would, giving up on it once it has been attempted too many times
+func (s *FakeSubscriber) deliver(handler nsqlib.Handler, msg *nsqlib.Message) {
+	if s.cfg.MaxAttempts > 0 && msg.Attempts > s.cfg.MaxAttempts {
+		log.Warnf("Giving up on message %s from %s/%s after %d attempts", msg.ID, s.topic, s.channel, msg.Attempts)
+		msg.Finish()
+		return
+	}
+
+	err := handler.HandleMessage(msg)
+	if msg.IsAutoResponseDisabled() {
+		return
+	}
+	if err != nil {
+		msg.Requeue(-1)
+	} else {
+		msg.Finish()
+	}
+}
@@ -0,0 +1,179 @@
+package nsq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+// recordingHandler records the bodies and attempts of the messages it handles, failing those in `fail`
+type recordingHandler struct {
+	bodies   []string
+	attempts []uint16
+	fail     map[string]bool
+}
+
+func (h *recordingHandler) HandleMessage(msg *nsqlib.Message) error {
+	h.bodies = append(h.bodies, string(msg.Body))
+	h.attempts = append(h.attempts, msg.Attempts)
+	if h.fail[string(msg.Body)] {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+func TestFakeBrokerFanOut(t *testing.T) {
+	b := NewFakeBroker()
+
+	// published before any channel exists, so kept for the first
+	if err := b.Publish("foo", []byte("early")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	first, second := &recordingHandler{}, &recordingHandler{}
+	sub1 := b.NewSubscriber("foo", "first")
+	sub1.AddHandler(first)
+	sub1.Connect()
+	sub2 := b.NewSubscriber("foo", "second")
+	sub2.AddHandler(second)
+	sub2.Connect()
+
+	b.MultiPublish("foo", [][]byte{[]byte("a"), []byte("b")})
+	b.Publish("other", []byte("c"))
+	if n := b.Process(); n != 5 {
+		t.Errorf("Expected 5 deliveries, Got %d", n)
+	}
+	if got := first.bodies; len(got) != 3 || got[0] != "early" || got[1] != "a" || got[2] != "b" {
+		t.Errorf("Unexpected messages for first channel %v", got)
+	}
+	if got := second.bodies; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Unexpected messages for second channel %v", got)
+	}
+	if stats := b.ChannelStats("foo", "first"); stats.Finished != 3 || stats.Depth != 0 || stats.InFlight != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if got := b.Published("foo"); len(got) != 3 {
+		t.Errorf("Expected 3 messages published to foo, Got %d", len(got))
+	}
+}
+
+func TestFakeBrokerRequeue(t *testing.T) {
+	b := NewFakeBroker()
+	h := &recordingHandler{fail: map[string]bool{"bad": true}}
+	sub := b.NewSubscriber("foo", "bar")
+	sub.cfg.MaxAttempts = 3
+	sub.AddHandler(h)
+	sub.Connect()
+
+	b.Publish("foo", []byte("bad"))
+	b.Publish("foo", []byte("good"))
+	b.Process()
+	if stats := b.ChannelStats("foo", "bar"); stats.Deferred != 1 || stats.Requeued != 1 || stats.Finished != 1 {
+		t.Fatalf("Expected failed message to be deferred, Got %+v", stats)
+	}
+
+	// requeued with a backoff which grows with attempts
+	if n := b.Advance(fakeRequeueDelay - time.Second); n != 0 {
+		t.Errorf("Expected nothing to be delivered before the requeue delay, Got %d", n)
+	}
+	if n := b.Advance(time.Second); n != 1 {
+		t.Errorf("Expected failed message to be redelivered, Got %d", n)
+	}
+	if n := b.Advance(2 * fakeRequeueDelay); n != 1 {
+		t.Errorf("Expected failed message to be redelivered, Got %d", n)
+	}
+
+	// and given up on after max attempts
+	b.Advance(fakeMaxRequeueDelay)
+	if got := h.attempts; len(got) != 4 || got[0] != 1 || got[2] != 2 || got[3] != 3 {
+		t.Errorf("Unexpected attempts %v", got)
+	}
+	if stats := b.ChannelStats("foo", "bar"); stats.Deferred != 0 || stats.Finished != 2 {
+		t.Errorf("Expected message to be given up on, Got %+v", stats)
+	}
+}
+
+func TestFakeBrokerDisconnect(t *testing.T) {
+	b := NewFakeBroker()
+	sub := b.NewSubscriber("foo", "bar#ephemeral")
+	sub.AddHandler(nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		msg.DisableAutoResponse()
+		return nil
+	}))
+	sub.Connect()
+
+	b.Publish("foo", []byte("hello"))
+	b.Process()
+	if got := b.Channels("foo"); len(got) != 1 || got[0] != "bar#ephemeral" {
+		t.Errorf("Expected ephemeral channel, Got %v", got)
+	}
+
+	// ephemeral channels go with their last subscriber
+	sub.Disconnect()
+	if got := b.Channels("foo"); len(got) != 0 {
+		t.Errorf("Expected ephemeral channel to be deleted, Got %v", got)
+	}
+}
+
+func TestFakeBrokerGlobalSubscriber(t *testing.T) {
+	b := NewFakeBroker()
+	h := &recordingHandler{}
+	sub := b.NewGlobalSubscriber("foo", "bar")
+	sub.AddHandler(h)
+	if err := sub.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	b.Publish("foo", []byte("local"))
+	b.PublishFederated("foo", []byte("federated"))
+	b.Process()
+	if got := h.bodies; len(got) != 2 || got[0] != "local" || got[1] != "federated" {
+		t.Errorf("Expected local and federated messages, Got %v", got)
+	}
+}
+
+func TestFakeBrokerDeadLetters(t *testing.T) {
+	b := NewFakeBroker()
+	sub := b.NewSubscriber("foo", "bar")
+	sub.AddHandler(RetryHandler("foo", "bar", RetryPolicy{MaxAttempts: 2, InitialDelay: time.Second, Publisher: b},
+		nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+			return errors.New("boom")
+		})))
+	sub.Connect()
+
+	b.Publish("foo", []byte("hello"))
+	b.Process()
+	b.Advance(time.Second)
+
+	dlq := b.Published(DeadLetterTopic("foo", "bar"))
+	if len(dlq) != 1 {
+		t.Fatalf("Expected message to be deadlettered, Got %d", len(dlq))
+	}
+	e, err := UnmarshalEnvelope(dlq[0])
+	if err != nil {
+		t.Fatalf("Failed to unmarshal deadletter: %v", err)
+	}
+	if e.Header(HeaderDeadLetterAttempts) != "2" {
+		t.Errorf("Expected 2 attempts, Got %v", e.Header(HeaderDeadLetterAttempts))
+	}
+}
+
+func TestFakeBrokerTypedDeadLetters(t *testing.T) {
+	b := NewFakeBroker()
+	sub := b.NewSubscriber("foo", "bar")
+	sub.AddTypedHandler(func() interface{} { return &typedFoo{} }, func(ctx context.Context, msg interface{}) error {
+		t.Error("Expected undecodable message not to be handled")
+		return nil
+	})
+	sub.Connect()
+
+	b.Publish("foo", []byte("not json"))
+	b.Process()
+	if dlq := b.Published(DeadLetterTopic("foo", "bar")); len(dlq) != 1 {
+		t.Errorf("Expected undecodable message to be deadlettered to the broker, Got %d", len(dlq))
+	}
+}
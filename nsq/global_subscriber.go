@@ -2,6 +2,7 @@ package nsq
 
 import (
 	nsqlib "github.com/HailoOSS/go-nsq"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -20,6 +21,11 @@ func (s *DefaultGlobalSubscriber) SetMaxInFlight(v int) {
 	s.federatedSubscriber.SetMaxInFlight(v)
 }
 
+func (s *DefaultGlobalSubscriber) EnableAdaptive(opts AdaptiveOptions) {
+	s.localSubscriber.EnableAdaptive(opts)
+	s.federatedSubscriber.EnableAdaptive(opts)
+}
+
 func (s *DefaultGlobalSubscriber) AddHandler(handler nsqlib.Handler) {
 	s.localSubscriber.AddHandler(handler)
 	s.federatedSubscriber.AddHandler(handler)
@@ -30,6 +36,11 @@ func (s *DefaultGlobalSubscriber) AddHandlers(handler nsqlib.Handler) {
 	s.federatedSubscriber.AddHandlers(handler)
 }
 
+func (s *DefaultGlobalSubscriber) AddTypedHandler(factory func() interface{}, handler TypedHandlerFunc) {
+	s.localSubscriber.AddTypedHandler(factory, handler)
+	s.federatedSubscriber.AddTypedHandler(factory, handler)
+}
+
 func (s *DefaultGlobalSubscriber) Connect() error {
 	if err := s.localSubscriber.Connect(); err != nil {
 		return err
@@ -45,6 +56,20 @@ func (s *DefaultGlobalSubscriber) Disconnect() {
 	s.federatedSubscriber.Disconnect()
 }
 
+// Drain drains the local and federated subscribers concurrently, returning the
+// first error
+func (s *DefaultGlobalSubscriber) Drain(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.federatedSubscriber.Drain(ctx)
+	}()
+	err := s.localSubscriber.Drain(ctx)
+	if ferr := <-errs; err == nil {
+		err = ferr
+	}
+	return err
+}
+
 func (s *DefaultGlobalSubscriber) IsStarved() bool {
 	return s.localSubscriber.IsStarved() || s.federatedSubscriber.IsStarved()
 }
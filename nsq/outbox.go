@@ -0,0 +1,575 @@
+package nsq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	segmentSuffix = ".outbox"
+	cursorFile    = "cursor"
+	// record header: payload length, payload checksum
+	recordHeaderLen = 8
+
+	defaultOutboxMaxBytes      int64 = 512 * 1024 * 1024
+	defaultOutboxSegmentBytes  int64 = 16 * 1024 * 1024
+	defaultOutboxRetryInterval       = time.Second
+)
+
+var (
+	ErrOutboxFull   = errors.New("NSQ outbox is full")
+	ErrOutboxClosed = errors.New("NSQ outbox is closed")
+
+	errCorruptRecord = errors.New("Corrupt outbox record")
+)
+
+// DropPolicy decides what happens when the outbox is full
+type DropPolicy int
+
+const (
+	// DropNewest refuses new messages, so publishing fails as it would without an outbox
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest segment(s) of messages to make room
+	DropOldest
+)
+
+// OutboxOptions configures an outbox; zero values take the defaults
+type OutboxOptions struct {
+	// MaxBytes bounds the size of the outbox on disk (default 512MB)
+	MaxBytes int64
+	// SegmentBytes is the size at which we start writing a new segment file (default 16MB)
+	SegmentBytes int64
+	// DropPolicy decides what to do when the outbox is full (default DropNewest)
+	DropPolicy DropPolicy
+	// RetryInterval is how often we attempt to replay the outbox while NSQ is unreachable (default 1s)
+	RetryInterval time.Duration
+}
+
+// Outbox is a local write-ahead log of messages which could not be PUBbed to enough NSQs. Messages are appended to a
+// series of segment files within a directory (which should belong to this process alone), and replayed in order once
+// NSQ is reachable again. Replay is at-least-once: messages may be PUBbed again if we crash part way through.
+type Outbox struct {
+	sync.Mutex
+	dir  string
+	opts OutboxOptions
+	// segments are ordered oldest first; we read from the first and write to the last
+	segments []*outboxSegment
+	writer   *os.File
+	reader   *os.File
+	// readOffset is how far through the first segment we have replayed
+	readOffset int64
+	// size is the total size of our segments on disk, and count the number of messages yet to be replayed
+	size   int64
+	count  int
+	closed bool
+	// replayMtx ensures only one replay happens at a time
+	replayMtx sync.Mutex
+}
+
+type outboxSegment struct {
+	id    uint64
+	size  int64
+	count int
+}
+
+// outboxRecord is a single (multi) publish within the outbox
+type outboxRecord struct {
+	topic string
+	body  [][]byte
+}
+
+// NewOutbox opens (creating if necessary) the outbox within `dir`, recovering anything left there by a previous process
+func NewOutbox(dir string, opts OutboxOptions) (*Outbox, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultOutboxMaxBytes
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = defaultOutboxSegmentBytes
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultOutboxRetryInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:  dir,
+		opts: opts,
+	}
+	if err := o.recover(); err != nil {
+		return nil, err
+	}
+	o.instrument()
+
+	log.Infof("Opened outbox %s with %d messages (%d bytes) waiting", dir, o.count, o.size)
+	return o, nil
+}
+
+// recover loads the segments and cursor found on disk, discarding anything already replayed and any torn writes
+func (o *Outbox) recover() error {
+	cursorId, cursorOffset := o.readCursor()
+
+	files, err := filepath.Glob(filepath.Join(o.dir, "*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	ids := make([]uint64, 0, len(files))
+	for _, f := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), segmentSuffix), 10, 64)
+		if err != nil {
+			log.Warnf("Ignoring unexpected file in outbox: %s", f)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64s(ids))
+
+	nextId := cursorId + 1
+	for _, id := range ids {
+		if id < cursorId {
+			// fully replayed, but not cleaned up
+			if err := os.Remove(o.segmentPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		from := int64(0)
+		if id == cursorId {
+			from = cursorOffset
+		}
+		seg, err := o.recoverSegment(id, from)
+		if err != nil {
+			return err
+		}
+		if len(o.segments) == 0 && id == cursorId {
+			o.readOffset = from
+			if o.readOffset > seg.size {
+				o.readOffset = seg.size
+			}
+		}
+		o.segments = append(o.segments, seg)
+		o.size += seg.size
+		o.count += seg.count
+		nextId = id + 1
+	}
+
+	// always start writing to a fresh segment, so we never append after a torn write
+	return o.newSegment(nextId)
+}
+
+// recoverSegment validates the records within a segment, counting those from the given offset and truncating the file
+// at the first record which is incomplete or corrupt
+func (o *Outbox) recoverSegment(id uint64, from int64) (*outboxSegment, error) {
+	f, err := os.OpenFile(o.segmentPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &outboxSegment{id: id}
+	for {
+		rec, n, err := readRecord(f, seg.size, fi.Size())
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Errorf("Truncating outbox segment %d at %d: %v", id, seg.size, err)
+			if err := f.Truncate(seg.size); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if seg.size >= from {
+			seg.count += len(rec.body)
+		}
+		seg.size += n
+	}
+	return seg, nil
+}
+
+func (o *Outbox) segmentPath(id uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// newSegment starts writing to a new segment. The caller must hold the lock (or have exclusive access).
+func (o *Outbox) newSegment(id uint64) error {
+	f, err := os.OpenFile(o.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if o.writer != nil {
+		o.writer.Close()
+	}
+	o.writer = f
+	o.segments = append(o.segments, &outboxSegment{id: id})
+	return nil
+}
+
+// readCursor returns the position up to which we have replayed, as persisted by writeCursor
+func (o *Outbox) readCursor() (uint64, int64) {
+	b, err := ioutil.ReadFile(filepath.Join(o.dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &id, &offset); err != nil {
+		log.Warnf("Ignoring invalid outbox cursor: %v", err)
+		return 0, 0
+	}
+	return id, offset
+}
+
+// writeCursor persists the position up to which we have replayed. The caller must hold the lock.
+func (o *Outbox) writeCursor() error {
+	tmp := filepath.Join(o.dir, cursorFile+".tmp")
+	data := fmt.Sprintf("%d %d", o.segments[0].id, o.readOffset)
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(o.dir, cursorFile))
+}
+
+// Append durably writes a (multi) publish to the outbox
+func (o *Outbox) Append(topic string, body [][]byte) error {
+	if len(body) <= 0 {
+		return ErrEmptyBody
+	}
+	rec := encodeRecord(topic, body)
+
+	o.Lock()
+	defer o.Unlock()
+	defer o.instrument()
+
+	if o.closed {
+		return ErrOutboxClosed
+	}
+	if err := o.makeRoom(int64(len(rec))); err != nil {
+		inst.Counter(1.0, "nsq.outbox.dropped", len(body))
+		return err
+	}
+
+	tail := o.segments[len(o.segments)-1]
+	if tail.size > 0 && tail.size+int64(len(rec)) > o.opts.SegmentBytes {
+		if err := o.newSegment(tail.id + 1); err != nil {
+			inst.Counter(1.0, "nsq.outbox.append.failure")
+			return err
+		}
+		tail = o.segments[len(o.segments)-1]
+	}
+
+	n, err := o.writer.Write(rec)
+	if err == nil {
+		err = o.writer.Sync()
+	}
+	if err != nil {
+		// don't leave a torn write for the reader to trip over
+		o.writer.Truncate(tail.size)
+		inst.Counter(1.0, "nsq.outbox.append.failure")
+		return err
+	}
+
+	tail.size += int64(n)
+	tail.count += len(body)
+	o.size += int64(n)
+	o.count += len(body)
+	inst.Counter(1.0, "nsq.outbox.appended", len(body))
+
+	return nil
+}
+
+// makeRoom applies the drop policy, if required, so that `n` more bytes fit within the outbox. The caller must hold
+// the lock.
+func (o *Outbox) makeRoom(n int64) error {
+	if n > o.opts.MaxBytes {
+		return ErrOutboxFull
+	}
+	if o.size+n <= o.opts.MaxBytes {
+		return nil
+	}
+	if o.opts.DropPolicy != DropOldest {
+		log.Warnf("Outbox %s is full, refusing message", o.dir)
+		return ErrOutboxFull
+	}
+
+	for o.size+n > o.opts.MaxBytes {
+		head := o.segments[0]
+		log.Warnf("Outbox %s is full, dropping %d messages from segment %d", o.dir, head.count, head.id)
+		inst.Counter(1.0, "nsq.outbox.dropped", head.count)
+		if err := o.removeHead(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeHead removes the oldest segment, either because it has been replayed or is being dropped. If it is the only
+// segment, we start writing a new one. The caller must hold the lock.
+func (o *Outbox) removeHead() error {
+	head := o.segments[0]
+	if len(o.segments) == 1 {
+		if err := o.newSegment(head.id + 1); err != nil {
+			return err
+		}
+	}
+	if o.reader != nil {
+		o.reader.Close()
+		o.reader = nil
+	}
+
+	o.segments = o.segments[1:]
+	o.size -= head.size
+	o.count -= head.count
+	o.readOffset = 0
+	return os.Remove(o.segmentPath(head.id))
+}
+
+// next returns the next record to be replayed, along with the position it was read from. A nil record means there is
+// nothing waiting.
+func (o *Outbox) next() (*outboxRecord, uint64, int64, int64, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return nil, 0, 0, 0, ErrOutboxClosed
+	}
+
+	// skip past anything we have finished with
+	for o.readOffset >= o.segments[0].size {
+		if len(o.segments) == 1 && o.segments[0].size == 0 {
+			return nil, 0, 0, 0, nil
+		}
+		if err := o.removeHead(); err != nil {
+			return nil, 0, 0, 0, err
+		}
+	}
+
+	head := o.segments[0]
+	if o.reader == nil {
+		f, err := os.Open(o.segmentPath(head.id))
+		if err != nil {
+			return nil, 0, 0, 0, err
+		}
+		o.reader = f
+	}
+	rec, n, err := readRecord(o.reader, o.readOffset, head.size)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return rec, head.id, o.readOffset, n, nil
+}
+
+// advance moves past a record which has been replayed, unless it was dropped while we were replaying it
+func (o *Outbox) advance(id uint64, offset, n int64, count int) {
+	o.Lock()
+	defer o.Unlock()
+	defer o.instrument()
+
+	if o.closed || o.segments[0].id != id || o.readOffset != offset {
+		return
+	}
+	o.readOffset += n
+	o.segments[0].count -= count
+	o.count -= count
+	if err := o.writeCursor(); err != nil {
+		log.Warnf("Failed to persist outbox cursor: %v", err)
+	}
+}
+
+// Replay publishes everything waiting in the outbox, in order, stopping at the first failure. It returns how many
+// messages were replayed.
+func (o *Outbox) Replay(publish func(topic string, body [][]byte) error) (int, error) {
+	o.replayMtx.Lock()
+	defer o.replayMtx.Unlock()
+
+	replayed := 0
+	for {
+		rec, id, offset, n, err := o.next()
+		if err != nil {
+			log.Errorf("Failed to read from outbox %s: %v", o.dir, err)
+			return replayed, err
+		}
+		if rec == nil {
+			return replayed, nil
+		}
+
+		if err := publish(rec.topic, rec.body); err != nil {
+			inst.Counter(1.0, "nsq.outbox.replay.failure")
+			return replayed, err
+		}
+		o.advance(id, offset, n, len(rec.body))
+		replayed += len(rec.body)
+		inst.Counter(1.0, "nsq.outbox.replayed", len(rec.body))
+	}
+}
+
+// Flush replays the outbox until it is empty, retrying while NSQ is unreachable, or until the context is done
+func (o *Outbox) Flush(ctx context.Context, publish func(topic string, body [][]byte) error) error {
+	for {
+		_, err := o.Replay(publish)
+		if err == ErrOutboxClosed {
+			return err
+		}
+		if o.Len() == 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(o.opts.RetryInterval):
+		case <-ctx.Done():
+			log.Warnf("Gave up flushing outbox %s with %d messages waiting: %v", o.dir, o.Len(), ctx.Err())
+			return ctx.Err()
+		}
+	}
+}
+
+// Len returns the number of messages waiting to be replayed
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.count
+}
+
+// Size returns the size of the outbox on disk, in bytes
+func (o *Outbox) Size() int64 {
+	o.Lock()
+	defer o.Unlock()
+	return o.size
+}
+
+// Close closes the outbox. Anything waiting remains on disk, to be replayed by the next process to open it.
+func (o *Outbox) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	if o.reader != nil {
+		o.reader.Close()
+	}
+	return o.writer.Close()
+}
+
+// instrument reports the outbox backlog. The caller must hold the lock.
+func (o *Outbox) instrument() {
+	inst.Gauge(1.0, "nsq.outbox.messages", o.count)
+	inst.Gauge(1.0, "nsq.outbox.bytes", int(o.size))
+}
+
+// encodeRecord serialises a publish as a header (payload length and checksum) followed by the payload: the topic
+// (16 bit length prefixed), then the number of messages, then each message (32 bit length prefixed)
+func encodeRecord(topic string, body [][]byte) []byte {
+	n := 2 + len(topic) + 4
+	for _, b := range body {
+		n += 4 + len(b)
+	}
+
+	buf := make([]byte, recordHeaderLen+n)
+	p := buf[recordHeaderLen:]
+	binary.BigEndian.PutUint16(p, uint16(len(topic)))
+	p = p[2:]
+	p = p[copy(p, topic):]
+	binary.BigEndian.PutUint32(p, uint32(len(body)))
+	p = p[4:]
+	for _, b := range body {
+		binary.BigEndian.PutUint32(p, uint32(len(b)))
+		p = p[4:]
+		p = p[copy(p, b):]
+	}
+
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[recordHeaderLen:]))
+	return buf
+}
+
+// readRecord reads the record at `offset`, returning it and its size. io.EOF is returned if there is no record there,
+// and io.ErrUnexpectedEOF if the record runs beyond `end`.
+func readRecord(r io.ReaderAt, offset, end int64) (*outboxRecord, int64, error) {
+	if offset >= end {
+		return nil, 0, io.EOF
+	}
+	if offset+recordHeaderLen > end {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, recordHeaderLen)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+
+	payloadLen := int64(binary.BigEndian.Uint32(header))
+	if offset+recordHeaderLen+payloadLen > end {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, payloadLen)
+	if _, err := r.ReadAt(payload, offset+recordHeaderLen); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	rec, err := decodePayload(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, int64(recordHeaderLen + len(payload)), nil
+}
+
+func decodePayload(p []byte) (*outboxRecord, error) {
+	if len(p) < 2 {
+		return nil, errCorruptRecord
+	}
+	topicLen := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < topicLen+4 {
+		return nil, errCorruptRecord
+	}
+	rec := &outboxRecord{topic: string(p[:topicLen])}
+	p = p[topicLen:]
+	count := int(binary.BigEndian.Uint32(p))
+	p = p[4:]
+
+	for i := 0; i < count; i++ {
+		if len(p) < 4 {
+			return nil, errCorruptRecord
+		}
+		bodyLen := int(binary.BigEndian.Uint32(p))
+		p = p[4:]
+		if len(p) < bodyLen {
+			return nil, errCorruptRecord
+		}
+		rec.body = append(rec.body, p[:bodyLen])
+		p = p[bodyLen:]
+	}
+	return rec, nil
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
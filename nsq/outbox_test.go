@@ -0,0 +1,214 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type published struct {
+	topic string
+	body  string
+}
+
+func recordingPublisher(out *[]published) func(string, [][]byte) error {
+	return func(topic string, body [][]byte) error {
+		for _, b := range body {
+			*out = append(*out, published{topic, string(b)})
+		}
+		return nil
+	}
+}
+
+func tempOutbox(t *testing.T, opts OutboxOptions) (*Outbox, string) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	o, err := NewOutbox(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open outbox: %v", err)
+	}
+	return o, dir
+}
+
+func TestOutboxReplaysInOrder(t *testing.T) {
+	o, dir := tempOutbox(t, OutboxOptions{SegmentBytes: 64})
+	defer os.RemoveAll(dir)
+	defer o.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := o.Append("foo", [][]byte{[]byte(fmt.Sprintf("msg-%d", i))}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := o.Append("bar", [][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if o.Len() != 12 {
+		t.Errorf("Want 12 messages waiting, Got %d", o.Len())
+	}
+
+	// a failed publish leaves everything in place
+	if _, err := o.Replay(func(string, [][]byte) error { return errors.New("nsq down") }); err == nil {
+		t.Error("Expected replay to fail")
+	}
+
+	var got []published
+	n, err := o.Replay(recordingPublisher(&got))
+	if err != nil || n != 12 {
+		t.Fatalf("Want 12 replayed, Got %d (%v)", n, err)
+	}
+	for i := 0; i < 10; i++ {
+		if want := (published{"foo", fmt.Sprintf("msg-%d", i)}); got[i] != want {
+			t.Errorf("Want %v, Got %v", want, got[i])
+		}
+	}
+	if got[10] != (published{"bar", "a"}) || got[11] != (published{"bar", "b"}) {
+		t.Errorf("Unexpected multi publish replay %v", got[10:])
+	}
+	if o.Len() != 0 {
+		t.Errorf("Want empty outbox, Got %d messages", o.Len())
+	}
+
+	// replayed segments are cleaned up
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(files) != 1 {
+		t.Errorf("Want a single segment left, Got %v", files)
+	}
+}
+
+func TestOutboxRecovery(t *testing.T) {
+	o, dir := tempOutbox(t, OutboxOptions{})
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 3; i++ {
+		o.Append("foo", [][]byte{[]byte(fmt.Sprintf("msg-%d", i))})
+	}
+	// replay just the first message
+	calls := 0
+	o.Replay(func(string, [][]byte) error {
+		if calls++; calls > 1 {
+			return errors.New("nsq down")
+		}
+		return nil
+	})
+	o.Close()
+
+	// simulate a torn write by a crashed process
+	last := o.segmentPath(o.segments[len(o.segments)-1].id)
+	f, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encodeRecord("foo", [][]byte{[]byte("torn")})[:10])
+	f.Close()
+
+	o, err := NewOutbox(dir, OutboxOptions{})
+	if err != nil {
+		t.Fatalf("Failed to reopen outbox: %v", err)
+	}
+	defer o.Close()
+	if o.Len() != 2 {
+		t.Errorf("Want 2 messages recovered, Got %d", o.Len())
+	}
+
+	var got []published
+	o.Replay(recordingPublisher(&got))
+	if len(got) != 2 || got[0].body != "msg-1" || got[1].body != "msg-2" {
+		t.Errorf("Unexpected replay after recovery %v", got)
+	}
+}
+
+func TestOutboxDropPolicy(t *testing.T) {
+	msg := [][]byte{make([]byte, 100)}
+	recLen := int64(len(encodeRecord("foo", msg)))
+
+	o, dir := tempOutbox(t, OutboxOptions{MaxBytes: recLen * 3, SegmentBytes: recLen})
+	defer os.RemoveAll(dir)
+	for i := 0; i < 3; i++ {
+		if err := o.Append("foo", msg); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := o.Append("foo", msg); err != ErrOutboxFull {
+		t.Errorf("Want %v, Got %v", ErrOutboxFull, err)
+	}
+	o.Close()
+
+	o, err := NewOutbox(dir, OutboxOptions{MaxBytes: recLen * 3, SegmentBytes: recLen, DropPolicy: DropOldest})
+	if err != nil {
+		t.Fatalf("Failed to reopen outbox: %v", err)
+	}
+	defer o.Close()
+	if err := o.Append("bar", msg); err != nil {
+		t.Errorf("Expected oldest to be dropped, Got %v", err)
+	}
+	if o.Len() != 3 || o.Size() > recLen*3 {
+		t.Errorf("Want 3 messages within bounds, Got %d (%d bytes)", o.Len(), o.Size())
+	}
+
+	var got []published
+	o.Replay(recordingPublisher(&got))
+	if len(got) != 3 || got[2].topic != "bar" {
+		t.Errorf("Unexpected replay after drop %v", got)
+	}
+}
+
+func TestOutboxFlush(t *testing.T) {
+	o, dir := tempOutbox(t, OutboxOptions{RetryInterval: time.Millisecond})
+	defer os.RemoveAll(dir)
+	defer o.Close()
+
+	o.Append("foo", [][]byte{[]byte("a")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	down := func(string, [][]byte) error { return errors.New("nsq down") }
+	if err := o.Flush(ctx, down); err != context.DeadlineExceeded {
+		t.Errorf("Want %v, Got %v", context.DeadlineExceeded, err)
+	}
+
+	// nsq comes back part way through
+	attempts := 0
+	flaky := func(string, [][]byte) error {
+		if attempts++; attempts < 3 {
+			return errors.New("nsq down")
+		}
+		return nil
+	}
+	if err := o.Flush(context.Background(), flaky); err != nil || o.Len() != 0 {
+		t.Errorf("Expected outbox to be flushed, Got %v (%d waiting)", err, o.Len())
+	}
+}
+
+func TestPublisherFallsBackToOutbox(t *testing.T) {
+	o, dir := tempOutbox(t, OutboxOptions{RetryInterval: time.Hour})
+	defer os.RemoveAll(dir)
+	defer o.Close()
+
+	// no hosts are configured, so every PUB fails
+	p := &HostpoolPublisher{}
+	p.once.Do(func() {})
+	if err := p.Publish("foo", []byte("a")); err == nil {
+		t.Fatal("Expected publish to fail without an outbox")
+	}
+
+	p.SetOutbox(o)
+	defer p.SetOutbox(nil)
+	if err := p.Publish("foo", []byte("a")); err != nil {
+		t.Fatalf("Expected publish to succeed with an outbox, Got %v", err)
+	}
+	if o.Len() != 1 {
+		t.Errorf("Want 1 message in outbox, Got %d", o.Len())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Want %v, Got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/net/context"
 
 	log "github.com/cihub/seelog"
 	"github.com/HailoOSS/go-hostpool"
@@ -46,6 +47,11 @@ func getDLQName(topic, channel string) string {
 	return deadletter
 }
 
+// DeadLetterTopic returns the name of the deadletter queue for a topic/channel
+func DeadLetterTopic(topic, channel string) string {
+	return getDLQName(topic, channel)
+}
+
 // Publisher is our wrapper round NSQ PUB for auto-config
 type Publisher interface {
 	MultiPublish(topic string, body [][]byte) error
@@ -62,6 +68,34 @@ func Publish(topic string, body []byte) error {
 	return DefaultPublisher.Publish(topic, body)
 }
 
+// Flush waits for DefaultPublisher to replay its outbox (if it has one), or until the context is done. It should be
+// called on shutdown.
+func Flush(ctx context.Context) error {
+	if f, ok := DefaultPublisher.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// EnableOutbox gives DefaultPublisher an outbox within `dir`, so that messages which cannot be PUBbed are kept on disk
+// and replayed later, rather than failing
+func EnableOutbox(dir string, opts OutboxOptions) error {
+	p, ok := DefaultPublisher.(*HostpoolPublisher)
+	if !ok {
+		return fmt.Errorf("DefaultPublisher does not support an outbox")
+	}
+	o, err := NewOutbox(dir, opts)
+	if err != nil {
+		return err
+	}
+	p.SetOutbox(o)
+	return nil
+}
+
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
 // PublishDeadLetter puts messages on the deadletter queue for a topic/channel.
 func PublishDeadLetter(topic, channel string, body []byte) error {
 	deadletter := getDLQName(topic, channel)
@@ -92,6 +126,9 @@ type HostpoolPublisher struct {
 	instrumentationSampleRate float32
 	// hash of current config, to avoid locking and updating if we don't have to
 	configHash string
+	// outbox (if set) holds messages we could not PUB until they can be replayed
+	outbox     *Outbox
+	stopReplay chan struct{}
 }
 
 // DefaultPublisher is a default implementation of the Publisher interface.
@@ -101,7 +138,9 @@ var DefaultPublisher Publisher = &HostpoolPublisher{
 	hostpool:  hostpool.New([]string{}),
 }
 
-// MultiPublish pubs X messages at once, synchronously, to N of M NSQs
+// MultiPublish pubs X messages at once, synchronously, to N of M NSQs. If we have an outbox, messages which cannot be
+// PUBbed to enough NSQs are appended to it instead, as are any messages published while it is being replayed (so that
+// they stay in order).
 func (p *HostpoolPublisher) MultiPublish(topic string, body [][]byte) error {
 
 	if len(body) <= 0 {
@@ -112,6 +151,22 @@ func (p *HostpoolPublisher) MultiPublish(topic string, body [][]byte) error {
 
 	p.once.Do(p.setup)
 
+	o := p.getOutbox()
+	if o == nil {
+		return p.multiPublish(topic, body)
+	}
+	if o.Len() == 0 {
+		err := p.multiPublish(topic, body)
+		if err == nil {
+			return nil
+		}
+		log.Warnf("Failed to PUB to NSQ, appending to outbox: %v", err)
+	}
+	return o.Append(topic, body)
+}
+
+// multiPublish pubs X messages at once, synchronously, to N of M NSQs
+func (p *HostpoolPublisher) multiPublish(topic string, body [][]byte) error {
 	p.RLock()
 	defer p.RUnlock()
 
@@ -168,6 +223,62 @@ func (publisher *HostpoolPublisher) Publish(topic string, body []byte) error {
 	return publisher.MultiPublish(topic, [][]byte{body})
 }
 
+// SetOutbox sets (or with nil, removes) the outbox to which we append messages that cannot be PUBbed, and replays it
+// in the background
+func (p *HostpoolPublisher) SetOutbox(o *Outbox) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.stopReplay != nil {
+		close(p.stopReplay)
+		p.stopReplay = nil
+	}
+	p.outbox = o
+	if o != nil {
+		p.stopReplay = make(chan struct{})
+		go p.replayLoop(o, p.stopReplay)
+	}
+}
+
+func (p *HostpoolPublisher) getOutbox() *Outbox {
+	p.RLock()
+	defer p.RUnlock()
+	return p.outbox
+}
+
+// replayLoop periodically replays the outbox, until stopped
+func (p *HostpoolPublisher) replayLoop(o *Outbox, stop chan struct{}) {
+	p.once.Do(p.setup)
+
+	tick := time.NewTicker(o.opts.RetryInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		if o.Len() == 0 {
+			continue
+		}
+		if n, err := o.Replay(p.multiPublish); err != nil {
+			log.Debugf("Failed to replay NSQ outbox (%d messages replayed): %v", n, err)
+		} else {
+			log.Infof("Replayed %d messages from NSQ outbox", n)
+		}
+	}
+}
+
+// Flush replays the outbox (if we have one) until it is empty, or the context is done
+func (p *HostpoolPublisher) Flush(ctx context.Context) error {
+	o := p.getOutbox()
+	if o == nil {
+		return nil
+	}
+	p.once.Do(p.setup)
+	return o.Flush(ctx, p.multiPublish)
+}
+
 // setup is a one-time action that loads PUB hosts from config and sets up a config subscriber
 func (p *HostpoolPublisher) setup() {
 	// Wait 5 mins for config to load. If we cannot load config by the
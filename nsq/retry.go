@@ -0,0 +1,193 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	defaultRetryMaxAttempts  = 5
+	defaultRetryInitialDelay = time.Second
+	defaultRetryMaxDelay     = 10 * time.Minute
+	defaultRetryMultiplier   = 2.0
+)
+
+// Headers added to the envelope of a message when it is sent to a deadletter queue
+const (
+	HeaderDeadLetterError     = "deadletter.error"
+	HeaderDeadLetterPermanent = "deadletter.permanent"
+	HeaderDeadLetterAttempts  = "deadletter.attempts"
+	HeaderDeadLetterTopic     = "deadletter.topic"
+	HeaderDeadLetterChannel   = "deadletter.channel"
+	// HeaderDeadLetterReceived is when NSQ first received the message, and HeaderDeadLetterFailed when we gave up on it
+	// (both RFC3339)
+	HeaderDeadLetterReceived = "deadletter.receivedAt"
+	HeaderDeadLetterFailed   = "deadletter.failedAt"
+	// HeaderDeadLetterLegacy marks messages which were not originally published within an envelope
+	HeaderDeadLetterLegacy = "deadletter.legacy"
+)
+
+// RetryPolicy decides how a failing message is redelivered, and when we give up on it; zero values take the defaults
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts after which a message is deadlettered (default 5)
+	MaxAttempts uint16
+	// InitialDelay is the requeue delay after the first attempt, which grows by Multiplier each attempt after that, up
+	// to MaxDelay (defaults 1s, 2, 10m)
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	// Retryable classifies errors; by default only those marked with Permanent are not worth retrying
+	Retryable func(err error) bool
+	// Publisher is used to publish deadletters (default DefaultPublisher)
+	Publisher Publisher
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = defaultRetryInitialDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultRetryMultiplier
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.Retryable == nil {
+		p.Retryable = func(err error) bool { return !IsPermanent(err) }
+	}
+	if p.Publisher == nil {
+		p.Publisher = DefaultPublisher
+	}
+	return p
+}
+
+// delay returns the requeue delay following the given attempt
+func (p RetryPolicy) delay(attempts uint16) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := uint16(1); i < attempts; i++ {
+		d *= p.Multiplier
+		if d >= float64(p.MaxDelay) {
+			return p.MaxDelay
+		}
+	}
+	return time.Duration(d)
+}
+
+// permanentError marks an error as not worth retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks an error as permanent, so that a message which fails with it is deadlettered without being retried
+// (eg: because it cannot be decoded)
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether an error was marked with Permanent
+func IsPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// RetryHandler wraps a handler for `topic` and `channel`, so that messages which fail are requeued with exponential
+// backoff, and once they have failed too many times (or fail permanently) are sent to the channel's deadletter queue
+// with details of the failure. Messages are requeued if they cannot be deadlettered.
+func RetryHandler(topic, channel string, policy RetryPolicy, h nsqlib.Handler) nsqlib.Handler {
+	policy = policy.withDefaults()
+
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		err := h.HandleMessage(msg)
+		if err == nil {
+			return nil
+		}
+
+		retryable := policy.Retryable(err)
+		if retryable && msg.Attempts < policy.MaxAttempts {
+			delay := policy.delay(msg.Attempts)
+			log.Debugf("Requeuing message %x from %s/%s in %v after attempt %d: %v", msg.ID, topic, channel, delay,
+				msg.Attempts, err)
+			inst.Counter(1.0, "nsq.retry.requeued")
+			msg.Requeue(delay)
+			return err
+		}
+
+		if dlErr := deadLetter(policy.Publisher, topic, channel, msg, err, !retryable); dlErr != nil {
+			log.Errorf("Failed to deadletter message %x from %s/%s: %v", msg.ID, topic, channel, dlErr)
+			inst.Counter(1.0, "nsq.retry.deadletter.failure")
+			msg.Requeue(policy.MaxDelay)
+			return err
+		}
+		inst.Counter(1.0, "nsq.retry.deadlettered")
+		return nil
+	})
+}
+
+// deadLetter publishes a message to the deadletter queue for a topic/channel, within an envelope describing why
+func deadLetter(p Publisher, topic, channel string, msg *nsqlib.Message, cause error, permanent bool) error {
+	e, err := MessageEnvelope(msg)
+	if err != nil {
+		// we can't make sense of the envelope, so keep the message exactly as it was
+		e = &Envelope{Id: fmt.Sprintf("%x", msg.ID), Body: msg.Body, Legacy: true}
+	}
+	if e.Legacy {
+		e.SetHeader(HeaderDeadLetterLegacy, "true")
+	}
+	e.SetHeader(HeaderDeadLetterError, cause.Error())
+	e.SetHeader(HeaderDeadLetterPermanent, strconv.FormatBool(permanent))
+	e.SetHeader(HeaderDeadLetterAttempts, strconv.Itoa(int(msg.Attempts)))
+	e.SetHeader(HeaderDeadLetterTopic, topic)
+	e.SetHeader(HeaderDeadLetterChannel, channel)
+	e.SetHeader(HeaderDeadLetterReceived, time.Unix(0, msg.Timestamp).Format(time.RFC3339))
+	e.SetHeader(HeaderDeadLetterFailed, time.Now().Format(time.RFC3339))
+
+	deadletter := getDLQName(topic, channel)
+	log.Errorf("Failed to process message after %d attempts. Sending to deadletter %s: %v", msg.Attempts, deadletter,
+		cause)
+	return PublishEnvelopeVia(p, deadletter, e)
+}
+
+// ErrDeadLetterHeaders is returned when trying to restore a message which was not deadlettered by RetryHandler
+var ErrDeadLetterHeaders = errors.New("Message has no deadletter headers")
+
+// OriginalMessage returns a deadlettered message as it was originally published (ie: without the deadletter headers,
+// or without any envelope at all if it was not published within one), along with the topic it was published to
+func OriginalMessage(e *Envelope) (string, []byte, error) {
+	topic := e.Header(HeaderDeadLetterTopic)
+	if topic == "" {
+		return "", nil, ErrDeadLetterHeaders
+	}
+	if e.Header(HeaderDeadLetterLegacy) == "true" {
+		return topic, e.Body, nil
+	}
+
+	orig := *e
+	orig.Headers = make(map[string]string)
+	for k, v := range e.Headers {
+		switch k {
+		case HeaderDeadLetterError, HeaderDeadLetterPermanent, HeaderDeadLetterAttempts, HeaderDeadLetterTopic,
+			HeaderDeadLetterChannel, HeaderDeadLetterReceived, HeaderDeadLetterFailed, HeaderDeadLetterLegacy:
+		default:
+			orig.Headers[k] = v
+		}
+	}
+	b, err := orig.Marshal()
+	return topic, b, err
+}
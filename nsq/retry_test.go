@@ -0,0 +1,114 @@
+package nsq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}.withDefaults()
+	testCases := []struct {
+		attempts uint16
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tc := range testCases {
+		if d := p.delay(tc.attempts); d != tc.expected {
+			t.Errorf("Attempt %d: Want %v, Got %v", tc.attempts, tc.expected, d)
+		}
+	}
+}
+
+func TestRetryHandler(t *testing.T) {
+	r := &batchRecorder{}
+	failure := errors.New("boom")
+	h := RetryHandler("foo", "bar", RetryPolicy{MaxAttempts: 3, Publisher: r},
+		nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+			if string(msg.Body) == "bad" {
+				return Permanent(errors.New("cannot decode"))
+			}
+			return failure
+		}))
+
+	msg := nsqlib.NewMessage(nsqlib.MessageID{}, []byte("raw"))
+	msg.Timestamp = time.Now().UnixNano()
+	for msg.Attempts = 1; msg.Attempts < 3; msg.Attempts++ {
+		if err := h.HandleMessage(msg); err != failure {
+			t.Errorf("Attempt %d: Want %v, Got %v", msg.Attempts, failure, err)
+		}
+	}
+	if len(r.sent()) != 0 {
+		t.Fatalf("Expected no deadletters before max attempts, Got %v", r.sent())
+	}
+
+	if err := h.HandleMessage(msg); err != nil {
+		t.Errorf("Expected deadlettered message to be finished, Got %v", err)
+	}
+	if len(r.sent()) != 1 {
+		t.Fatalf("Expected a deadletter, Got %v", r.sent())
+	}
+	e, err := UnmarshalEnvelope([]byte(r.sent()[0][0]))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal deadletter: %v", err)
+	}
+	if e.Header(HeaderDeadLetterError) != "boom" || e.Header(HeaderDeadLetterAttempts) != "3" ||
+		e.Header(HeaderDeadLetterPermanent) != "false" || e.Header(HeaderDeadLetterChannel) != "bar" {
+		t.Errorf("Unexpected deadletter headers %v", e.Headers)
+	}
+	if topic, body, err := OriginalMessage(e); err != nil || topic != "foo" || string(body) != "raw" {
+		t.Errorf("Unexpected original message %s %q (%v)", topic, body, err)
+	}
+
+	// permanent failures are not retried
+	bad := nsqlib.NewMessage(nsqlib.MessageID{}, []byte("bad"))
+	bad.Attempts = 1
+	if err := h.HandleMessage(bad); err != nil {
+		t.Errorf("Expected deadlettered message to be finished, Got %v", err)
+	}
+	if len(r.sent()) != 2 {
+		t.Fatalf("Expected a deadletter, Got %v", r.sent())
+	}
+}
+
+func TestRetryHandlerRequeuesWhenDeadLetterFails(t *testing.T) {
+	r := &batchRecorder{err: errors.New("nsq down")}
+	failure := errors.New("boom")
+	h := RetryHandler("foo", "bar", RetryPolicy{MaxAttempts: 1, Publisher: r},
+		nsqlib.HandlerFunc(func(msg *nsqlib.Message) error { return failure }))
+
+	msg := nsqlib.NewMessage(nsqlib.MessageID{}, []byte("raw"))
+	msg.Attempts = 1
+	if err := h.HandleMessage(msg); err != failure {
+		t.Errorf("Want %v, Got %v", failure, err)
+	}
+}
+
+func TestOriginalMessageKeepsEnvelope(t *testing.T) {
+	e := NewEnvelope([]byte("body"))
+	e.SetHeader("origin", "test")
+	b, _ := e.Marshal()
+
+	r := &batchRecorder{}
+	msg := nsqlib.NewMessage(nsqlib.MessageID{}, b)
+	if err := deadLetter(r, "foo", "bar", msg, errors.New("boom"), true); err != nil {
+		t.Fatalf("Failed to deadletter: %v", err)
+	}
+	dl, _ := UnmarshalEnvelope([]byte(r.sent()[0][0]))
+
+	_, orig, err := OriginalMessage(dl)
+	if err != nil {
+		t.Fatalf("Failed to restore message: %v", err)
+	}
+	got, err := UnmarshalEnvelope(orig)
+	if err != nil || got.Id != e.Id || string(got.Body) != "body" || len(got.Headers) != 1 || got.Header("origin") != "test" {
+		t.Errorf("Unexpected original envelope %+v (%v)", got, err)
+	}
+}
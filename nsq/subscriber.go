@@ -5,11 +5,20 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
 	nsqlib "github.com/HailoOSS/go-nsq"
 	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+	"golang.org/x/net/context"
+)
+
+const (
+	// throughputInterval is how often we report handler throughput
+	throughputInterval = 10 * time.Second
 )
 
 type Subscriber interface {
@@ -20,9 +29,17 @@ type Subscriber interface {
 	// config to determine how many handlers should be started.
 	AddHandlers(handler nsqlib.Handler)
 
+	// AddTypedHandler registers something to handle inbound messages, decoded into
+	// a new value from factory (see TypedHandler)
+	AddTypedHandler(factory func() interface{}, handler TypedHandlerFunc)
+
 	// SetMaxInFlight defines how many messages NSQ should punt our way at a time
 	SetMaxInFlight(int)
 
+	// EnableAdaptive tunes concurrency and max in flight within the given limits,
+	// rather than using fixed values (call before AddHandlers)
+	EnableAdaptive(opts AdaptiveOptions)
+
 	// IsStarved indicates whether any connection will reach max in flight
 	IsStarved() bool
 
@@ -33,6 +50,10 @@ type Subscriber interface {
 	// Disconnect stops the consumer and the config loop
 	Disconnect()
 
+	// Drain stops receiving messages, and waits for those in flight to be handled,
+	// or until the context is done (in which case they are requeued)
+	Drain(ctx context.Context) error
+
 	// SetConfig sets a config value on the underlying NSQ consumer
 	SetConfig(option string, value interface{}) error
 }
@@ -44,9 +65,18 @@ type DefaultSubscriber struct {
 	cfg          *nsqlib.Config
 	handlers     []nsqlib.Handler
 	stop         chan struct{}
+	stopOnce     sync.Once
 	configHash   string
 	subHosts     []string
 	lookupdHosts []string
+
+	// messages being handled, and how many have been handled in total
+	mtx      sync.Mutex
+	inFlight map[*nsqlib.Message]time.Time
+	handled  int64
+
+	// tunes concurrency and max in flight, if enabled
+	adaptive *adaptiveTuner
 }
 
 // NewDefaultSubscriber yields a DefaultSubscriber that automatically connects to
@@ -54,10 +84,11 @@ type DefaultSubscriber struct {
 // messages for the given topic
 func NewDefaultSubscriber(topic string, channel string) (Subscriber, error) {
 	return &DefaultSubscriber{
-		cfg:     nsqlib.NewConfig(),
-		topic:   topic,
-		channel: channel,
-		stop:    make(chan struct{}),
+		cfg:      nsqlib.NewConfig(),
+		topic:    topic,
+		channel:  channel,
+		stop:     make(chan struct{}),
+		inFlight: make(map[*nsqlib.Message]time.Time),
 	}, nil
 }
 
@@ -75,12 +106,20 @@ func (s *DefaultSubscriber) AddHandler(handler nsqlib.Handler) {
 
 func (s *DefaultSubscriber) AddHandlers(handler nsqlib.Handler) {
 	subHandlers := config.AtPath("hailo", "service", "nsq", "subHandlers").AsInt(6)
+	if s.adaptive != nil {
+		// concurrency is limited by the tuner
+		subHandlers = s.adaptive.opts.MaxConcurrency
+	}
 	log.Infof("Adding %d handlers", subHandlers)
 	for i := 0; i < subHandlers; i++ {
 		s.AddHandler(handler)
 	}
 }
 
+func (s *DefaultSubscriber) AddTypedHandler(factory func() interface{}, handler TypedHandlerFunc) {
+	s.AddHandler(TypedHandler(s.topic, s.channel, factory, handler))
+}
+
 func (s *DefaultSubscriber) IsStarved() bool {
 	return s.consumer.IsStarved()
 }
@@ -92,19 +131,131 @@ func (s *DefaultSubscriber) Connect() error {
 	}
 	consumer.SetLogger(&logBridge{}, nsqlib.LogLevelInfo)
 	for _, handler := range s.handlers {
-		consumer.AddHandler(handler)
+		if s.adaptive != nil {
+			handler = s.adaptive.wrap(handler)
+		}
+		consumer.AddHandler(s.track(handler))
 	}
 	s.consumer = consumer
 	go s.configLoop()
+	go s.reportThroughput()
+	if s.adaptive != nil {
+		go s.adaptiveLoop()
+	}
 	return nil
 }
 
 func (s *DefaultSubscriber) Disconnect() {
-	close(s.stop)
-	s.consumer.Stop()
+	s.stopConsumer()
 	<-s.consumer.StopChan
 }
 
+// Drain stops receiving messages, and waits for those in flight to be handled. If
+// the context is done first, whatever is still in flight is requeued.
+func (s *DefaultSubscriber) Drain(ctx context.Context) error {
+	s.stopConsumer()
+
+	if err := s.waitForInFlight(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-s.consumer.StopChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopConsumer stops the consumer and our loops, once only so that we can be
+// both drained and disconnected
+func (s *DefaultSubscriber) stopConsumer() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.consumer.Stop()
+	})
+}
+
+// InFlight returns the number of messages currently being handled
+func (s *DefaultSubscriber) InFlight() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.inFlight)
+}
+
+// waitForInFlight waits until no messages are being handled, or requeues those
+// which are if the context is done first
+func (s *DefaultSubscriber) waitForInFlight(ctx context.Context) error {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for s.InFlight() > 0 {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			s.mtx.Lock()
+			log.Warnf("Requeuing %d messages still in flight for %s/%s: %v", len(s.inFlight), s.topic, s.channel,
+				ctx.Err())
+			for msg := range s.inFlight {
+				// if the handler does finish, its response is ignored
+				msg.RequeueWithoutBackoff(0)
+			}
+			s.mtx.Unlock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// track wraps a handler to keep track of the messages in flight, and instrument
+// how long they take to handle
+func (s *DefaultSubscriber) track(handler nsqlib.Handler) nsqlib.Handler {
+	prefix := fmt.Sprintf("nsq.subscribe.%s.%s.", s.topic, s.channel)
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		startTime := time.Now()
+		s.mtx.Lock()
+		s.inFlight[msg] = startTime
+		inFlight := len(s.inFlight)
+		s.mtx.Unlock()
+		inst.Gauge(1.0, prefix+"inflight", inFlight)
+
+		err := handler.HandleMessage(msg)
+
+		s.mtx.Lock()
+		delete(s.inFlight, msg)
+		inFlight = len(s.inFlight)
+		s.mtx.Unlock()
+		atomic.AddInt64(&s.handled, 1)
+
+		inst.Gauge(1.0, prefix+"inflight", inFlight)
+		inst.Timing(1.0, prefix+"handle", time.Since(startTime))
+		if err != nil {
+			inst.Counter(1.0, prefix+"failure")
+		} else {
+			inst.Counter(1.0, prefix+"success")
+		}
+		return err
+	})
+}
+
+// reportThroughput periodically reports how many messages per second we are
+// handling, until we are disconnected
+func (s *DefaultSubscriber) reportThroughput() {
+	tick := time.NewTicker(throughputInterval)
+	defer tick.Stop()
+
+	bucket := fmt.Sprintf("nsq.subscribe.%s.%s.throughput", s.topic, s.channel)
+	last := atomic.LoadInt64(&s.handled)
+	for {
+		select {
+		case <-tick.C:
+		case <-s.stop:
+			return
+		}
+		handled := atomic.LoadInt64(&s.handled)
+		inst.GaugeFloat64(1.0, bucket, float64(handled-last)/throughputInterval.Seconds())
+		last = handled
+	}
+}
+
 func (s *DefaultSubscriber) configLoop() {
 	// Wait 5 mins for config to load. If we cannot load config by the
 	// then there's most likely a major issue and we should panic.
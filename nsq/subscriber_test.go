@@ -0,0 +1,104 @@
+package nsq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+type recordingDelegate struct {
+	sync.Mutex
+	finished, requeued int
+}
+
+func (d *recordingDelegate) OnFinish(*nsqlib.Message) {
+	d.Lock()
+	defer d.Unlock()
+	d.finished++
+}
+
+func (d *recordingDelegate) OnRequeue(m *nsqlib.Message, delay time.Duration, backoff bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.requeued++
+}
+
+func (d *recordingDelegate) OnTouch(*nsqlib.Message) {}
+
+func TestWaitForInFlight(t *testing.T) {
+	sub, err := NewDefaultSubscriber("foo", "bar")
+	if err != nil {
+		t.Fatalf("Failed to create subscriber: %v", err)
+	}
+	s := sub.(*DefaultSubscriber)
+
+	release := make(chan struct{})
+	h := s.track(nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		<-release
+		return nil
+	}))
+
+	d := &recordingDelegate{}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		msg := nsqlib.NewMessage(nsqlib.MessageID{}, []byte("hello"))
+		msg.Delegate = d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.HandleMessage(msg)
+		}()
+	}
+	for s.InFlight() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// messages still in flight when the deadline passes are requeued
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.waitForInFlight(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded, Got %v", err)
+	}
+	d.Lock()
+	if d.requeued != 3 {
+		t.Errorf("Expected 3 messages to be requeued, Got %d", d.requeued)
+	}
+	d.Unlock()
+
+	close(release)
+	wg.Wait()
+	if n := s.InFlight(); n != 0 {
+		t.Errorf("Expected nothing in flight, Got %d", n)
+	}
+	if err := s.waitForInFlight(context.Background()); err != nil {
+		t.Errorf("Expected no error with nothing in flight, Got %v", err)
+	}
+}
+
+func TestDrainThenDisconnect(t *testing.T) {
+	sub, err := NewDefaultSubscriber("foo", "bar")
+	if err != nil {
+		t.Fatalf("Failed to create subscriber: %v", err)
+	}
+	sub.AddHandler(nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		return nil
+	}))
+	if err := sub.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sub.Drain(ctx); err != nil {
+		t.Errorf("Failed to drain: %v", err)
+	}
+	// neither draining again nor disconnecting should panic
+	if err := sub.Drain(ctx); err != nil {
+		t.Errorf("Failed to drain again: %v", err)
+	}
+	sub.Disconnect()
+}
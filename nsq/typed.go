@@ -0,0 +1,106 @@
+package nsq
+
+import (
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+type contextKey int
+
+const (
+	messageKey contextKey = iota
+	envelopeKey
+)
+
+// TypedHandlerFunc handles a decoded message. The raw message and its envelope can be found within the context.
+type TypedHandlerFunc func(ctx context.Context, msg interface{}) error
+
+// MessageFromContext returns the message being handled by a TypedHandlerFunc
+func MessageFromContext(ctx context.Context) *nsqlib.Message {
+	msg, _ := ctx.Value(messageKey).(*nsqlib.Message)
+	return msg
+}
+
+// EnvelopeFromContext returns the envelope of the message being handled by a TypedHandlerFunc
+func EnvelopeFromContext(ctx context.Context) *Envelope {
+	e, _ := ctx.Value(envelopeKey).(*Envelope)
+	return e
+}
+
+// TypedHandler wraps TypedHandlerVia for DefaultPublisher
+func TypedHandler(topic, channel string, factory func() interface{}, h TypedHandlerFunc) nsqlib.Handler {
+	return TypedHandlerVia(DefaultPublisher, topic, channel, factory, h)
+}
+
+// TypedHandlerVia returns a handler for `topic` and `channel` which decodes each message body into a new value from
+// `factory` (eg: a protobuf message) before passing it to `h`. The codec is chosen by the content type of the message's
+// envelope; legacy messages are assumed to be protobuf if the value is a protobuf message, otherwise JSON. Messages
+// which cannot be decoded are sent straight to the deadletter queue, published with `p` (default DefaultPublisher).
+func TypedHandlerVia(p Publisher, topic, channel string, factory func() interface{}, h TypedHandlerFunc) nsqlib.Handler {
+	if p == nil {
+		p = DefaultPublisher
+	}
+	return nsqlib.HandlerFunc(func(msg *nsqlib.Message) error {
+		v := factory()
+		e, err := decodeTyped(msg, v)
+		if err != nil {
+			log.Warnf("Failed to decode message %x from %s/%s: %v", msg.ID, topic, channel, err)
+			inst.Counter(1.0, "nsq.typed.decode.failure")
+			// if we can't deadletter it, requeue it rather than lose it
+			return deadLetter(p, topic, channel, msg, err, true)
+		}
+
+		ctx := context.WithValue(context.Background(), messageKey, msg)
+		ctx = context.WithValue(ctx, envelopeKey, e)
+		return h(ctx, v)
+	})
+}
+
+func decodeTyped(msg *nsqlib.Message, v interface{}) (*Envelope, error) {
+	e, err := MessageEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = defaultContentType(v)
+	}
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Unmarshal(e.Body, v); err != nil {
+		return nil, fmt.Errorf("Failed to decode %s: %v", contentType, err)
+	}
+	return e, nil
+}
+
+// PublishTyped wraps PublishTypedVia for DefaultPublisher
+func PublishTyped(topic string, v interface{}) error {
+	return PublishTypedVia(DefaultPublisher, topic, "", v)
+}
+
+// PublishTypedVia encodes a value with the codec for `contentType` (or by default protobuf for protobuf messages,
+// otherwise JSON), and publishes it within an envelope so that TypedHandler knows how to decode it
+func PublishTypedVia(p Publisher, topic, contentType string, v interface{}) error {
+	if contentType == "" {
+		contentType = defaultContentType(v)
+	}
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return err
+	}
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	e := NewEnvelope(body)
+	e.ContentType = contentType
+	return PublishEnvelopeVia(p, topic, e)
+}
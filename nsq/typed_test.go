@@ -0,0 +1,88 @@
+package nsq
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	nsqlib "github.com/HailoOSS/go-nsq"
+)
+
+type typedFoo struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestTypedHandler(t *testing.T) {
+	r := &batchRecorder{}
+	defer func(p Publisher) { DefaultPublisher = p }(DefaultPublisher)
+	DefaultPublisher = r
+
+	var got []*typedFoo
+	h := TypedHandler("foo", "bar", func() interface{} { return &typedFoo{} },
+		func(ctx context.Context, msg interface{}) error {
+			if EnvelopeFromContext(ctx) == nil || MessageFromContext(ctx) == nil {
+				t.Error("Expected message and envelope within context")
+			}
+			got = append(got, msg.(*typedFoo))
+			return nil
+		})
+
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgpack} {
+		if err := PublishTypedVia(r, "foo", contentType, &typedFoo{Name: "a", Count: 1}); err != nil {
+			t.Fatalf("Failed to publish %s: %v", contentType, err)
+		}
+	}
+	// legacy raw JSON
+	r.batches = append(r.batches, []string{`{"name":"b","count":2}`})
+
+	for _, batch := range r.sent() {
+		if err := h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, []byte(batch[0]))); err != nil {
+			t.Errorf("Failed to handle %q: %v", batch[0], err)
+		}
+	}
+	if len(got) != 3 || got[0].Name != "a" || got[1].Count != 1 || got[2].Name != "b" {
+		t.Errorf("Unexpected decoded messages %+v", got)
+	}
+}
+
+func TestTypedHandlerDeadLettersDecodeFailures(t *testing.T) {
+	r := &batchRecorder{}
+	defer func(p Publisher) { DefaultPublisher = p }(DefaultPublisher)
+	DefaultPublisher = r
+
+	h := TypedHandler("foo", "bar", func() interface{} { return &typedFoo{} },
+		func(ctx context.Context, msg interface{}) error {
+			t.Error("Expected undecodable message not to be handled")
+			return nil
+		})
+
+	unknown := NewEnvelope([]byte("?"))
+	unknown.ContentType = "application/x-unknown"
+	b, _ := unknown.Marshal()
+
+	for _, body := range [][]byte{[]byte("not json"), b} {
+		if err := h.HandleMessage(nsqlib.NewMessage(nsqlib.MessageID{}, body)); err != nil {
+			t.Errorf("Expected deadlettered message to be finished, Got %v", err)
+		}
+	}
+	if len(r.sent()) != 2 {
+		t.Fatalf("Want 2 deadletters, Got %v", r.sent())
+	}
+	e, _ := UnmarshalEnvelope([]byte(r.sent()[0][0]))
+	if e.Header(HeaderDeadLetterPermanent) != "true" {
+		t.Errorf("Expected decode failure to be permanent, Got %v", e.Headers)
+	}
+}
+
+func TestCodecRegistry(t *testing.T) {
+	if _, err := CodecFor("application/x-unknown"); err == nil {
+		t.Error("Expected unknown content type to have no codec")
+	}
+	if c, err := CodecFor(ContentTypeProtobuf); err != nil || c.ContentType() != ContentTypeProtobuf {
+		t.Errorf("Expected protobuf codec, Got %v (%v)", c, err)
+	}
+	if _, err := (protobufCodec{}).Marshal(&typedFoo{}); err == nil {
+		t.Error("Expected protobuf codec to refuse non-protobuf values")
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"github.com/HailoOSS/service/config"
 	d "github.com/HailoOSS/service/dedupe"
-	"time"
 )
 
 type RedisDedupeClient struct {
@@ -27,27 +26,7 @@ func (rs *RedisDedupeClient) connect() (*redis.Pool, error) {
 	host := config.AtPath("hailo", "service", "deduper", "redis", "hostname").AsString(":16379")
 	// var password string
 	log.Debugf("Setting redis server from config: %v", host)
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", host)
-			if err != nil {
-				return nil, err
-			}
-			if _, err := c.Do("PING"); err != nil {
-				c.Close()
-				return nil, err
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-
-	return pool, nil
+	return NewPool(host), nil
 }
 
 func (rs *RedisDedupeClient) changeConfigSubscriber() {
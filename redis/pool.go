@@ -0,0 +1,30 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// NewPool returns a pool of connections to the redis server at `host`, which are checked on borrow
+func NewPool(host string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", host)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.Do("PING"); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, err
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	hsync "github.com/HailoOSS/service/sync"
+)
+
+var (
+	// tokenBucketScript refills and takes from the bucket at KEYS[1]. ARGV is capacity, ms per token, now (ms) and ttl
+	// (ms), and it returns {allowed, wait (ms)}.
+	tokenBucketScript = redis.NewScript(1, `
+local capacity = tonumber(ARGV[1])
+local perToken = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or capacity
+local ts = tonumber(b[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) / perToken)
+end
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * perToken)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return {allowed, wait}`)
+
+	// slidingLogScript keeps a log of events in the sorted set at KEYS[1]. ARGV is now (ms), window (ms), limit and a
+	// unique member for this event, and it returns {allowed, wait (ms)}.
+	slidingLogScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	return {1, 0}
+end
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {0, tonumber(oldest[2]) + window - now}`)
+)
+
+// RateLimitBackend is an implementation of sync.RateLimitBackend which counts events in redis. Both algorithms are
+// implemented as Lua scripts so they are atomic; sliding windows are exact, keeping a log of events in a sorted set.
+type RateLimitBackend struct {
+	pool *redis.Pool
+}
+
+// NewRateLimitBackend returns a rate limit backend using the redis server at `host`
+func NewRateLimitBackend(host string) *RateLimitBackend {
+	return &RateLimitBackend{
+		pool: NewPool(host),
+	}
+}
+
+func (b *RateLimitBackend) Take(key string, alg hsync.RateLimitAlgorithm, l hsync.RateLimit) (bool, time.Duration, error) {
+	c := b.pool.Get()
+	defer c.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	per := int64(l.Per / time.Millisecond)
+
+	var (
+		res []int
+		err error
+	)
+	if alg == hsync.SlidingWindow {
+		res, err = redis.Ints(slidingLogScript.Do(c, key, now, per, l.Limit, eventId()))
+	} else {
+		// once the bucket has been idle long enough to refill it is no different to a missing one
+		perToken := float64(per) / float64(l.Limit)
+		ttl := int64(float64(l.Capacity())*perToken) + per
+		res, err = redis.Ints(tokenBucketScript.Do(c, key, l.Capacity(), perToken, now, ttl))
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// eventId returns a member for the sliding log which is unique even if events happen in the same millisecond
+func eventId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,217 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	inst "github.com/HailoOSS/service/instrumentation"
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+const (
+	participantNodePrefix = "participant-"
+	readyNode             = "ready"
+)
+
+var (
+	ErrNotEntered = errors.New("Barrier has not been entered")
+)
+
+// Barrier is a distributed double barrier: nobody proceeds past Enter until N participants have entered, and nobody
+// proceeds past Leave until they have all left
+type Barrier interface {
+	// Enter joins the barrier, waiting until all participants have joined or the context is done
+	Enter(ctx context.Context) error
+	// Leave leaves the barrier, waiting until all participants have left or the context is done
+	Leave(ctx context.Context) error
+}
+
+type regionBarrier struct {
+	client *zk.Client
+	path   string
+	n      int
+	holder HolderInfo
+	node   string
+}
+
+// RegionBarrier returns a barrier on `id` within the local operating region for `n` participants. All participants
+// must agree on `n`, and each round should use a new ID. Barriers are namespaced per service (see
+// SetRegionLockNamespace), and participants which crash are removed along with their ZooKeeper session.
+func RegionBarrier(id []byte, n int, opts ...LockOption) (Barrier, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("Barrier must have at least one participant")
+	}
+	path, err := constructRecipePath("barrier", string(id))
+	if err != nil {
+		return nil, err
+	}
+	o := newLockOptions(0, opts...)
+	return &regionBarrier{
+		client: o.client,
+		path:   path,
+		n:      n,
+		holder: o.holder,
+	}, nil
+}
+
+// Enter joins the barrier. If the context is done before all participants have joined, we leave again.
+func (b *regionBarrier) Enter(ctx context.Context) error {
+	log.Tracef("[Sync:RegionBarrier] Entering '%s' (%d participants)", b.path, b.n)
+	startTime := time.Now()
+	err := b.enter(ctx)
+	inst.Timing(1.0, "sync.regionbarrier.enter", time.Since(startTime))
+	reaperFor(b.client).addPath(b.path)
+
+	if err != nil {
+		log.Errorf("[Sync:RegionBarrier] Failed to enter '%s': %v", b.path, err)
+		inst.Counter(1.0, "sync.regionbarrier.enter.failure")
+		return err
+	}
+	inst.Counter(1.0, "sync.regionbarrier.enter.success")
+
+	return nil
+}
+
+func (b *regionBarrier) enter(ctx context.Context) error {
+	h := b.holder
+	h.Since = time.Now()
+
+	var err error
+	for i := 0; i < maxCreateAttempts; i++ {
+		b.node, err = b.client.CreateProtectedEphemeralSequential(b.path+"/"+participantNodePrefix, encodeHolder(h),
+			syncACL(b.client))
+		if err != gozk.ErrNoNode {
+			break
+		}
+		// the parent may have been reaped from under us, so keep trying to create it
+		if err := b.client.CreateParents(b.path); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		exists, _, watch, err := b.client.ExistsW(b.path + "/" + readyNode)
+		if err != nil {
+			b.abandon()
+			return err
+		} else if exists {
+			return nil
+		}
+
+		// whoever completes the set of participants lets everyone else through
+		n, err := b.participants()
+		if err != nil {
+			b.abandon()
+			return err
+		} else if n >= b.n {
+			// this is persistent (the last to leave deletes it), as others may not have seen it before our session ends
+			_, err := b.client.Create(b.path+"/"+readyNode, []byte{}, 0, syncACL(b.client))
+			if err != nil && err != gozk.ErrNodeExists {
+				b.abandon()
+				return err
+			}
+			return nil
+		}
+
+		select {
+		case ev := <-watch:
+			if ev.Err != nil {
+				b.abandon()
+				return ev.Err
+			}
+		case <-ctx.Done():
+			b.abandon()
+			return ctx.Err()
+		}
+	}
+}
+
+// Leave leaves the barrier
+func (b *regionBarrier) Leave(ctx context.Context) error {
+	if b.node == "" {
+		return ErrNotEntered
+	}
+	log.Tracef("[Sync:RegionBarrier] Leaving '%s'", b.path)
+
+	startTime := time.Now()
+	err := b.leave(ctx)
+	inst.Timing(1.0, "sync.regionbarrier.leave", time.Since(startTime))
+
+	if err != nil {
+		log.Errorf("[Sync:RegionBarrier] Failed to leave '%s': %v", b.path, err)
+		inst.Counter(1.0, "sync.regionbarrier.leave.failure")
+		return err
+	}
+	inst.Counter(1.0, "sync.regionbarrier.leave.success")
+
+	return nil
+}
+
+func (b *regionBarrier) leave(ctx context.Context) error {
+	if err := b.client.Delete(b.node, -1); err != nil && err != gozk.ErrNoNode {
+		return err
+	}
+	b.node = ""
+
+	for {
+		children, _, watch, err := b.client.ChildrenW(b.path)
+		if err == gozk.ErrNoNode {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if countPrefixed(children, participantNodePrefix) == 0 {
+			// the last to leave tidies up, so that the path can be reaped
+			if err := b.client.Delete(b.path+"/"+readyNode, -1); err != nil && err != gozk.ErrNoNode {
+				return err
+			}
+			return nil
+		}
+
+		select {
+		case ev := <-watch:
+			if ev.Err != nil {
+				return ev.Err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// participants returns how many participants have entered the barrier
+func (b *regionBarrier) participants() (int, error) {
+	children, _, err := b.client.Children(b.path)
+	if err != nil {
+		return 0, err
+	}
+	return countPrefixed(children, participantNodePrefix), nil
+}
+
+// abandon removes our participant node after failing to enter
+func (b *regionBarrier) abandon() {
+	if err := b.client.Delete(b.node, -1); err != nil && err != gozk.ErrNoNode {
+		log.Warnf("[Sync:RegionBarrier] Failed to remove participant node '%s': %v", b.node, err)
+	}
+	b.node = ""
+}
+
+// countPrefixed counts the child nodes which were created with the given (sequential node) prefix
+func countPrefixed(children []string, prefix string) int {
+	n := 0
+	for _, c := range children {
+		if strings.Contains(c, prefix) {
+			n++
+		}
+	}
+	return n
+}
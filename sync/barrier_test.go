@@ -0,0 +1,124 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRegionBarrier(t *testing.T) {
+	setupFakeZookeeper()
+
+	b1, err := RegionBarrier([]byte("barrier"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create barrier: %v", err)
+	}
+	b2, err := RegionBarrier([]byte("barrier"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create barrier: %v", err)
+	}
+	if err := b1.Leave(context.Background()); err != ErrNotEntered {
+		t.Errorf("Want %v, Got %v", ErrNotEntered, err)
+	}
+
+	// nobody proceeds until everyone has entered
+	entered := make(chan error, 1)
+	go func() {
+		entered <- b1.Enter(context.Background())
+	}()
+	select {
+	case err := <-entered:
+		t.Fatalf("Expected to wait for the other participant, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := b2.Enter(context.Background()); err != nil {
+		t.Fatalf("Failed to enter: %v", err)
+	}
+	select {
+	case err := <-entered:
+		if err != nil {
+			t.Fatalf("Failed to enter: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected to enter once all participants have")
+	}
+
+	// nor until everyone has left
+	left := make(chan error, 1)
+	go func() {
+		left <- b1.Leave(context.Background())
+	}()
+	select {
+	case err := <-left:
+		t.Fatalf("Expected to wait for the other participant, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := b2.Leave(context.Background()); err != nil {
+		t.Fatalf("Failed to leave: %v", err)
+	}
+	select {
+	case err := <-left:
+		if err != nil {
+			t.Fatalf("Failed to leave: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected to leave once all participants have")
+	}
+}
+
+func TestRegionBarrierOutlivesCompletingSession(t *testing.T) {
+	fake := setupFakeZookeeper()
+	c, other := newFakeSession("barrier")
+	defer c.TearDown()
+
+	b1, err := RegionBarrier([]byte("barrier-session"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create barrier: %v", err)
+	}
+	b2, err := RegionBarrier([]byte("barrier-session"), 2, WithZookeeper(c))
+	if err != nil {
+		t.Fatalf("Failed to create barrier: %v", err)
+	}
+
+	entered := make(chan error, 1)
+	go func() {
+		entered <- b1.Enter(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := b2.Enter(context.Background()); err != nil {
+		t.Fatalf("Failed to enter: %v", err)
+	}
+	if err := <-entered; err != nil {
+		t.Fatalf("Failed to enter: %v", err)
+	}
+
+	// the barrier stays open for everyone else, even though the participant which opened it has gone
+	other.ExpireSession()
+	if exists, _, err := fake.Exists(b1.(*regionBarrier).path + "/" + readyNode); err != nil || !exists {
+		t.Errorf("Expected the barrier to remain open (%v)", err)
+	}
+}
+
+func TestRegionBarrierEnterTimeout(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	b, err := RegionBarrier([]byte("barrier-timeout"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create barrier: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Enter(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Want %v, Got %v", context.DeadlineExceeded, err)
+	}
+
+	// having given up, we are no longer a participant
+	children, _, err := fake.Children(b.(*regionBarrier).path)
+	if err != nil || len(children) != 0 {
+		t.Errorf("Expected no participants, got %v (%v)", children, err)
+	}
+	if err := b.Leave(context.Background()); err != ErrNotEntered {
+		t.Errorf("Want %v, Got %v", ErrNotEntered, err)
+	}
+}
@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Campaign stands for election as the "leader" of an ID, and re-enters the election whenever leadership is lost. This
+// suits workloads which alternate between being active and on standby.
+//
+//	c := sync.NewCampaign("my-job")
+//	c.OnElected(func(l sync.Leader) { go doWork(l.Rescinded()) })
+//	c.OnRescinded(func() { log.Info("on standby") })
+//	c.Start()
+//	defer c.Stop()
+type Campaign struct {
+	sync.RWMutex
+	id          string
+	global      bool
+	opts        []LockOption
+	onElected   func(Leader)
+	onRescinded func()
+	leader      Leader
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// NewCampaign returns a campaign for leadership of `id` within the local operating region
+func NewCampaign(id string, opts ...LockOption) *Campaign {
+	return &Campaign{
+		id:   id,
+		opts: opts,
+	}
+}
+
+// NewGlobalCampaign returns a campaign for global leadership of `id` (see NewGlobalLeader)
+func NewGlobalCampaign(id string, opts ...LockOption) *Campaign {
+	c := NewCampaign(id, opts...)
+	c.global = true
+	return c
+}
+
+// OnElected registers a callback which is called each time we are elected. Callbacks are called synchronously, so
+// should not block.
+func (c *Campaign) OnElected(f func(Leader)) {
+	c.Lock()
+	defer c.Unlock()
+	c.onElected = f
+}
+
+// OnRescinded registers a callback which is called each time we lose leadership. Callbacks are called synchronously,
+// so should not block.
+func (c *Campaign) OnRescinded(f func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.onRescinded = f
+}
+
+// Start enters the election in the background
+func (c *Campaign) Start() {
+	c.Lock()
+	defer c.Unlock()
+	if c.done != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = make(chan struct{})
+	go c.run(ctx, c.done)
+}
+
+// Stop rescinds leadership (if held) and leaves the election, blocking until this is done
+func (c *Campaign) Stop() {
+	c.Lock()
+	cancel, done := c.cancel, c.done
+	c.cancel, c.done = nil, nil
+	c.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Resign rescinds leadership (if held), after which we re-enter the election behind the other candidates
+func (c *Campaign) Resign() {
+	c.RLock()
+	l := c.leader
+	c.RUnlock()
+
+	if l != nil {
+		l.Rescind()
+	}
+}
+
+// Leader returns our current leadership, or nil if we are not the leader
+func (c *Campaign) Leader() Leader {
+	c.RLock()
+	defer c.RUnlock()
+	return c.leader
+}
+
+// IsLeader returns whether we are currently the leader
+func (c *Campaign) IsLeader() bool {
+	return c.Leader() != nil
+}
+
+func (c *Campaign) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for {
+		var (
+			l   Leader
+			err error
+		)
+		if c.global {
+			l, err = GlobalLeaderWithin(ctx, c.id, c.opts...)
+		} else {
+			l, err = RegionLeaderWithin(ctx, c.id, c.opts...)
+		}
+		if err != nil {
+			// we only fail to be elected once we've been stopped
+			return
+		}
+
+		c.Lock()
+		c.leader = l
+		onElected := c.onElected
+		c.Unlock()
+		if onElected != nil {
+			onElected(l)
+		}
+
+		select {
+		case <-l.Rescinded():
+		case <-ctx.Done():
+			l.Rescind()
+		}
+
+		c.Lock()
+		c.leader = nil
+		onRescinded := c.onRescinded
+		c.Unlock()
+		if onRescinded != nil {
+			onRescinded()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
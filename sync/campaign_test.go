@@ -0,0 +1,178 @@
+package sync
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HailoOSS/service/config"
+)
+
+// campaignEvents records the callbacks of a campaign
+type campaignEvents struct {
+	elected   chan Leader
+	rescinded chan struct{}
+}
+
+func watchCampaign(c *Campaign) *campaignEvents {
+	e := &campaignEvents{
+		elected:   make(chan Leader, 10),
+		rescinded: make(chan struct{}, 10),
+	}
+	c.OnElected(func(l Leader) { e.elected <- l })
+	c.OnRescinded(func() { e.rescinded <- struct{}{} })
+	return e
+}
+
+func (e *campaignEvents) expectElected(t *testing.T) Leader {
+	select {
+	case l := <-e.elected:
+		return l
+	case <-time.After(time.Second):
+		t.Fatal("Expected to be elected")
+	}
+	return nil
+}
+
+func (e *campaignEvents) expectRescinded(t *testing.T) {
+	select {
+	case <-e.rescinded:
+	case <-time.After(time.Second):
+		t.Fatal("Expected leadership to be rescinded")
+	}
+}
+
+func TestCampaign(t *testing.T) {
+	setupFakeZookeeper()
+
+	c := NewCampaign("campaign", WithHolderId("first"))
+	e := watchCampaign(c)
+	c.Start()
+	e.expectElected(t)
+	if !c.IsLeader() {
+		t.Error("Expected to be leader once elected")
+	}
+	if h, err := CurrentLeader("campaign"); err != nil || h.Id != "first" {
+		t.Errorf("Expected 'first' to be leader, got %v (%v)", h, err)
+	}
+
+	// resigning re-enters the election, which we win again as the only candidate
+	c.Resign()
+	e.expectRescinded(t)
+	e.expectElected(t)
+
+	// stopping leaves the election
+	c.Stop()
+	e.expectRescinded(t)
+	if c.IsLeader() {
+		t.Error("Expected not to be leader once stopped")
+	}
+	l, err := TryRegionLeader("campaign")
+	if err != nil {
+		t.Fatalf("Expected to be elected once campaign stopped, got %v", err)
+	}
+	l.Rescind()
+
+	// stopping again is harmless
+	c.Stop()
+}
+
+func TestCampaignStandby(t *testing.T) {
+	setupFakeZookeeper()
+
+	l1, err := TryRegionLeader("standby", WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+
+	c := NewCampaign("standby", WithHolderId("second"))
+	e := watchCampaign(c)
+	c.Start()
+	defer c.Stop()
+
+	select {
+	case <-e.elected:
+		t.Fatal("Expected to be on standby whilst another candidate leads")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if c.IsLeader() {
+		t.Error("Expected not to be leader whilst on standby")
+	}
+
+	l1.Rescind()
+	e.expectElected(t)
+	if h, err := CurrentLeader("standby"); err != nil || h.Id != "second" {
+		t.Errorf("Expected 'second' to be leader, got %v (%v)", h, err)
+	}
+}
+
+func TestRegionLeaderWithinTimeout(t *testing.T) {
+	setupFakeZookeeper()
+
+	l1, err := TryRegionLeader("within", WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+	defer l1.Rescind()
+
+	if _, err := TryRegionLeader("within"); err != ErrNotLeader {
+		t.Errorf("Want %v, Got %v", ErrNotLeader, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := RegionLeaderWithin(ctx, "within", WithHolderId("second")); err != context.DeadlineExceeded {
+		t.Fatalf("Want %v, Got %v", context.DeadlineExceeded, err)
+	}
+
+	// our candidacy is withdrawn, leaving only the leader
+	children, _, err := fakeZookeeper.Children("/sync/regionleader/within")
+	if err != nil || len(children) != 1 {
+		t.Errorf("Expected only the leader's node to remain, got %v (%v)", children, err)
+	}
+}
+
+func TestGlobalLeaderWithin(t *testing.T) {
+	setupFakeZookeeper()
+	defer loadLeadingRegion(false)
+
+	// this region isn't leading, so we can't lead globally
+	loadLeadingRegion(false)
+	if _, err := TryGlobalLeader("global"); err != ErrNotLeader {
+		t.Errorf("Want %v, Got %v", ErrNotLeader, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := GlobalLeaderWithin(ctx, "global"); err != context.DeadlineExceeded {
+		t.Errorf("Want %v, Got %v", context.DeadlineExceeded, err)
+	}
+
+	// until it becomes the leading region
+	elected := make(chan Leader, 1)
+	go func() {
+		if l, err := GlobalLeaderWithin(context.Background(), "global"); err == nil {
+			elected <- l
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	loadLeadingRegion(true)
+
+	select {
+	case l := <-elected:
+		l.Rescind()
+	case <-time.After(time.Second):
+		t.Fatal("Expected to be elected once this region is leading")
+	}
+}
+
+// loadLeadingRegion loads config marking this region as the leader (or not)
+func loadLeadingRegion(leading bool) {
+	leader := "false"
+	if leading {
+		leader = "true"
+	}
+	config.Load(bytes.NewBufferString(`{"hailo": {"service": {"zookeeper": {"hosts": ["localhost:2181"]}}}, ` +
+		`"leaders": {"isLeader": ` + leader + `}}`))
+}
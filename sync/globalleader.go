@@ -1,17 +1,71 @@
 package sync
 
 import (
+	"golang.org/x/net/context"
+
 	"github.com/HailoOSS/service/config"
+	zk "github.com/HailoOSS/service/zookeeper"
 )
 
+// globalZookeeper is an ensemble spanning all regions, if we have one
+var globalZookeeper *zk.Client
+
+// SetGlobalZookeeper sets a ZooKeeper ensemble spanning all regions. Global leaders are then elected directly on it,
+// rather than within whichever region is configured as leading. It should be called on startup, before any coordination
+// takes place.
+func SetGlobalZookeeper(c *zk.Client) {
+	globalZookeeper = c
+}
+
+// globalOptions directs coordination at the global ensemble (options given explicitly still take precedence)
+func globalOptions(opts []LockOption) []LockOption {
+	return append([]LockOption{WithZookeeper(globalZookeeper)}, opts...)
+}
+
 // NewGlobalLocker returns a global leader which is basically just a region leader pinned to one region based on
 // config.
 func NewGlobalLeader(id string) Leader {
+	// this can only fail if the context is done, which it never will be
+	l, _ := GlobalLeaderWithin(context.Background(), id)
+	return l
+}
+
+// GlobalLeaderWithin blocks until this region is configured as the leading region and this invocation has been
+// elected the "leader" within it, or the context is done. If a global ensemble is set, the election takes place on it
+// across all regions instead.
+func GlobalLeaderWithin(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error) {
+	if globalZookeeper != nil {
+		return RegionLeaderWithin(ctx, id, globalOptions(opts)...)
+	}
+	if err := waitForLeadingRegion(ctx); err != nil {
+		return nil, err
+	}
+	return RegionLeaderWithin(ctx, id, opts...)
+}
+
+// TryGlobalLeader attempts to become the global leader without waiting. ErrNotLeader is returned if this region is
+// not configured as the leading region, or another candidate is already leading.
+func TryGlobalLeader(id string, opts ...LockOption) (HandoverLeader, error) {
+	if globalZookeeper != nil {
+		return TryRegionLeader(id, globalOptions(opts)...)
+	}
+	if !config.AtPath("leaders", "isLeader").AsBool() {
+		return nil, ErrNotLeader
+	}
+	return TryRegionLeader(id, opts...)
+}
+
+// waitForLeadingRegion blocks until config marks this region as the leader
+func waitForLeadingRegion(ctx context.Context) error {
+	ch := config.SubscribeChanges()
 	for {
 		if config.AtPath("leaders", "isLeader").AsBool() {
-			break
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		<-config.SubscribeChanges()
 	}
-	return RegionLeader(id)
 }
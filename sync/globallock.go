@@ -9,6 +9,7 @@ import (
 	"time"
 
 	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
 
 	"github.com/HailoOSS/go-hailo-lib/multierror"
 	"github.com/HailoOSS/service/cassandra"
@@ -39,6 +40,13 @@ type globalLock struct {
 	lockId   gossie.UUID
 	exit     chan struct{}
 	unlocked bool
+	lost     *lostNotifier
+}
+
+// Lost returns a channel that is closed if we fail to refresh the lock (or hold it beyond `holdFor` without
+// refreshing), or once it has been released
+func (gl *globalLock) Lost() <-chan struct{} {
+	return gl.lost.Lost()
 }
 
 // Unlock releases this global lock
@@ -49,6 +57,7 @@ func (gl *globalLock) Unlock() {
 	// close the exit channel (so we can only Unlock once) which causes our refresher loop (if any) to break
 	close(gl.exit)
 	gl.unlocked = true
+	gl.lost.lose()
 
 	// delete from C*
 	pool, err := cassandra.ConnectionPool(keyspace)
@@ -79,7 +88,24 @@ func GlobalLock(id []byte) (Lock, error) {
 // (eg: binary crashes) then this is the maximum amount of time other programs will hang
 // around contending for the now defunkt lock
 func GlobalTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
-	if int64(holdFor) < int64(minHoldFor) {
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+
+	lock, err := GlobalLockContext(ctx, id, HoldFor(holdFor), AutoRefresh())
+	if IsContended(err) {
+		// we have always returned the plain sentinel error from here
+		return nil, ErrContended
+	}
+	return lock, err
+}
+
+// GlobalLockContext attempts to achieve a global lock on `id`, waiting until the context is done in case of
+// contention. If the context deadline is exceeded a *ContendedError is returned which identifies the current holder.
+// The lock is held for a maximum of 5 seconds, unless overridden via options; use AutoRefresh to keep it held until
+// Unlock is called.
+func GlobalLockContext(ctx context.Context, id []byte, opts ...LockOption) (Lock, error) {
+	o := newLockOptions(defaultHoldFor, opts...)
+	if int64(o.holdFor) < int64(minHoldFor) {
 		return nil, ErrHoldFor
 	}
 
@@ -92,8 +118,14 @@ func GlobalTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
 		id:     id,
 		lockId: u,
 		exit:   make(chan struct{}),
+		lost:   newLostNotifier(),
 	}
 
+	// let other contenders know who we are
+	holder := o.holder
+	holder.Since = time.Now()
+	holderData := encodeHolder(holder)
+
 	// make my node in C*
 	pool, err := cassandra.ConnectionPool(keyspace)
 	if err != nil {
@@ -105,8 +137,8 @@ func GlobalTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
 		Columns: []*gossie.Column{
 			{
 				Name:  []byte(l.lockId[:]),
-				Value: []byte{}, // @todo could inject some data about who has the lock here
-				Ttl:   durationToSeconds(holdFor, 1.0),
+				Value: holderData,
+				Ttl:   durationToSeconds(o.holdFor, 1.0),
 			},
 		},
 	})
@@ -122,18 +154,22 @@ func GlobalTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
 	reader := pool.Reader().ConsistencyLevel(gossie.CONSISTENCY_QUORUM).Cf(cfGlobalLock)
 	attempts := 0
 	errs := multierror.New()
-	start := time.Now()
+	var current *HolderInfo
 	for {
 		// break out if we've waited too long
 		if attempts > 0 {
-			if time.Now().After(start.Add(waitFor)) {
+			// delay a bit to avoid hammering C*
+			select {
+			case <-ctx.Done():
 				inst.Timing(1.0, "sync.globaltimedlock.acquire", time.Since(startTime))
 				inst.Counter(1.0, "sync.globaltimedlock.acquire.failure")
 				l.Unlock()
-				return nil, ErrContended
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, &ContendedError{Holder: current}
+				}
+				return nil, ctx.Err()
+			case <-time.After(addJitter(delayFor)):
 			}
-			// delay a bit to avoid hammering C*
-			time.Sleep(addJitter(delayFor))
 		}
 
 		attempts++
@@ -153,16 +189,31 @@ func GlobalTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
 			// we have the lock
 			break
 		}
+		current = decodeHolder(col.Value)
 	}
 
 	inst.Timing(1.0, "sync.globaltimedlock.acquire", time.Since(startTime))
 	inst.Counter(1.0, "sync.globaltimedlock.acquire.success")
 
-	// put in place the refresher loop @todo
+	if !o.autoRefresh {
+		// our column will expire after holdFor, at which point someone else may grab the lock
+		go func() {
+			select {
+			case <-l.exit:
+			case <-time.After(o.holdFor):
+				log.Warnf("[Sync:GlobalLock] lock %s held beyond %v .. cannot guarantee exclusivity", string(l.id), o.holdFor)
+				inst.Counter(1.0, "sync.globaltimedlock.lost")
+				l.lost.lose()
+			}
+		}()
+		return l, nil
+	}
+
+	// put in place the refresher loop
 	go func() {
 		for {
 			log.Debug("[Sync:GlobalLock] Doing refresher loop…")
-			refresh := time.Duration(float64(holdFor) * 0.75)
+			refresh := time.Duration(float64(o.holdFor) * 0.75)
 			select {
 			case <-l.exit:
 				log.Debugf("[Sync:GlobalLock] Breaking out of refresher loop")
@@ -173,13 +224,15 @@ func GlobalTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
 					Key: l.id,
 					Columns: []*gossie.Column{{
 						Name:  []byte(l.lockId[:]),
-						Value: []byte{},                        // @todo could inject some data about who has the lock here
-						Ttl:   durationToSeconds(holdFor, 1.5), // 1.5 is because we renew the lock earlier than the timeout, so we need to cover that extra bit
+						Value: holderData,
+						Ttl:   durationToSeconds(o.holdFor, 1.5), // 1.5 is because we renew the lock earlier than the timeout, so we need to cover that extra bit
 					}},
 				})
 				if err := writer.Run(); err != nil {
-					// @todo we could inform clients of this, somehow, eg: via a channel
-					log.Warnf("[Sync:GlobalLock] failed to refresh lock .. cannot guarantee exclusivity")
+					log.Warnf("[Sync:GlobalLock] failed to refresh lock .. cannot guarantee exclusivity: %v", err)
+					inst.Counter(1.0, "sync.globaltimedlock.lost")
+					// inform clients that they can no longer rely on holding this lock
+					l.lost.lose()
 				}
 			}
 		}
@@ -0,0 +1,140 @@
+package sync
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	inst "github.com/HailoOSS/service/instrumentation"
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+const (
+	countNodePrefix      = "count-"
+	defaultLatchLifetime = time.Hour
+)
+
+// CountDownLatch is a distributed latch which opens once it has been counted down N times
+type CountDownLatch interface {
+	// CountDown decrements the count of the latch
+	CountDown() error
+	// Await waits until the latch is open, or the context is done
+	Await(ctx context.Context) error
+	// Count returns the number of count downs remaining until the latch is open
+	Count() (int, error)
+}
+
+type regionLatch struct {
+	client   *zk.Client
+	path     string
+	count    int
+	lifetime time.Duration
+}
+
+// RegionCountDownLatch returns a latch on `id` within the local operating region, which opens after `count` count
+// downs. All processes using the same ID must agree on `count`. Latches are namespaced per service (see
+// SetRegionLockNamespace). Count downs survive the process which made them, but expire (along with the latch) after
+// an hour unless overridden with HoldFor.
+func RegionCountDownLatch(id []byte, count int, opts ...LockOption) (CountDownLatch, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("Latch count must be at least one")
+	}
+	path, err := constructRecipePath("latch", string(id))
+	if err != nil {
+		return nil, err
+	}
+	o := newLockOptions(defaultLatchLifetime, opts...)
+	return &regionLatch{
+		client:   o.client,
+		path:     path,
+		count:    count,
+		lifetime: o.holdFor,
+	}, nil
+}
+
+// CountDown decrements the count of the latch
+func (l *regionLatch) CountDown() error {
+	// Ensure we are reaping
+	reaperFor(l.client).addExpiringPath(l.path)
+
+	data := encodeTTL(time.Now().Add(l.lifetime))
+	var err error
+	for i := 0; i < maxCreateAttempts; i++ {
+		_, err = l.client.Create(l.path+"/"+countNodePrefix, data, gozk.FlagSequence, syncACL(l.client))
+		if err != gozk.ErrNoNode {
+			break
+		}
+		if err := l.client.CreateParents(l.path); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		log.Errorf("[Sync:RegionLatch] Failed to count down '%s': %v", l.path, err)
+		inst.Counter(1.0, "sync.regionlatch.countdown.failure")
+		return err
+	}
+	inst.Counter(1.0, "sync.regionlatch.countdown.success")
+
+	return nil
+}
+
+// Await waits until the latch is open
+func (l *regionLatch) Await(ctx context.Context) error {
+	log.Tracef("[Sync:RegionLatch] Awaiting '%s' (count %d)", l.path, l.count)
+	startTime := time.Now()
+	defer func() {
+		inst.Timing(1.0, "sync.regionlatch.await", time.Since(startTime))
+	}()
+
+	for {
+		_, _, watch, err := l.client.ChildrenW(l.path)
+		if err == gozk.ErrNoNode {
+			// nobody has counted down yet, so wait for the first one
+			var exists bool
+			exists, _, watch, err = l.client.ExistsW(l.path)
+			if exists {
+				continue
+			}
+		} else if err == nil {
+			// count as Count does, so that count downs which have expired are not counted
+			var nodes sequenceNodes
+			nodes, err = sequenceChildren(l.client, l.path, countNodePrefix)
+			if err == gozk.ErrNoNode {
+				continue
+			} else if err == nil && len(nodes) >= l.count {
+				return nil
+			}
+		}
+		if err != nil {
+			log.Errorf("[Sync:RegionLatch] Failed to await '%s': %v", l.path, err)
+			return err
+		}
+
+		select {
+		case ev := <-watch:
+			if ev.Err != nil {
+				return ev.Err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Count returns the number of count downs remaining until the latch is open
+func (l *regionLatch) Count() (int, error) {
+	nodes, err := sequenceChildren(l.client, l.path, countNodePrefix)
+	if err == gozk.ErrNoNode {
+		return l.count, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if remaining := l.count - len(nodes); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
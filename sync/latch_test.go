@@ -0,0 +1,71 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRegionCountDownLatch(t *testing.T) {
+	setupFakeZookeeper()
+
+	l, err := RegionCountDownLatch([]byte("latch"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create latch: %v", err)
+	}
+	if n, err := l.Count(); err != nil || n != 2 {
+		t.Errorf("Expected count of 2, got %v (%v)", n, err)
+	}
+
+	if err := l.CountDown(); err != nil {
+		t.Fatalf("Failed to count down: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Await(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected latch to be closed, got %v", err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- l.Await(context.Background())
+	}()
+	if err := l.CountDown(); err != nil {
+		t.Fatalf("Failed to count down: %v", err)
+	}
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("Failed to await latch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected latch to open")
+	}
+	if n, err := l.Count(); err != nil || n != 0 {
+		t.Errorf("Expected count of 0, got %v (%v)", n, err)
+	}
+}
+
+func TestRegionCountDownLatchExpiry(t *testing.T) {
+	setupFakeZookeeper()
+
+	l, err := RegionCountDownLatch([]byte("latch-expiry"), 1, HoldFor(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create latch: %v", err)
+	}
+	if err := l.CountDown(); err != nil {
+		t.Fatalf("Failed to count down: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// expired count downs no longer count
+	if n, err := l.Count(); err != nil || n != 1 {
+		t.Errorf("Expected count of 1, got %v (%v)", n, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Await(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected latch to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package sync
+
+import (
+	"sync"
+)
+
+// lostNotifier signals (once) that a lock can no longer guarantee exclusivity
+type lostNotifier struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newLostNotifier() *lostNotifier {
+	return &lostNotifier{
+		ch: make(chan struct{}),
+	}
+}
+
+// Lost returns a channel that is closed when exclusivity is lost
+func (n *lostNotifier) Lost() <-chan struct{} {
+	return n.ch
+}
+
+// lose closes the lost channel; it is safe to call this multiple times
+func (n *lostNotifier) lose() {
+	n.once.Do(func() {
+		close(n.ch)
+	})
+}
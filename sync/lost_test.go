@@ -0,0 +1,25 @@
+package sync
+
+import (
+	"testing"
+)
+
+func TestLostNotifier(t *testing.T) {
+	n := newLostNotifier()
+
+	select {
+	case <-n.Lost():
+		t.Fatal("Lost channel should not be closed before lose() is called")
+	default:
+	}
+
+	// should be safe to call multiple times
+	n.lose()
+	n.lose()
+
+	select {
+	case <-n.Lost():
+	default:
+		t.Fatal("Lost channel should be closed after lose() is called")
+	}
+}
@@ -0,0 +1,204 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// memoryProvider implements all primitives in-process, which is useful for unit tests and single node deployments
+type memoryProvider struct {
+	mtx          sync.Mutex
+	seq          uint64
+	locks        map[string]*memoryLock
+	reservations map[string]*memoryReservationEntry
+}
+
+// NewMemoryProvider returns a Provider which coordinates between goroutines within this process only
+func NewMemoryProvider() Provider {
+	return &memoryProvider{
+		locks:        make(map[string]*memoryLock),
+		reservations: make(map[string]*memoryReservationEntry),
+	}
+}
+
+type memoryLock struct {
+	p        *memoryProvider
+	key      string
+	holder   HolderInfo
+	expires  time.Time // zero if the lock is auto refreshed
+	released chan struct{}
+	lost     *lostNotifier
+	once     sync.Once
+}
+
+// Lock attempts to achieve a lock on `id`, waiting until the context is done in case of contention
+func (p *memoryProvider) Lock(ctx context.Context, id []byte, opts ...LockOption) (Lock, error) {
+	o := newLockOptions(defaultRegionHoldFor, opts...)
+	key := string(id)
+
+	for {
+		p.mtx.Lock()
+		cur, ok := p.locks[key]
+		if !ok || cur.expired() {
+			l := &memoryLock{
+				p:        p,
+				key:      key,
+				holder:   o.holder,
+				released: make(chan struct{}),
+				lost:     newLostNotifier(),
+			}
+			l.holder.Since = time.Now()
+			if !o.autoRefresh {
+				l.expires = time.Now().Add(o.holdFor)
+				go l.expireAfter(o.holdFor)
+			}
+			p.locks[key] = l
+			p.mtx.Unlock()
+			return l, nil
+		}
+		released := cur.released
+		holder := cur.holder
+		var expired <-chan time.Time
+		if !cur.expires.IsZero() {
+			expired = time.After(cur.expires.Sub(time.Now()))
+		}
+		p.mtx.Unlock()
+
+		select {
+		case <-released:
+		case <-expired:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, &ContendedError{Holder: &holder}
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *memoryLock) expired() bool {
+	return !l.expires.IsZero() && !l.expires.After(time.Now())
+}
+
+func (l *memoryLock) expireAfter(d time.Duration) {
+	select {
+	case <-l.released:
+	case <-time.After(d):
+		l.lost.lose()
+	}
+}
+
+// Unlock releases the lock
+func (l *memoryLock) Unlock() {
+	l.once.Do(func() {
+		l.p.mtx.Lock()
+		if l.p.locks[l.key] == l {
+			delete(l.p.locks, l.key)
+		}
+		l.p.mtx.Unlock()
+		close(l.released)
+		l.lost.lose()
+	})
+}
+
+// Lost returns a channel which is closed once the lock has expired or been released
+func (l *memoryLock) Lost() <-chan struct{} {
+	return l.lost.Lost()
+}
+
+// Leader blocks until we are elected leader of `id`, or the context is done
+func (p *memoryProvider) Leader(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error) {
+	l, err := p.Lock(ctx, []byte("leader:"+id), append(opts, AutoRefresh())...)
+	if err != nil {
+		return nil, err
+	}
+	return newLockLeader(l), nil
+}
+
+// TryLeader attempts to become leader of `id` without waiting
+func (p *memoryProvider) TryLeader(id string, opts ...LockOption) (HandoverLeader, error) {
+	l, err := tryLock(p, []byte("leader:"+id), append(opts, AutoRefresh())...)
+	if err != nil {
+		return nil, err
+	}
+	return newLockLeader(l), nil
+}
+
+type memoryReservationEntry struct {
+	data  ReservationData
+	token uint64
+}
+
+type memoryReservation struct {
+	p     *memoryProvider
+	key   string
+	owner HolderInfo
+	token uint64
+}
+
+// Reservation returns a reservation for the item `id` under `path`
+func (p *memoryProvider) Reservation(path, id string, opts ...LockOption) Reservation {
+	return &memoryReservation{
+		p:     p,
+		key:   constructPath(path, id),
+		owner: newLockOptions(0, opts...).holder,
+	}
+}
+
+// Reserve will reserve the item for the given amount of time
+func (r *memoryReservation) Reserve(d time.Duration) error {
+	r.p.mtx.Lock()
+	defer r.p.mtx.Unlock()
+
+	if e, ok := r.p.reservations[r.key]; ok && e.data.Expires.After(time.Now()) {
+		return ErrReserved
+	}
+	r.p.seq++
+	r.token = r.p.seq
+	r.p.reservations[r.key] = &memoryReservationEntry{
+		data: ReservationData{
+			Expires: time.Now().Add(d),
+			Owner:   r.owner,
+		},
+		token: r.token,
+	}
+	return nil
+}
+
+// Renew extends our reservation
+func (r *memoryReservation) Renew(d time.Duration) error {
+	r.p.mtx.Lock()
+	defer r.p.mtx.Unlock()
+
+	e, ok := r.p.reservations[r.key]
+	if !ok || r.token == 0 || e.token != r.token {
+		return ErrNotReserved
+	}
+	e.data.Expires = time.Now().Add(d)
+	return nil
+}
+
+// Holder returns details of the current reservation, or nil if the item is not reserved
+func (r *memoryReservation) Holder() (*ReservationData, error) {
+	r.p.mtx.Lock()
+	defer r.p.mtx.Unlock()
+
+	e, ok := r.p.reservations[r.key]
+	if !ok || !e.data.Expires.After(time.Now()) {
+		return nil, nil
+	}
+	rd := e.data
+	return &rd, nil
+}
+
+// Release will release the reservation, regardless of who holds it
+func (r *memoryReservation) Release() error {
+	r.p.mtx.Lock()
+	defer r.p.mtx.Unlock()
+
+	delete(r.p.reservations, r.key)
+	r.token = 0
+	return nil
+}
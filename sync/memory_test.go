@@ -0,0 +1,147 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestMemoryLockContention(t *testing.T) {
+	p := NewMemoryProvider()
+
+	l, err := p.Lock(context.Background(), []byte("foo"), WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.Lock(ctx, []byte("foo"))
+	if !IsContended(err) {
+		t.Fatalf("Expected contention, got %v", err)
+	}
+	if h := err.(*ContendedError).Holder; h == nil || h.Id != "first" {
+		t.Errorf("Expected holder 'first', got %v", h)
+	}
+
+	// unlocking wakes up waiters
+	acquired := make(chan Lock)
+	go func() {
+		l2, err := p.Lock(context.Background(), []byte("foo"))
+		if err != nil {
+			t.Errorf("Unexpected error acquiring lock: %v", err)
+		}
+		acquired <- l2
+	}()
+	l.Unlock()
+
+	select {
+	case <-l.Lost():
+	default:
+		t.Error("Expected Lost() to be closed on Unlock")
+	}
+	select {
+	case l2 := <-acquired:
+		l2.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for lock after Unlock")
+	}
+}
+
+func TestMemoryLockExpires(t *testing.T) {
+	p := NewMemoryProvider()
+
+	l, err := p.Lock(context.Background(), []byte("foo"), HoldFor(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring lock: %v", err)
+	}
+
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("Expected lock to be lost once held beyond holdFor")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l2, err := p.Lock(ctx, []byte("foo"))
+	if err != nil {
+		t.Fatalf("Expected to acquire expired lock, got %v", err)
+	}
+	l2.Unlock()
+
+	// unlocking an expired lock must not release the new holder
+	l.Unlock()
+}
+
+func TestMemoryTryLeader(t *testing.T) {
+	p := NewMemoryProvider()
+
+	l, err := p.TryLeader("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error becoming leader: %v", err)
+	}
+	if _, err := p.TryLeader("foo"); err != ErrNotLeader {
+		t.Errorf("Expected ErrNotLeader, got %v", err)
+	}
+	if err := l.Handover("bar"); err != ErrHandoverUnsupported {
+		t.Errorf("Expected ErrHandoverUnsupported, got %v", err)
+	}
+
+	l.Rescind()
+	select {
+	case <-l.Rescinded():
+	default:
+		t.Error("Expected Rescinded() to be closed")
+	}
+
+	l, err = p.TryLeader("foo")
+	if err != nil {
+		t.Fatalf("Expected to become leader after rescind, got %v", err)
+	}
+	l.Rescind()
+}
+
+func TestMemoryReservation(t *testing.T) {
+	p := NewMemoryProvider()
+	r1 := p.Reservation("/reservations", "foo", WithHolderId("first"))
+	r2 := p.Reservation("/reservations", "foo")
+
+	if err := r1.Reserve(time.Minute); err != nil {
+		t.Fatalf("Unexpected error reserving: %v", err)
+	}
+	if err := r2.Reserve(time.Minute); err != ErrReserved {
+		t.Errorf("Expected ErrReserved, got %v", err)
+	}
+	if err := r2.Renew(time.Minute); err != ErrNotReserved {
+		t.Errorf("Expected ErrNotReserved, got %v", err)
+	}
+	rd, err := r2.Holder()
+	if err != nil || rd == nil || rd.Owner.Id != "first" {
+		t.Errorf("Expected holder 'first', got %v (%v)", rd, err)
+	}
+
+	// anyone may release
+	if err := r2.Release(); err != nil {
+		t.Fatalf("Unexpected error releasing: %v", err)
+	}
+	if err := r1.Renew(time.Minute); err != ErrNotReserved {
+		t.Errorf("Expected ErrNotReserved after release, got %v", err)
+	}
+
+	// expired reservations may be taken over
+	if err := r1.Reserve(time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error reserving: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if rd, _ := r2.Holder(); rd != nil {
+		t.Errorf("Expected no holder once expired, got %v", rd)
+	}
+	if err := r2.Reserve(time.Minute); err != nil {
+		t.Errorf("Expected to reserve expired item, got %v", err)
+	}
+	if err := r1.Renew(time.Minute); err != ErrNotReserved {
+		t.Errorf("Expected ErrNotReserved once taken over, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+var (
+	holderOnce sync.Once
+	holderHost string
+	holderId   string
+)
+
+// HolderInfo describes whoever currently holds a lock
+type HolderInfo struct {
+	Hostname string            `json:"hostname"`
+	Id       string            `json:"id"`
+	Since    time.Time         `json:"since"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (h *HolderInfo) String() string {
+	return fmt.Sprintf("%s@%s since %s", h.Id, h.Hostname, h.Since.Format(time.RFC3339))
+}
+
+// defaultHolder returns a HolderInfo identifying this process
+func defaultHolder() HolderInfo {
+	holderOnce.Do(func() {
+		holderHost, _ = os.Hostname()
+		holderId = fmt.Sprintf("%s-%d", holderHost, os.Getpid())
+	})
+	return HolderInfo{
+		Hostname: holderHost,
+		Id:       holderId,
+	}
+}
+
+func encodeHolder(h HolderInfo) []byte {
+	b, _ := json.Marshal(h)
+	return b
+}
+
+// decodeHolder returns nil if the data does not describe a holder
+func decodeHolder(b []byte) *HolderInfo {
+	if len(b) == 0 {
+		return nil
+	}
+	h := &HolderInfo{}
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil
+	}
+	return h
+}
+
+// LockOption configures how a lock is acquired and held
+type LockOption func(*lockOptions)
+
+type lockOptions struct {
+	holdFor     time.Duration
+	autoRefresh bool
+	holder      HolderInfo
+	client      *zk.Client
+}
+
+func newLockOptions(holdFor time.Duration, opts ...LockOption) *lockOptions {
+	o := &lockOptions{
+		holdFor: holdFor,
+		holder:  defaultHolder(),
+		client:  regionZookeeper,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// HoldFor reserves the lock for a maximum of `d` in the event of failing to Unlock (or refresh) it
+func HoldFor(d time.Duration) LockOption {
+	return func(o *lockOptions) {
+		o.holdFor = d
+	}
+}
+
+// AutoRefresh keeps extending the lock in the background until it is released, so it can be held for longer than
+// the `HoldFor` duration
+func AutoRefresh() LockOption {
+	return func(o *lockOptions) {
+		o.autoRefresh = true
+	}
+}
+
+// WithHolderId overrides the identity of the holder, which defaults to the hostname and process ID
+func WithHolderId(id string) LockOption {
+	return func(o *lockOptions) {
+		o.holder.Id = id
+	}
+}
+
+// WithMetadata attaches a key/value pair to the holder information, which is reported to other contenders
+func WithMetadata(key, value string) LockOption {
+	return func(o *lockOptions) {
+		if o.holder.Metadata == nil {
+			o.holder.Metadata = make(map[string]string)
+		}
+		o.holder.Metadata[key] = value
+	}
+}
+
+// WithZookeeper coordinates via the given ZooKeeper client, rather than the region's (see SetRegionZookeeper). It is
+// ignored by coordination which does not use ZooKeeper.
+func WithZookeeper(c *zk.Client) LockOption {
+	return func(o *lockOptions) {
+		o.client = c
+	}
+}
+
+// ContendedError is returned by the context aware lock functions when a lock could not be obtained due to
+// contention. Holder describes the current owner of the lock, if known.
+type ContendedError struct {
+	Holder *HolderInfo
+}
+
+func (e *ContendedError) Error() string {
+	if e.Holder == nil {
+		return ErrContended.Error()
+	}
+	return fmt.Sprintf("%s (held by %s)", ErrContended.Error(), e.Holder.String())
+}
+
+// IsContended returns whether an error indicates that a lock could not be obtained due to contention
+func IsContended(err error) bool {
+	if err == ErrContended {
+		return true
+	}
+	_, ok := err.(*ContendedError)
+	return ok
+}
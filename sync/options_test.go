@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockOptions(t *testing.T) {
+	o := newLockOptions(time.Second, HoldFor(time.Minute), AutoRefresh(), WithHolderId("foo"), WithMetadata("k", "v"))
+
+	if o.holdFor != time.Minute {
+		t.Errorf("Want holdFor %v, Got %v", time.Minute, o.holdFor)
+	}
+	if !o.autoRefresh {
+		t.Error("Expected autoRefresh to be set")
+	}
+	if o.holder.Id != "foo" {
+		t.Errorf("Want holder ID foo, Got %s", o.holder.Id)
+	}
+	if o.holder.Metadata["k"] != "v" {
+		t.Errorf("Want metadata value v, Got %s", o.holder.Metadata["k"])
+	}
+}
+
+func TestHolderEncoding(t *testing.T) {
+	h := HolderInfo{Hostname: "host", Id: "id", Since: time.Now().UTC().Truncate(time.Second)}
+	decoded := decodeHolder(encodeHolder(h))
+	if decoded == nil {
+		t.Fatal("Expected to decode holder")
+	}
+	if decoded.Id != h.Id || decoded.Hostname != h.Hostname || !decoded.Since.Equal(h.Since) {
+		t.Errorf("Want %v, Got %v", h, decoded)
+	}
+
+	// legacy lock data (ie: none, or a gob encoded time) is not a holder
+	if decodeHolder([]byte{}) != nil {
+		t.Error("Expected empty data not to decode")
+	}
+	if decodeHolder(encodeTTL(time.Now())) != nil {
+		t.Error("Expected TTL data not to decode")
+	}
+}
+
+func TestIsContended(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{ErrContended, true},
+		{&ContendedError{}, true},
+		{&ContendedError{Holder: &HolderInfo{Id: "foo"}}, true},
+		{errors.New("foo"), false},
+		{nil, false},
+	}
+
+	for i, tc := range testCases {
+		if got := IsContended(tc.err); got != tc.expected {
+			t.Errorf("Want %v, Got %v (Case %d)", tc.expected, got, i)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package sync
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrHandoverUnsupported = errors.New("Leadership handover is not supported by this provider")
+)
+
+// LockProvider achieves locks
+type LockProvider interface {
+	// Lock attempts to achieve a lock on `id`, waiting until the context is done in case of contention
+	Lock(ctx context.Context, id []byte, opts ...LockOption) (Lock, error)
+}
+
+// LeaderProvider elects leaders
+type LeaderProvider interface {
+	// Leader blocks until we are elected leader of `id`, or the context is done
+	Leader(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error)
+	// TryLeader attempts to become leader of `id` without waiting, returning ErrNotLeader if someone else leads
+	TryLeader(id string, opts ...LockOption) (HandoverLeader, error)
+}
+
+// ReservationProvider creates reservations
+type ReservationProvider interface {
+	// Reservation returns a reservation for the item `id` under `path`
+	Reservation(path, id string, opts ...LockOption) Reservation
+}
+
+// Provider supplies all of our synchronisation primitives. Code which depends on a Provider (rather than calling the
+// package level functions directly) can be unit tested with NewMemoryProvider.
+type Provider interface {
+	LockProvider
+	LeaderProvider
+	ReservationProvider
+}
+
+var (
+	// RegionProvider coordinates within the local operating region via ZooKeeper
+	RegionProvider Provider = &regionProvider{}
+	// GlobalProvider coordinates globally; locks are held in Cassandra, and leaders are region leaders pinned to one
+	// region based on config. Reservations are regional (via ZooKeeper).
+	GlobalProvider Provider = &globalProvider{}
+)
+
+type regionProvider struct{}
+
+func (p *regionProvider) Lock(ctx context.Context, id []byte, opts ...LockOption) (Lock, error) {
+	return RegionLockContext(ctx, id, opts...)
+}
+
+func (p *regionProvider) Leader(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error) {
+	return RegionLeaderWithin(ctx, id, opts...)
+}
+
+func (p *regionProvider) TryLeader(id string, opts ...LockOption) (HandoverLeader, error) {
+	return TryRegionLeader(id, opts...)
+}
+
+func (p *regionProvider) Reservation(path, id string, opts ...LockOption) Reservation {
+	return NewReservation(path, id, syncACL(newLockOptions(0, opts...).client), opts...)
+}
+
+type globalProvider struct {
+	regionProvider
+}
+
+func (p *globalProvider) Lock(ctx context.Context, id []byte, opts ...LockOption) (Lock, error) {
+	return GlobalLockContext(ctx, id, opts...)
+}
+
+// Reservation returns a reservation on the global ensemble, if set, or else within the region
+func (p *globalProvider) Reservation(path, id string, opts ...LockOption) Reservation {
+	if globalZookeeper != nil {
+		opts = globalOptions(opts)
+	}
+	return p.regionProvider.Reservation(path, id, opts...)
+}
+
+func (p *globalProvider) Leader(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error) {
+	return GlobalLeaderWithin(ctx, id, opts...)
+}
+
+func (p *globalProvider) TryLeader(id string, opts ...LockOption) (HandoverLeader, error) {
+	return TryGlobalLeader(id, opts...)
+}
+
+// lockLeader adapts a lock (which should be auto refreshed) into leadership, for providers which have no native
+// concept of an election
+type lockLeader struct {
+	lock      Lock
+	rescinded chan struct{}
+	once      sync.Once
+}
+
+func newLockLeader(l Lock) *lockLeader {
+	ll := &lockLeader{
+		lock:      l,
+		rescinded: make(chan struct{}),
+	}
+	go func() {
+		<-l.Lost()
+		ll.Rescind()
+	}()
+	return ll
+}
+
+// Rescinded returns a channel that will close when you are no longer the leader
+func (ll *lockLeader) Rescinded() chan struct{} {
+	return ll.rescinded
+}
+
+// Rescind should be called to indicate you no longer wish to be the leader
+func (ll *lockLeader) Rescind() {
+	ll.once.Do(func() {
+		close(ll.rescinded)
+		ll.lock.Unlock()
+	})
+}
+
+// Handover is not supported when leadership is a plain lock
+func (ll *lockLeader) Handover(candidateId string) error {
+	return ErrHandoverUnsupported
+}
+
+// tryLock attempts to achieve a lock without waiting, returning ErrNotLeader on contention
+func tryLock(p LockProvider, id []byte, opts ...LockOption) (Lock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	l, err := p.Lock(ctx, id, opts...)
+	if IsContended(err) {
+		return nil, ErrNotLeader
+	}
+	return l, err
+}
@@ -0,0 +1,225 @@
+package sync
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	inst "github.com/HailoOSS/service/instrumentation"
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+const (
+	itemNodePrefix         = "item-"
+	defaultClaimFor        = time.Second * 30
+	queueClaimPollInterval = time.Second
+)
+
+// Queue is a durable distributed FIFO queue. Items are claimed by one worker at a time, and are only removed once
+// acknowledged; if a worker Nacks an item, or crashes, or its claim expires, the item may be taken by another worker.
+type Queue interface {
+	// Put adds an item to the back of the queue
+	Put(data []byte) (string, error)
+	// Take claims the item nearest the front of the queue which is not already claimed, waiting until the context is
+	// done if there are none
+	Take(ctx context.Context) (*QueueItem, error)
+	// Ack removes a claimed item from the queue
+	Ack(item *QueueItem) error
+	// Nack releases our claim on an item, so that it may be taken again
+	Nack(item *QueueItem) error
+	// Depth returns the number of items in the queue, including those which are claimed
+	Depth() (int, error)
+}
+
+// QueueItem is an item which has been taken from a queue
+type QueueItem struct {
+	Id    string
+	Data  []byte
+	claim Reservation
+}
+
+// Renew extends our claim on the item, returning ErrNotReserved if it has already expired
+func (qi *QueueItem) Renew(d time.Duration) error {
+	return qi.claim.Renew(d)
+}
+
+type regionQueue struct {
+	client     *zk.Client
+	itemsPath  string
+	claimsPath string
+	claimFor   time.Duration
+	opts       []LockOption
+}
+
+// RegionQueue returns a queue on `id` within the local operating region. Queues are namespaced per service (see
+// SetRegionLockNamespace), and items are claimed for 30 seconds unless overridden with HoldFor.
+func RegionQueue(id []byte, opts ...LockOption) (Queue, error) {
+	path, err := constructRecipePath("queue", string(id))
+	if err != nil {
+		return nil, err
+	}
+	o := newLockOptions(defaultClaimFor, opts...)
+	return &regionQueue{
+		client:     o.client,
+		itemsPath:  path + "/items",
+		claimsPath: path + "/claims",
+		claimFor:   o.holdFor,
+		opts:       opts,
+	}, nil
+}
+
+// Put adds an item to the back of the queue, returning its ID
+func (q *regionQueue) Put(data []byte) (string, error) {
+	var (
+		node string
+		err  error
+	)
+	for i := 0; i < maxCreateAttempts; i++ {
+		node, err = q.client.Create(q.itemsPath+"/"+itemNodePrefix, data, gozk.FlagSequence, syncACL(q.client))
+		if err != gozk.ErrNoNode {
+			break
+		}
+		if err := q.client.CreateParents(q.itemsPath); err != nil {
+			return "", err
+		}
+	}
+	if err != nil {
+		log.Errorf("[Sync:RegionQueue] Failed to put item on '%s': %v", q.itemsPath, err)
+		inst.Counter(1.0, "sync.regionqueue.put.failure")
+		return "", err
+	}
+	inst.Counter(1.0, "sync.regionqueue.put.success")
+
+	return nodeName(node), nil
+}
+
+// Take claims the first unclaimed item
+func (q *regionQueue) Take(ctx context.Context) (*QueueItem, error) {
+	startTime := time.Now()
+	defer func() {
+		inst.Timing(1.0, "sync.regionqueue.take", time.Since(startTime))
+	}()
+
+	for {
+		items, _, itemsWatch, err := q.client.ChildrenW(q.itemsPath)
+		if err == gozk.ErrNoNode {
+			if err := q.client.CreateParents(q.itemsPath); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, id := range sortItems(items) {
+			item, err := q.claim(id)
+			if err != nil {
+				return nil, err
+			} else if item != nil {
+				inst.Counter(1.0, "sync.regionqueue.take.success")
+				return item, nil
+			}
+		}
+
+		// we're woken by new items, or released claims; expired claims don't notify anyone so we also poll
+		_, _, claimsWatch, err := q.client.ChildrenW(q.claimsPath)
+		if err != nil && err != gozk.ErrNoNode {
+			return nil, err
+		}
+		select {
+		case <-itemsWatch:
+		case <-claimsWatch:
+		case <-time.After(queueClaimPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// claim attempts to claim the item with the given ID, returning nil if it is already claimed (or gone)
+func (q *regionQueue) claim(id string) (*QueueItem, error) {
+	claim := NewEphemeralReservation(q.claimsPath, id, syncACL(q.client), q.opts...)
+	if err := claim.Reserve(q.claimFor); err == ErrReserved {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, _, err := q.client.Get(q.itemsPath + "/" + id)
+	if err == gozk.ErrNoNode {
+		// acked by someone else since we listed it
+		claim.Release()
+		return nil, nil
+	} else if err != nil {
+		claim.Release()
+		return nil, err
+	}
+
+	return &QueueItem{
+		Id:    id,
+		Data:  data,
+		claim: claim,
+	}, nil
+}
+
+// Ack removes the item from the queue, as long as our claim hasn't expired
+func (q *regionQueue) Ack(item *QueueItem) error {
+	if err := item.claim.Renew(q.claimFor); err != nil {
+		inst.Counter(1.0, "sync.regionqueue.ack.failure")
+		return err
+	}
+	if err := q.client.Delete(q.itemsPath+"/"+item.Id, -1); err != nil && err != gozk.ErrNoNode {
+		inst.Counter(1.0, "sync.regionqueue.ack.failure")
+		return err
+	}
+	inst.Counter(1.0, "sync.regionqueue.ack.success")
+
+	return item.claim.Release()
+}
+
+// Nack releases our claim on the item, as long as it hasn't expired (and been claimed by someone else)
+func (q *regionQueue) Nack(item *QueueItem) error {
+	if err := item.claim.Renew(q.claimFor); err != nil {
+		return err
+	}
+	inst.Counter(1.0, "sync.regionqueue.nack")
+
+	return item.claim.Release()
+}
+
+// Depth returns the number of items in the queue
+func (q *regionQueue) Depth() (int, error) {
+	items, _, err := q.client.Children(q.itemsPath)
+	if err == gozk.ErrNoNode {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return countPrefixed(items, itemNodePrefix), nil
+}
+
+// sortItems returns item nodes sorted by sequence number
+func sortItems(children []string) []string {
+	nodes := make(sequenceNodes, 0, len(children))
+	for _, c := range children {
+		if !strings.HasPrefix(c, itemNodePrefix) {
+			continue
+		}
+		seq, err := parseSeq(c)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, sequenceNode{name: c, seq: seq})
+	}
+	sort.Sort(nodes)
+
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.name
+	}
+	return ids
+}
@@ -0,0 +1,189 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSortItems(t *testing.T) {
+	children := []string{"item-0000000010", "item-0000000002", "reserve-item-0000000001", "item-0000000009"}
+
+	want := []string{"item-0000000002", "item-0000000009", "item-0000000010"}
+	if got := sortItems(children); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want %v, Got %v", want, got)
+	}
+}
+
+func TestRegionQueue(t *testing.T) {
+	setupFakeZookeeper()
+
+	q, err := RegionQueue([]byte("queue"))
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := q.Put([]byte(data)); err != nil {
+			t.Fatalf("Failed to put item: %v", err)
+		}
+	}
+	if n, err := q.Depth(); err != nil || n != 3 {
+		t.Errorf("Expected depth of 3, got %v (%v)", n, err)
+	}
+
+	// items are taken in order, skipping those already claimed
+	a := takeItem(t, q, "a")
+	b := takeItem(t, q, "b")
+
+	// acked items are removed
+	if err := q.Ack(a); err != nil {
+		t.Fatalf("Failed to ack: %v", err)
+	}
+	if n, err := q.Depth(); err != nil || n != 2 {
+		t.Errorf("Expected depth of 2, got %v (%v)", n, err)
+	}
+
+	// nacked items may be taken again
+	if err := q.Nack(b); err != nil {
+		t.Fatalf("Failed to nack: %v", err)
+	}
+	b = takeItem(t, q, "b")
+	c := takeItem(t, q, "c")
+
+	// with everything claimed, there is nothing to take
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if item, err := q.Take(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected nothing to take, got %v (%v)", item, err)
+	}
+
+	// until something is put
+	taken := make(chan *QueueItem, 1)
+	go func() {
+		if item, err := q.Take(context.Background()); err == nil {
+			taken <- item
+		}
+	}()
+	if _, err := q.Put([]byte("d")); err != nil {
+		t.Fatalf("Failed to put item: %v", err)
+	}
+	select {
+	case d := <-taken:
+		if string(d.Data) != "d" {
+			t.Errorf("Want d, Got %s", d.Data)
+		}
+		q.Ack(d)
+	case <-time.After(time.Second):
+		t.Fatal("Expected to take new item")
+	}
+
+	q.Ack(b)
+	q.Ack(c)
+	if n, err := q.Depth(); err != nil || n != 0 {
+		t.Errorf("Expected depth of 0, got %v (%v)", n, err)
+	}
+}
+
+func TestRegionQueueClaimExpiry(t *testing.T) {
+	setupFakeZookeeper()
+
+	q, err := RegionQueue([]byte("queue-expiry"), HoldFor(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	if _, err := q.Put([]byte("a")); err != nil {
+		t.Fatalf("Failed to put item: %v", err)
+	}
+
+	// once our claim expires, the item may be taken by another worker
+	first := takeItem(t, q, "a")
+	time.Sleep(30 * time.Millisecond)
+	second := takeItem(t, q, "a")
+
+	// and we can no longer ack it
+	if err := q.Ack(first); err != ErrNotReserved {
+		t.Errorf("Want %v, Got %v", ErrNotReserved, err)
+	}
+	if n, err := q.Depth(); err != nil || n != 1 {
+		t.Errorf("Expected item to remain, got depth %v (%v)", n, err)
+	}
+	if err := q.Ack(second); err != nil {
+		t.Errorf("Failed to ack: %v", err)
+	}
+}
+
+func TestRegionQueueClaimSessionExpiry(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	q, err := RegionQueue([]byte("queue-session"), HoldFor(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	if _, err := q.Put([]byte("a")); err != nil {
+		t.Fatalf("Failed to put item: %v", err)
+	}
+	takeItem(t, q, "a")
+
+	// claims go with the session of the worker which crashed
+	fake.ExpireSession()
+	a := takeItem(t, q, "a")
+	if err := q.Ack(a); err != nil {
+		t.Errorf("Failed to ack: %v", err)
+	}
+}
+
+func TestRegionQueueReclaimOutlivesPreviousClaimant(t *testing.T) {
+	setupFakeZookeeper()
+	first, firstSession := newFakeSession("first-worker")
+	defer first.TearDown()
+	second, _ := newFakeSession("second-worker")
+	defer second.TearDown()
+
+	q1, err := RegionQueue([]byte("queue-reclaim"), HoldFor(20*time.Millisecond), WithZookeeper(first))
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	q2, err := RegionQueue([]byte("queue-reclaim"), WithZookeeper(second))
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	q3, err := RegionQueue([]byte("queue-reclaim"))
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	if _, err := q1.Put([]byte("a")); err != nil {
+		t.Fatalf("Failed to put item: %v", err)
+	}
+
+	// the first worker's claim expires, and the item is taken by a second
+	takeItem(t, q1, "a")
+	time.Sleep(30 * time.Millisecond)
+	a := takeItem(t, q2, "a")
+
+	// the first worker then goes away, which must not release the second's claim
+	firstSession.ExpireSession()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if item, err := q3.Take(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected item to still be claimed, got %v (%v)", item, err)
+	}
+	if err := q2.Ack(a); err != nil {
+		t.Errorf("Failed to ack: %v", err)
+	}
+}
+
+// takeItem takes the next item from the queue, which is expected to be `want`
+func takeItem(t *testing.T, q Queue, want string) *QueueItem {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	item, err := q.Take(ctx)
+	if err != nil {
+		t.Fatalf("Failed to take %s: %v", want, err)
+	}
+	if string(item.Data) != want {
+		t.Fatalf("Want %s, Got %s", want, item.Data)
+	}
+	return item
+}
@@ -0,0 +1,363 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	"github.com/HailoOSS/service/config"
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+// RateLimitAlgorithm determines how events are counted against a RateLimit
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket permits bursts of up to RateLimit.Burst events, refilling at Limit per Per
+	TokenBucket RateLimitAlgorithm = iota
+	// SlidingWindow permits at most Limit events in any period of length Per
+	SlidingWindow
+)
+
+const (
+	// localSweepSize is the number of keys the local backend tracks before sweeping idle ones
+	localSweepSize = 10000
+	// limitCacheSize is the number of keys a RateLimiter caches limits for before forgetting them
+	limitCacheSize = 10000
+)
+
+var (
+	ErrRateLimited = errors.New("Rate limit exceeded")
+)
+
+// RateLimit describes how many events are permitted for a key
+type RateLimit struct {
+	// Limit is the number of events permitted per period
+	Limit int
+	// Per is the length of the period
+	Per time.Duration
+	// Burst is the capacity of the token bucket, which defaults to Limit
+	Burst int
+	// Local is the limit applied by each instance while the shared backend is unavailable, which defaults to Limit
+	Local int
+}
+
+// Capacity returns the capacity of the token bucket
+func (l RateLimit) Capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Limit
+}
+
+// local returns the limit to apply within this instance only
+func (l RateLimit) local() RateLimit {
+	if l.Local > 0 {
+		l.Limit, l.Burst = l.Local, 0
+	}
+	return l
+}
+
+// RateLimitBackend counts events so that limits may be shared between instances
+type RateLimitBackend interface {
+	// Take attempts to count a single event against `key`. If the event is not allowed, the time to wait until it may
+	// be is returned.
+	Take(key string, alg RateLimitAlgorithm, l RateLimit) (allowed bool, wait time.Duration, err error)
+}
+
+// RateLimiter limits the rate of events per key. Limits are read from config at:
+//
+//	hailo.service.sync.ratelimit.<name>.<key>     {"limit": 100, "per": "1s", "burst": 200, "local": 20}
+//	hailo.service.sync.ratelimit.<name>.default
+//
+// falling back to the limit the RateLimiter was created with. If the backend is unavailable, each instance applies
+// the "local" limit by itself.
+type RateLimiter struct {
+	name         string
+	alg          RateLimitAlgorithm
+	backend      RateLimitBackend
+	local        *localRateLimitBackend
+	defaultLimit RateLimit
+
+	mtx    sync.RWMutex
+	limits map[string]RateLimit
+
+	exit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRateLimiter returns a rate limiter called `name` which counts events in `backend` (such as
+// memcache.RateLimitBackend or redis.RateLimitBackend). If backend is nil, limits apply within this instance only.
+// Rate limiters watch config for changes to their limits until closed.
+func NewRateLimiter(name string, alg RateLimitAlgorithm, backend RateLimitBackend, def RateLimit) *RateLimiter {
+	rl := &RateLimiter{
+		name:         name,
+		alg:          alg,
+		backend:      backend,
+		local:        newLocalRateLimitBackend(),
+		defaultLimit: def,
+		limits:       make(map[string]RateLimit),
+		exit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go rl.configLoop()
+	return rl
+}
+
+// Close stops watching config for changes to our limits. The rate limiter may still be used, with the limits it had
+// already loaded.
+func (rl *RateLimiter) Close() {
+	rl.closeOnce.Do(func() {
+		close(rl.exit)
+	})
+	<-rl.done
+}
+
+// Allow counts an event against `key`, returning whether it is within the limit
+func (rl *RateLimiter) Allow(key string) bool {
+	allowed, _ := rl.take(key)
+	return allowed
+}
+
+// Wait blocks until an event against `key` is within the limit. ErrRateLimited is returned (without waiting) if this
+// cannot happen before the context's deadline.
+func (rl *RateLimiter) Wait(ctx context.Context, key string) error {
+	for {
+		allowed, wait := rl.take(key)
+		if allowed {
+			return nil
+		}
+		if wait <= 0 {
+			wait = addJitter(delayFor)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return ErrRateLimited
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Limit returns the limit applied to `key`
+func (rl *RateLimiter) Limit(key string) RateLimit {
+	rl.mtx.RLock()
+	l, ok := rl.limits[key]
+	rl.mtx.RUnlock()
+	if ok {
+		return l
+	}
+
+	l = rl.loadLimit(key)
+	rl.mtx.Lock()
+	if len(rl.limits) >= limitCacheSize {
+		// keys are often one-offs (eg: per user), so rather than growing forever start again
+		rl.limits = make(map[string]RateLimit)
+	}
+	rl.limits[key] = l
+	rl.mtx.Unlock()
+	return l
+}
+
+func (rl *RateLimiter) take(key string) (bool, time.Duration) {
+	l := rl.Limit(key)
+	if l.Limit <= 0 || l.Per <= 0 {
+		// no limit
+		return true, 0
+	}
+
+	var (
+		allowed bool
+		wait    time.Duration
+		err     error = ErrRateLimited
+	)
+	if rl.backend != nil {
+		allowed, wait, err = rl.backend.Take(rl.backendKey(key), rl.alg, l)
+		if err != nil {
+			log.Debugf("[Sync:RateLimiter] Backend unavailable for '%s', applying local limit: %v", rl.name, err)
+			inst.Counter(1.0, fmt.Sprintf("sync.ratelimit.%s.fallback", rl.name))
+		}
+	}
+	if err != nil {
+		allowed, wait, _ = rl.local.Take(key, rl.alg, l.local())
+	}
+
+	if !allowed {
+		inst.Counter(1.0, fmt.Sprintf("sync.ratelimit.%s.rejected", rl.name))
+	}
+	return allowed, wait
+}
+
+func (rl *RateLimiter) backendKey(key string) string {
+	return fmt.Sprintf("ratelimit:%s:%s:%s", regionLockNamespace, rl.name, key)
+}
+
+// loadLimit reads the limit for `key` from config
+func (rl *RateLimiter) loadLimit(key string) RateLimit {
+	path := []string{"hailo", "service", "sync", "ratelimit", rl.name}
+	l := limitFromConfig(config.AtPath(append(path, "default")...), rl.defaultLimit)
+	return limitFromConfig(config.AtPath(append(path, key)...), l)
+}
+
+func limitFromConfig(c config.ConfigElement, def RateLimit) RateLimit {
+	return RateLimit{
+		Limit: c.AtPath("limit").AsInt(def.Limit),
+		Per:   c.AtPath("per").AsDuration(def.Per.String()),
+		Burst: c.AtPath("burst").AsInt(def.Burst),
+		Local: c.AtPath("local").AsInt(def.Local),
+	}
+}
+
+// configLoop forgets our limits whenever config changes, so they are reloaded on next use, until we are closed
+func (rl *RateLimiter) configLoop() {
+	defer close(rl.done)
+
+	ch := config.SubscribeChanges()
+	for {
+		select {
+		case <-ch:
+			rl.mtx.Lock()
+			rl.limits = make(map[string]RateLimit)
+			rl.mtx.Unlock()
+		case <-rl.exit:
+			return
+		}
+	}
+}
+
+// TakeToken refills a token bucket which last held `tokens` at `last`, and attempts to take a token from it at `now`.
+// Backends use this to implement the TokenBucket algorithm.
+func (l RateLimit) TakeToken(tokens float64, last, now time.Time) (remaining float64, allowed bool, wait time.Duration) {
+	perToken := float64(l.Per) / float64(l.Limit)
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens += float64(elapsed) / perToken
+	}
+	tokens = math.Min(tokens, float64(l.Capacity()))
+
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration(math.Ceil((1 - tokens) * perToken))
+}
+
+// AllowWindow approximates the number of events in the last period by weighting the count from the previous fixed
+// window by how much of it overlaps the sliding one. `offset` is how far into the current window we are, and `cur`
+// includes the event being checked. Backends use this to implement the SlidingWindow algorithm.
+func (l RateLimit) AllowWindow(prev, cur int64, offset time.Duration) (allowed bool, wait time.Duration) {
+	weight := 1 - float64(offset)/float64(l.Per)
+	if float64(prev)*weight+float64(cur) <= float64(l.Limit) {
+		return true, 0
+	}
+
+	untilNext := l.Per - offset
+	if cur > int64(l.Limit) || prev == 0 {
+		return false, untilNext
+	}
+	// wait until enough of the previous window has slid out
+	needed := 1 - float64(int64(l.Limit)-cur)/float64(prev)
+	wait = time.Duration(needed*float64(l.Per)) - offset
+	if wait <= 0 || wait > untilNext {
+		wait = untilNext
+	}
+	return false, wait
+}
+
+// Window returns the index of the fixed window containing `t`, and how far into it `t` is
+func (l RateLimit) Window(t time.Time) (index int64, offset time.Duration) {
+	n := t.UnixNano()
+	return n / int64(l.Per), time.Duration(n % int64(l.Per))
+}
+
+// localRateLimitBackend counts events within this instance only
+type localRateLimitBackend struct {
+	mtx     sync.Mutex
+	buckets map[string]*localBucket
+	windows map[string]*localWindow
+}
+
+type localBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type localWindow struct {
+	index     int64
+	prev, cur int64
+	last      time.Time
+}
+
+func newLocalRateLimitBackend() *localRateLimitBackend {
+	return &localRateLimitBackend{
+		buckets: make(map[string]*localBucket),
+		windows: make(map[string]*localWindow),
+	}
+}
+
+func (b *localRateLimitBackend) Take(key string, alg RateLimitAlgorithm, l RateLimit) (bool, time.Duration, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	b.sweep(now, l.Per)
+
+	if alg == SlidingWindow {
+		index, offset := l.Window(now)
+		w, ok := b.windows[key]
+		if !ok {
+			w = &localWindow{index: index}
+			b.windows[key] = w
+		}
+		switch {
+		case w.index == index-1:
+			w.prev, w.cur = w.cur, 0
+		case w.index < index-1:
+			w.prev, w.cur = 0, 0
+		}
+		w.index, w.last = index, now
+
+		allowed, wait := l.AllowWindow(w.prev, w.cur+1, offset)
+		if allowed {
+			w.cur++
+		}
+		return allowed, wait, nil
+	}
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &localBucket{tokens: float64(l.Capacity()), last: now}
+		b.buckets[key] = bucket
+	}
+	var (
+		allowed bool
+		wait    time.Duration
+	)
+	bucket.tokens, allowed, wait = l.TakeToken(bucket.tokens, bucket.last, now)
+	bucket.last = now
+	return allowed, wait, nil
+}
+
+// sweep forgets keys which have been idle long enough to have no effect, once we are tracking lots of them
+func (b *localRateLimitBackend) sweep(now time.Time, per time.Duration) {
+	if len(b.buckets)+len(b.windows) < localSweepSize {
+		return
+	}
+	for k, bucket := range b.buckets {
+		if now.Sub(bucket.last) > 2*per {
+			delete(b.buckets, k)
+		}
+	}
+	for k, w := range b.windows {
+		if now.Sub(w.last) > 2*per {
+			delete(b.windows, k)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/HailoOSS/service/config"
+)
+
+func TestTakeToken(t *testing.T) {
+	l := RateLimit{Limit: 10, Per: time.Second, Burst: 2}
+	now := time.Now()
+
+	tokens, allowed, _ := l.TakeToken(2, now, now)
+	if !allowed || tokens != 1 {
+		t.Errorf("Expected to take a token leaving 1, got allowed=%v tokens=%v", allowed, tokens)
+	}
+	tokens, allowed, _ = l.TakeToken(tokens, now, now)
+	if !allowed || tokens != 0 {
+		t.Errorf("Expected to take a token leaving 0, got allowed=%v tokens=%v", allowed, tokens)
+	}
+	_, allowed, wait := l.TakeToken(tokens, now, now)
+	if allowed || wait != 100*time.Millisecond {
+		t.Errorf("Expected rejection with 100ms wait, got allowed=%v wait=%v", allowed, wait)
+	}
+
+	// refills at 10 per second, up to the burst
+	tokens, allowed, _ = l.TakeToken(0, now, now.Add(time.Hour))
+	if !allowed || tokens != 1 {
+		t.Errorf("Expected refill to burst, got allowed=%v tokens=%v", allowed, tokens)
+	}
+}
+
+func TestAllowWindow(t *testing.T) {
+	l := RateLimit{Limit: 10, Per: time.Second}
+
+	testCases := []struct {
+		prev, cur int64
+		offset    time.Duration
+		allowed   bool
+		wait      time.Duration
+	}{
+		{0, 1, 0, true, 0},
+		{0, 10, 0, true, 0},
+		{0, 11, 0, false, time.Second},
+		{0, 11, 400 * time.Millisecond, false, 600 * time.Millisecond},
+		// half of the previous window overlaps, so 5 + 5
+		{10, 5, 500 * time.Millisecond, true, 0},
+		// 5 + 6 is over; once 60% of the previous window has slid out 4 + 6 is ok
+		{10, 6, 500 * time.Millisecond, false, 100 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		allowed, wait := l.AllowWindow(tc.prev, tc.cur, tc.offset)
+		if allowed != tc.allowed || wait != tc.wait {
+			t.Errorf("AllowWindow(%d, %d, %v): want %v %v, got %v %v", tc.prev, tc.cur, tc.offset, tc.allowed, tc.wait,
+				allowed, wait)
+		}
+	}
+}
+
+func TestLocalRateLimitBackend(t *testing.T) {
+	for _, alg := range []RateLimitAlgorithm{TokenBucket, SlidingWindow} {
+		b := newLocalRateLimitBackend()
+		l := RateLimit{Limit: 3, Per: time.Hour}
+
+		for i := 0; i < 3; i++ {
+			if allowed, _, _ := b.Take("foo", alg, l); !allowed {
+				t.Errorf("Algorithm %d: expected event %d to be allowed", alg, i)
+			}
+		}
+		if allowed, wait, _ := b.Take("foo", alg, l); allowed || wait <= 0 {
+			t.Errorf("Algorithm %d: expected rejection with a wait, got allowed=%v wait=%v", alg, allowed, wait)
+		}
+		if allowed, _, _ := b.Take("bar", alg, l); !allowed {
+			t.Errorf("Algorithm %d: expected keys to be limited independently", alg)
+		}
+	}
+}
+
+type failingRateLimitBackend struct{}
+
+func (b *failingRateLimitBackend) Take(key string, alg RateLimitAlgorithm, l RateLimit) (bool, time.Duration, error) {
+	return false, 0, errors.New("unavailable")
+}
+
+func TestRateLimiterFallback(t *testing.T) {
+	rl := NewRateLimiter("test", TokenBucket, &failingRateLimitBackend{}, RateLimit{Limit: 10, Per: time.Hour, Local: 1})
+
+	if !rl.Allow("foo") {
+		t.Error("Expected first event to be allowed by local limit")
+	}
+	if rl.Allow("foo") {
+		t.Error("Expected second event to be rejected by local limit")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	rl := NewRateLimiter("test", TokenBucket, nil, RateLimit{Limit: 1, Per: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := rl.Wait(ctx, "foo"); err != nil {
+			t.Fatalf("Unexpected error waiting: %v", err)
+		}
+	}
+
+	// cannot happen before the deadline
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := rl.Wait(ctx, "foo"); err != ErrRateLimited {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+
+	// no limit
+	rl = NewRateLimiter("test", TokenBucket, nil, RateLimit{})
+	for i := 0; i < 100; i++ {
+		if !rl.Allow("foo") {
+			t.Fatal("Expected all events to be allowed without a limit")
+		}
+	}
+}
+
+func TestRateLimiterClose(t *testing.T) {
+	setupFakeZookeeper()
+
+	rl := NewRateLimiter("closed", TokenBucket, nil, RateLimit{Limit: 1, Per: time.Second})
+	if l := rl.Limit("foo"); l.Limit != 1 {
+		t.Fatalf("Expected default limit, got %v", l)
+	}
+	rl.Close()
+	rl.Close()
+
+	// once closed, we no longer reload limits when config changes
+	config.Load(bytes.NewBufferString(`{"hailo": {"service": {"zookeeper": {"hosts": ["localhost:2181"]}, ` +
+		`"sync": {"ratelimit": {"closed": {"default": {"limit": 5}}}}}}}`))
+	if l := rl.Limit("foo"); l.Limit != 1 {
+		t.Errorf("Expected limit not to be reloaded once closed, got %v", l)
+	}
+	if !rl.Allow("foo") {
+		t.Error("Expected closed rate limiter to still allow events")
+	}
+}
+
+func TestRateLimiterLimitCacheIsBounded(t *testing.T) {
+	rl := NewRateLimiter("bounded", TokenBucket, nil, RateLimit{Limit: 1, Per: time.Second})
+	defer rl.Close()
+
+	for i := 0; i <= limitCacheSize; i++ {
+		if l := rl.Limit(fmt.Sprintf("key-%d", i)); l.Limit != 1 {
+			t.Fatalf("Expected default limit, got %v", l)
+		}
+	}
+	rl.mtx.RLock()
+	n := len(rl.limits)
+	rl.mtx.RUnlock()
+	if n > limitCacheSize {
+		t.Errorf("Expected at most %d cached limits, got %d", limitCacheSize, n)
+	}
+}
@@ -0,0 +1,266 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+const (
+	lockNodePrefix    = "lock-"
+	maxCreateAttempts = 3
+	holderInfoRoot    = "/sync/holders"
+)
+
+var (
+	ErrNodeVanished = errors.New("Our ZooKeeper node no longer exists")
+)
+
+// sequenceNode is a child node which was created with the sequential flag, eg: "_c_<guid>-lock-0000000001"
+type sequenceNode struct {
+	name string
+	seq  int
+}
+
+type sequenceNodes []sequenceNode
+
+func (s sequenceNodes) Len() int           { return len(s) }
+func (s sequenceNodes) Less(i, j int) bool { return s[i].seq < s[j].seq }
+func (s sequenceNodes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// indexOf returns the position of the named node, or -1 if it is not present
+func (s sequenceNodes) indexOf(name string) int {
+	for i, n := range s {
+		if n.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// holdsFunc decides whether the node at position `i` of the sorted children holds a lock. If not, it returns the name
+// of the node which we should wait to be deleted before checking again (or "" to wait for any change to the children).
+type holdsFunc func(nodes sequenceNodes, i int) (holds bool, waitOn string)
+
+// holdsExclusive is held by the lowest node, with each node waiting on the node next in line for the lock
+func holdsExclusive(nodes sequenceNodes, i int) (bool, string) {
+	if i == 0 {
+		return true, ""
+	}
+	return false, nodes[i-1].name
+}
+
+// constructRecipePath namespaces the path for a recipe (eg: "rwlock") within the region lock namespace
+func constructRecipePath(recipe, id string) (string, error) {
+	if regionLockNamespace == "" {
+		return "", fmt.Errorf("Namespace or ID cannot be blank")
+	}
+	return constructLockPath(regionLockNamespace+"/."+recipe, id)
+}
+
+// createSequenceNode creates a protected ephemeral sequential node under `path`, creating any parents as required. It
+// returns the full path of the node which was created.
+func createSequenceNode(c *zk.Client, path, prefix string, data []byte) (string, error) {
+	var (
+		node string
+		err  error
+	)
+	for i := 0; i < maxCreateAttempts; i++ {
+		node, err = c.CreateProtectedEphemeralSequential(path+"/"+prefix, data, syncACL(c))
+		if err != gozk.ErrNoNode {
+			break
+		}
+		// the parent may have been reaped from under us, so keep trying to create it
+		if err := c.CreateParents(path); err != nil {
+			return "", err
+		}
+	}
+	return node, err
+}
+
+// sequenceChildren returns the children of `path` created with the given prefix (or all children if the prefix is
+// blank), sorted by sequence number. Any nodes which contain an expiry time which has passed are deleted along the way.
+func sequenceChildren(c *zk.Client, path, prefix string) (sequenceNodes, error) {
+	children, _, err := c.Children(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(sequenceNodes, 0, len(children))
+	for _, p := range children {
+		if !strings.Contains(p, prefix) {
+			continue
+		}
+
+		// Check if this node has timed out
+		data, stat, err := c.Get(path + "/" + p)
+		if ttl, ok := decodeTTL(data); err == nil && ok && ttl.Before(time.Now()) {
+			log.Tracef("[Sync] Deleting expired node '%s'", path+"/"+p)
+			// if it has been refreshed since we read it then it is still held
+			if err := c.Delete(path+"/"+p, stat.Version); err != gozk.ErrBadVersion {
+				deleteHolderInfo(c, path, p)
+				continue
+			}
+		}
+
+		seq, err := parseSeq(p)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, sequenceNode{name: p, seq: seq})
+	}
+	sort.Sort(nodes)
+
+	return nodes, nil
+}
+
+// waitForDeletion blocks until the node at `path` no longer exists, its expiry time passes, or our context is done. A
+// node which has expired is not deleted until someone next lists the children (see sequenceChildren), so we cannot
+// rely on a watch to tell us of it.
+func waitForDeletion(ctx context.Context, c *zk.Client, path string) error {
+	for {
+		data, _, watch, err := c.GetW(path)
+		if err == gozk.ErrNoNode {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ttl, ok := decodeTTL(data)
+		expiry, stop := expiryTimer(ttl, ok)
+		select {
+		case ev := <-watch:
+			stop()
+			if ev.Err != nil {
+				return ev.Err
+			}
+			if ev.Type == gozk.EventNodeDeleted {
+				return nil
+			}
+			// data changed (eg: a refresh) - re-establish our watch
+		case <-expiry:
+			return nil
+		case <-ctx.Done():
+			stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForChildren blocks until the children of `path` change, the earliest expiry time of those children passes, or
+// our context is done
+func waitForChildren(ctx context.Context, c *zk.Client, path string) error {
+	children, _, watch, err := c.ChildrenW(path)
+	if err != nil {
+		return err
+	}
+
+	var earliest time.Time
+	for _, p := range children {
+		data, _, _ := c.Get(path + "/" + p)
+		if ttl, ok := decodeTTL(data); ok && (earliest.IsZero() || ttl.Before(earliest)) {
+			earliest = ttl
+		}
+	}
+
+	expiry, stop := expiryTimer(earliest, !earliest.IsZero())
+	defer stop()
+	select {
+	case ev := <-watch:
+		return ev.Err
+	case <-expiry:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expiryTimer returns a channel which fires once `ttl` has passed, or which never fires if there is no ttl
+func expiryTimer(ttl time.Time, ok bool) (<-chan time.Time, func() bool) {
+	if !ok {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(ttl.Sub(time.Now()))
+	return t.C, t.Stop
+}
+
+// holderInfoPath returns where information about the holder of `node` (a child of `path`) is kept. This is apart from
+// the node itself, as older versions treat any lock node whose data is not an expiry time as expired, and cannot parse
+// children of a lock path which are not sequence nodes.
+func holderInfoPath(path, node string) string {
+	return holderInfoRoot + path + "/" + node
+}
+
+// setHolderInfo records information about the holder of `node`, which is deleted along with our session if ephemeral
+func setHolderInfo(c *zk.Client, path, node string, data []byte, ephemeral bool) error {
+	var flags int32
+	if ephemeral {
+		flags = gozk.FlagEphemeral
+	}
+	p := holderInfoPath(path, node)
+	for i := 0; i < maxCreateAttempts; i++ {
+		_, err := c.Create(p, data, flags, syncACL(c))
+		switch err {
+		case gozk.ErrNoNode:
+			if err := c.CreateParents(holderInfoRoot + path); err != nil {
+				return err
+			}
+			continue
+		case gozk.ErrNodeExists:
+			// replace it, rather than setting its data, so that it has our flags and belongs to our session
+			if err := c.Delete(p, -1); err != nil && err != gozk.ErrNoNode {
+				return err
+			}
+			continue
+		}
+		return err
+	}
+	return gozk.ErrNoNode
+}
+
+// getHolderInfo returns the information recorded about the holder of `node`, or nil if there is none
+func getHolderInfo(c *zk.Client, path, node string) []byte {
+	data, _, err := c.Get(holderInfoPath(path, node))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// deleteHolderInfo deletes the information recorded about the holder of `node`
+func deleteHolderInfo(c *zk.Client, path, node string) {
+	if err := c.Delete(holderInfoPath(path, node), -1); err != nil && err != gozk.ErrNoNode {
+		log.Debugf("[Sync] Failed to delete holder of '%s': %v", path+"/"+node, err)
+	}
+}
+
+// nodeName returns the last element of a ZooKeeper path
+func nodeName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// encodeTTL encodes an expiry time in the format used by lock nodes
+func encodeTTL(t time.Time) []byte {
+	b, _ := t.GobEncode()
+	return b
+}
+
+// decodeTTL returns the expiry time stored in a lock node, if there is one
+func decodeTTL(data []byte) (time.Time, bool) {
+	var ttl time.Time
+	if len(data) == 0 {
+		return ttl, false
+	}
+	if err := ttl.GobDecode(data); err != nil {
+		return ttl, false
+	}
+	return ttl, true
+}
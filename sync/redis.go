@@ -0,0 +1,349 @@
+package sync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+var (
+	// unlockScript deletes KEYS[1] only if it still holds our token
+	unlockScript = redis.NewScript(1, `
+local v = redis.call("GET", KEYS[1])
+if v and cjson.decode(v).token == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+	// refreshScript replaces KEYS[1] with ARGV[2], expiring after ARGV[3] ms, only if it still holds our token ARGV[1]
+	refreshScript = redis.NewScript(1, `
+local v = redis.call("GET", KEYS[1])
+if v and cjson.decode(v).token == ARGV[1] then
+	return redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+end
+return false`)
+)
+
+// redisProvider implements locks, leaders and reservations using single-instance Redis. Keys are written with
+// SET NX PX, and are only ever modified by their owner via Lua scripts which compare a random token.
+type redisProvider struct {
+	pool *redis.Pool
+}
+
+// NewRedisProvider returns a Provider backed by Redis (see redis.NewPool). Locks are namespaced per service (see
+// SetRegionLockNamespace).
+func NewRedisProvider(pool *redis.Pool) Provider {
+	return &redisProvider{
+		pool: pool,
+	}
+}
+
+// redisValue is stored against each key
+type redisValue struct {
+	Token   string     `json:"token"`
+	Holder  HolderInfo `json:"holder"`
+	Expires time.Time  `json:"expires,omitempty"`
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func redisKey(kind, id string) string {
+	return fmt.Sprintf("sync:%s:%s:%s", kind, regionLockNamespace, id)
+}
+
+func millis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// setNX stores the value against key if it does not exist, returning whether it was set
+func (p *redisProvider) setNX(key string, v *redisValue, ttl time.Duration) (bool, error) {
+	b, _ := json.Marshal(v)
+	c := p.pool.Get()
+	defer c.Close()
+
+	_, err := redis.String(c.Do("SET", key, b, "NX", "PX", millis(ttl)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// get returns the value held against key, or nil if there is none
+func (p *redisProvider) get(key string) (*redisValue, error) {
+	c := p.pool.Get()
+	defer c.Close()
+
+	b, err := redis.Bytes(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	v := &redisValue{}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// refresh extends our hold on key, returning false if we no longer hold it
+func (p *redisProvider) refresh(key string, v *redisValue, ttl time.Duration) (bool, error) {
+	b, _ := json.Marshal(v)
+	c := p.pool.Get()
+	defer c.Close()
+
+	_, err := redis.String(refreshScript.Do(c, key, v.Token, b, millis(ttl)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release deletes key if we still hold it
+func (p *redisProvider) release(key, token string) error {
+	c := p.pool.Get()
+	defer c.Close()
+
+	_, err := unlockScript.Do(c, key, token)
+	return err
+}
+
+type redisLock struct {
+	p           *redisProvider
+	key         string
+	value       *redisValue
+	holdFor     time.Duration
+	autoRefresh bool
+	lost        *lostNotifier
+	exit        chan struct{}
+	once        sync.Once
+}
+
+// Lock attempts to achieve a lock on `id`, polling until the context is done in case of contention
+func (p *redisProvider) Lock(ctx context.Context, id []byte, opts ...LockOption) (Lock, error) {
+	o := newLockOptions(defaultHoldFor, opts...)
+	key := redisKey("lock", string(id))
+	v := &redisValue{
+		Token:  newToken(),
+		Holder: o.holder,
+	}
+	v.Holder.Since = time.Now()
+
+	ttl := o.holdFor
+	if o.autoRefresh {
+		// 1.5 is because we renew the lock earlier than the timeout, so we need to cover that extra bit
+		ttl = time.Duration(float64(o.holdFor) * 1.5)
+	}
+
+	startTime := time.Now()
+	defer func() {
+		inst.Timing(1.0, "sync.redislock.acquire", time.Since(startTime))
+	}()
+
+	for {
+		ok, err := p.setNX(key, v, ttl)
+		if err != nil {
+			log.Errorf("[Sync:RedisLock] Failed to acquire '%s': %v", key, err)
+			inst.Counter(1.0, "sync.redislock.acquire.failure")
+			return nil, err
+		}
+		if ok {
+			inst.Counter(1.0, "sync.redislock.acquire.success")
+			l := &redisLock{
+				p:           p,
+				key:         key,
+				value:       v,
+				holdFor:     o.holdFor,
+				autoRefresh: o.autoRefresh,
+				lost:        newLostNotifier(),
+				exit:        make(chan struct{}),
+			}
+			go l.monitor()
+			return l, nil
+		}
+
+		select {
+		case <-time.After(addJitter(delayFor)):
+		case <-ctx.Done():
+			inst.Counter(1.0, "sync.redislock.acquire.failure")
+			if ctx.Err() != context.DeadlineExceeded {
+				return nil, ctx.Err()
+			}
+			cerr := &ContendedError{}
+			if cur, err := p.get(key); err == nil && cur != nil {
+				cerr.Holder = &cur.Holder
+			}
+			return nil, cerr
+		}
+	}
+}
+
+// Unlock releases the lock
+func (l *redisLock) Unlock() {
+	l.once.Do(func() {
+		close(l.exit)
+		if err := l.p.release(l.key, l.value.Token); err != nil {
+			log.Warnf("[Sync:RedisLock] Failed to release '%s': %v", l.key, err)
+		}
+		l.lost.lose()
+	})
+}
+
+// Lost returns a channel which is closed once we can no longer guarantee exclusivity, or the lock is released
+func (l *redisLock) Lost() <-chan struct{} {
+	return l.lost.Lost()
+}
+
+// monitor refreshes the lock (if required) or loses it once it expires, until we are unlocked
+func (l *redisLock) monitor() {
+	var expired, refresh <-chan time.Time
+	if l.autoRefresh {
+		t := time.NewTicker(time.Duration(float64(l.holdFor) * 0.75))
+		defer t.Stop()
+		refresh = t.C
+	} else {
+		t := time.NewTimer(l.holdFor)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	for {
+		select {
+		case <-l.exit:
+			return
+		case <-expired:
+			l.loseWith("held beyond %v", l.holdFor)
+			return
+		case <-refresh:
+			ok, err := l.p.refresh(l.key, l.value, time.Duration(float64(l.holdFor)*1.5))
+			if err != nil {
+				l.loseWith("failed to refresh: %v", err)
+				return
+			} else if !ok {
+				l.loseWith("was taken by another holder")
+				return
+			}
+		}
+	}
+}
+
+func (l *redisLock) loseWith(format string, args ...interface{}) {
+	log.Warnf("[Sync:RedisLock] Lock '%s' %s .. cannot guarantee exclusivity", l.key, fmt.Sprintf(format, args...))
+	inst.Counter(1.0, "sync.redislock.lost")
+	l.lost.lose()
+}
+
+// Leader blocks until we are elected leader of `id`, or the context is done
+func (p *redisProvider) Leader(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error) {
+	l, err := p.Lock(ctx, []byte("leader:"+id), append(opts, AutoRefresh())...)
+	if err != nil {
+		return nil, err
+	}
+	return newLockLeader(l), nil
+}
+
+// TryLeader attempts to become leader of `id` without waiting
+func (p *redisProvider) TryLeader(id string, opts ...LockOption) (HandoverLeader, error) {
+	l, err := tryLock(p, []byte("leader:"+id), append(opts, AutoRefresh())...)
+	if err != nil {
+		return nil, err
+	}
+	return newLockLeader(l), nil
+}
+
+type redisReservation struct {
+	sync.Mutex
+	p     *redisProvider
+	key   string
+	owner HolderInfo
+	token string
+}
+
+// Reservation returns a reservation for the item `id` under `path`
+func (p *redisProvider) Reservation(path, id string, opts ...LockOption) Reservation {
+	return &redisReservation{
+		p:     p,
+		key:   redisKey("reservation", constructPath(path, id)),
+		owner: newLockOptions(0, opts...).holder,
+	}
+}
+
+// Reserve will reserve the item for the given amount of time
+func (r *redisReservation) Reserve(d time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+
+	v := &redisValue{
+		Token:   newToken(),
+		Holder:  r.owner,
+		Expires: time.Now().Add(d),
+	}
+	ok, err := r.p.setNX(r.key, v, d)
+	if err != nil {
+		return err
+	} else if !ok {
+		inst.Counter(1.0, "sync.reservation.contended")
+		return ErrReserved
+	}
+	r.token = v.Token
+	return nil
+}
+
+// Renew extends our reservation
+func (r *redisReservation) Renew(d time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.token == "" {
+		return ErrNotReserved
+	}
+	ok, err := r.p.refresh(r.key, &redisValue{
+		Token:   r.token,
+		Holder:  r.owner,
+		Expires: time.Now().Add(d),
+	}, d)
+	if err != nil {
+		return err
+	} else if !ok {
+		r.token = ""
+		return ErrNotReserved
+	}
+	return nil
+}
+
+// Holder returns details of the current reservation, or nil if the item is not reserved
+func (r *redisReservation) Holder() (*ReservationData, error) {
+	v, err := r.p.get(r.key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return &ReservationData{
+		Expires: v.Expires,
+		Owner:   v.Holder,
+	}, nil
+}
+
+// Release will release the reservation, regardless of who holds it
+func (r *redisReservation) Release() error {
+	r.Lock()
+	r.token = ""
+	r.Unlock()
+
+	c := r.p.pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", r.key)
+	return err
+}
@@ -1,6 +1,8 @@
 package sync
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -10,6 +12,7 @@ import (
 	"github.com/cenkalti/backoff"
 
 	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
 
 	inst "github.com/HailoOSS/service/instrumentation"
 
@@ -33,31 +36,62 @@ func init() {
 	rls = make([]*regionLeader, 0)
 }
 
+var (
+	ErrNoLeader    = errors.New("No leader has been elected")
+	ErrNoCandidate = errors.New("Cannot find candidate to hand over leadership to")
+	ErrNotLeader   = errors.New("Another candidate has been elected leader")
+)
+
 type regionLeader struct {
+	client    *zookeeper.Client
 	active    bool
+	path      string
 	lockNode  string
 	rescinded chan struct{}
 	cleanup   sync.Once
 }
 
-func newRegionLeader(lockNode string) *regionLeader {
+// handoverRecord is stored as the data of the election path while a leader hands over to a nominated candidate
+type handoverRecord struct {
+	From    string `json:"from"`
+	Nominee string `json:"nominee"`
+}
+
+func newRegionLeader(client *zookeeper.Client, path, lockNode string) *regionLeader {
 	rl := &regionLeader{
+		client:    client,
 		active:    true,
+		path:      path,
 		lockNode:  lockNode,
 		rescinded: make(chan struct{}),
 	}
 	// establish a watch to cleanup
 	go func() {
-		_, _, watch, err := zookeeper.GetW(rl.lockNode)
+		sessions := rl.client.SubscribeSession()
+		defer rl.client.UnsubscribeSession(sessions)
+
+		_, _, watch, err := rl.client.GetW(rl.lockNode)
 		if err != nil {
 			rl.Rescind()
 			return
 		}
-		<-watch
-		log.Debugf("[Sync:RegionLeader] Watch triggered on '%v', will rescind leadership", rl.lockNode)
-		inst.Counter(1.0, "sync.regionleader.remotely-rescinded")
-		rl.Rescind()
-		return
+		for {
+			select {
+			case <-watch:
+				log.Debugf("[Sync:RegionLeader] Watch triggered on '%v', will rescind leadership", rl.lockNode)
+				inst.Counter(1.0, "sync.regionleader.remotely-rescinded")
+			case ev := <-sessions:
+				// a disconnection alone doesn't mean another candidate has taken over, so we wait to find out
+				if ev != zookeeper.SessionExpired {
+					continue
+				}
+				log.Warnf("[Sync:RegionLeader] Session expired, so '%v' no longer exists; will rescind leadership", rl.lockNode)
+				inst.Counter(1.0, "sync.regionleader.session-expired")
+			case <-rl.rescinded:
+			}
+			rl.Rescind()
+			return
+		}
 	}()
 
 	// Register region leader
@@ -80,7 +114,7 @@ func (rl *regionLeader) Rescind() {
 		close(rl.rescinded)
 		// keep trying to delete the ZK node (to release leadership) until we're sure it doesn't exist
 		for {
-			err := zookeeper.Delete(rl.lockNode, -1)
+			err := rl.client.Delete(rl.lockNode, -1)
 			if err == nil || err == gozk.ErrNoNode {
 				log.Debugf("[Sync:RegionLeader] Have deleted leadership node '%v'", rl.lockNode)
 				inst.Counter(1.0, "sync.regionleader.rescinded")
@@ -89,6 +123,14 @@ func (rl *regionLeader) Rescind() {
 			log.Warnf("[Sync:RegionLeader] Failed to cleanup/rescind leadership (will retry): %v", err)
 			time.Sleep(cleanupDelay)
 		}
+		deleteHolderInfo(rl.client, rl.path, nodeName(rl.lockNode))
+
+		// if leadership was handed over to us, we're done with the handover now
+		if data, stat, err := rl.client.Get(rl.path); err == nil {
+			if rec := decodeHandover(data); rec != nil && rec.Nominee == nodeName(rl.lockNode) {
+				rl.client.Set(rl.path, []byte{}, stat.Version)
+			}
+		}
 
 		// Unregister region leader
 		mu.Lock()
@@ -102,13 +144,73 @@ func (rl *regionLeader) Rescind() {
 	})
 }
 
+// Handover nominates another candidate (identified by its holder ID) to become the next leader, and then rescinds our
+// leadership. Other candidates will defer to the nominee, even if they have been waiting for longer. Candidates running
+// versions which predate handover do not, so it should not be used until all candidates have been upgraded.
+func (rl *regionLeader) Handover(candidateId string) error {
+	nodes, err := sequenceChildren(rl.client, rl.path, lockNodePrefix)
+	if err != nil {
+		return err
+	}
+
+	nominee := ""
+	for _, n := range nodes {
+		if n.name == nodeName(rl.lockNode) {
+			continue
+		}
+		if h := decodeHolder(getHolderInfo(rl.client, rl.path, n.name)); h != nil && h.Id == candidateId {
+			nominee = n.name
+			break
+		}
+	}
+	if nominee == "" {
+		return ErrNoCandidate
+	}
+
+	b, _ := json.Marshal(handoverRecord{From: nodeName(rl.lockNode), Nominee: nominee})
+	if _, err := rl.client.Set(rl.path, b, -1); err != nil {
+		return err
+	}
+
+	log.Infof("[Sync:RegionLeader] Handing over leadership of '%v' to %v", rl.path, candidateId)
+	inst.Counter(1.0, "sync.regionleader.handover")
+	rl.Rescind()
+
+	return nil
+}
+
 // RegionLeader block indefinitely until this invocation has been elected the "leader" within the local operating region.
-// It will then return a channel that will eventually be closed when leadership is rescinded.
-func RegionLeader(id string) Leader {
+// It will then return a channel that will eventually be closed when leadership is rescinded. Candidates publish
+// information about themselves (see CurrentLeader), which can be customised via the WithHolderId and WithMetadata
+// options; other options are ignored.
+func RegionLeader(id string, opts ...LockOption) Leader {
+	// this can only fail if the context is done, which it never will be
+	l, _ := electRegionLeader(context.Background(), id, true, opts...)
+	return l
+}
+
+// RegionLeaderWithin blocks until this invocation has been elected the "leader" within the local operating region, or
+// the context is done, in which case we withdraw our candidacy and return the context's error.
+func RegionLeaderWithin(ctx context.Context, id string, opts ...LockOption) (HandoverLeader, error) {
+	return electRegionLeader(ctx, id, true, opts...)
+}
+
+// TryRegionLeader attempts to become the "leader" within the local operating region without waiting. If another
+// candidate is already leading then ErrNotLeader is returned.
+func TryRegionLeader(id string, opts ...LockOption) (HandoverLeader, error) {
+	return electRegionLeader(context.Background(), id, false, opts...)
+}
+
+func electRegionLeader(ctx context.Context, id string, wait bool, opts ...LockOption) (HandoverLeader, error) {
 	path := fmt.Sprintf(regionLeaderPath, id)
-	prefix := path + "/lock-"
+	prefix := path + "/" + lockNodePrefix
 	var lockNode string
 
+	o := newLockOptions(0, opts...)
+	c := o.client
+	candidate := o.holder
+	candidate.Since = time.Now()
+
 	for {
 		// create our lock node -- retry until this is done, use exponential backoff
 		// to add some delay between attempts
@@ -117,35 +219,57 @@ func RegionLeader(id string) Leader {
 		b.MaxInterval = backoffMaxInterval
 		b.MaxElapsedTime = 0 // Never stop retrying
 
-		backoff.RetryNotify(func() (err error) {
+		for {
+			var err error
 			log.Infof("[Sync:RegionLeader] Attepting to create ephemeral lock node for leadership election")
-			lockNode, err = zookeeper.CreateProtectedEphemeralSequential(prefix, []byte{}, gozk.WorldACL(gozk.PermAll))
+			// candidate nodes carry no data, as older versions treat data which isn't an expiry time as expired
+			lockNode, err = c.CreateProtectedEphemeralSequential(prefix, []byte{}, syncACL(c))
+			if err == nil {
+				break
+			}
 
-			return
-		}, b, func(err error, d time.Duration) {
+			d := b.NextBackOff()
 			if err == gozk.ErrNoNode {
-				createParents(path)
-			} else if err != nil {
+				c.CreateParents(path)
+			} else {
 				log.Warnf("[Sync:RegionLeader] ZooKeeper error creating ephemeral lock node for leadership election: %s. Waiting %s", err, d)
 			}
-		})
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
 
-		err := waitForWinner(path, lockNode)
-		if err != nil {
-			// try to cleanup - then go again
-			zookeeper.Delete(lockNode, -1)
-			time.Sleep(time.Second)
-			continue
+		// publish information about ourselves to CurrentLeader and Handover
+		if err := setHolderInfo(c, path, nodeName(lockNode), encodeHolder(candidate), true); err != nil {
+			log.Warnf("[Sync:RegionLeader] Failed to record candidate for '%v': %v", id, err)
 		}
 
-		// we are the leader
-		break
+		err := waitForWinner(ctx, c, path, lockNode, wait)
+		if err == nil {
+			// we are the leader
+			break
+		}
+
+		// try to cleanup - then go again (unless we've been told to stop)
+		c.Delete(lockNode, -1)
+		deleteHolderInfo(c, path, nodeName(lockNode))
+		if err == ErrNotLeader || err == ctx.Err() {
+			inst.Counter(1.0, "sync.regionleader.not-elected")
+			return nil, err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
 	log.Infof("[Sync:RegionLeader] Elected leader of '%v'", id)
 	inst.Counter(1.0, "sync.regionleader.elected")
 
-	return newRegionLeader(lockNode)
+	return newRegionLeader(c, path, lockNode), nil
 }
 
 // CleanupRegionLeaders is a cleanup callback function which is run when the
@@ -164,25 +288,46 @@ func CleanupRegionLeaders() {
 	}
 }
 
-func waitForWinner(path, ourNode string) error {
-	seq, err := parseSeq(ourNode)
-	if err != nil {
-		return err
-	}
+// waitForWinner blocks until our node is elected leader, or the context is done. Usually this is the lowest node,
+// however while a handover is in progress the nominated candidate takes precedence. If we are not to wait then
+// ErrNotLeader is returned immediately if someone else leads.
+func waitForWinner(ctx context.Context, c *zookeeper.Client, path, ourNode string, wait bool) error {
+	me := nodeName(ourNode)
 
 	for {
-		lowestSeq, prevSeqPath, err := findLowestSequenceNode(path, seq)
+		data, _, handoverWatch, err := c.GetW(path)
 		if err != nil {
 			return err
 		}
+		rec := decodeHandover(data)
 
-		if seq == lowestSeq {
+		nodes, err := sequenceChildren(c, path, lockNodePrefix)
+		if err != nil {
+			return err
+		}
+		if nodes.indexOf(me) < 0 {
+			return ErrNodeVanished
+		}
+
+		leader := electedNode(nodes, rec)
+		if leader == me {
 			// we are now the leader!
 			break
 		}
+		if !wait {
+			return ErrNotLeader
+		}
 
-		// wait on the node next in line for the lock
-		_, _, ch, err := zookeeper.GetW(path + "/" + prevSeqPath)
+		// wait on the node next in line for leadership, unless there's a handover in progress in which case wait
+		// on whoever is leading
+		waitOn := leader
+		if rec == nil || nodes.indexOf(rec.Nominee) < 0 {
+			_, waitOn = holdsExclusive(nodes, nodes.indexOf(me))
+		} else if rec.Nominee == me {
+			waitOn = rec.From
+		}
+
+		_, _, ch, err := c.GetW(path + "/" + waitOn)
 		if err != nil && err != gozk.ErrNoNode {
 			return err
 		} else if err != nil && err == gozk.ErrNoNode {
@@ -190,7 +335,13 @@ func waitForWinner(path, ourNode string) error {
 			continue
 		}
 
-		ev := <-ch
+		var ev gozk.Event
+		select {
+		case ev = <-ch:
+		case ev = <-handoverWatch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if ev.Err != nil {
 			return ev.Err
 		}
@@ -199,64 +350,148 @@ func waitForWinner(path, ourNode string) error {
 	return nil
 }
 
-func createParents(path string) error {
-	parts := strings.Split(path, "/")
-	pth := ""
-	for _, p := range parts[1:] {
-		pth += "/" + p
-		_, err := zookeeper.Create(pth, []byte{}, 0, gozk.WorldACL(gozk.PermAll))
-		if err != nil && err != gozk.ErrNodeExists {
-			return err
+// electedNode returns the name of the candidate which should lead
+func electedNode(nodes sequenceNodes, rec *handoverRecord) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+	if rec != nil && nodes.indexOf(rec.Nominee) >= 0 {
+		// the nominee takes over once the previous leader has gone
+		if nodes.indexOf(rec.From) >= 0 {
+			return rec.From
 		}
+		return rec.Nominee
 	}
-	return nil
+	return nodes[0].name
 }
 
-func parseSeq(path string) (int, error) {
-	parts := strings.Split(path, "-")
-	return strconv.Atoi(parts[len(parts)-1])
+func decodeHandover(data []byte) *handoverRecord {
+	if len(data) == 0 {
+		return nil
+	}
+	rec := &handoverRecord{}
+	if err := json.Unmarshal(data, rec); err != nil || rec.Nominee == "" {
+		return nil
+	}
+	return rec
 }
 
-// findLowestSequenceNode within a particular lock path
-func findLowestSequenceNode(path string, seq int) (lowestSeq int, prevSeqPath string, err error) {
-	// Read all the children of the node
-	// This is why we create sequential nodes under a parent node based on the lock ID
-	// If not, say we stored all ephemeral locks under a higher level parent,
-	// we would be checking nodes of every lock currently in play, rather than locks
-	// on this ID
-	children, _, err := zookeeper.Children(path)
+// CurrentLeader returns information about the current leader of `id` within the local operating region. Fields will
+// be blank if the leader is not publishing information about itself. WithZookeeper may be used to look elsewhere.
+func CurrentLeader(id string, opts ...LockOption) (*HolderInfo, error) {
+	c := newLockOptions(0, opts...).client
+	leader, err := currentLeader(c, fmt.Sprintf(regionLeaderPath, id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return leader.holder, nil
+}
+
+type leaderState struct {
+	node   string
+	holder *HolderInfo
+}
+
+// currentLeader determines the leader of the election at `path`, optionally setting watches on the election data and
+// candidates
+func currentLeader(c *zookeeper.Client, path string, dataWatch, childWatch *<-chan gozk.Event) (*leaderState, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if dataWatch != nil {
+		data, _, *dataWatch, err = c.GetW(path)
+	} else {
+		data, _, err = c.Get(path)
+	}
+	if err == gozk.ErrNoNode {
+		return nil, ErrNoLeader
+	} else if err != nil {
+		return nil, err
+	}
+	if childWatch != nil {
+		if _, _, *childWatch, err = c.ChildrenW(path); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes, err := sequenceChildren(c, path, lockNodePrefix)
 	if err != nil {
-		return -1, "", err
+		return nil, err
 	}
+	leader := electedNode(nodes, decodeHandover(data))
+	if leader == "" {
+		return nil, ErrNoLeader
+	}
+
+	h := decodeHolder(getHolderInfo(c, path, leader))
+	if h == nil {
+		h = &HolderInfo{}
+	}
+	return &leaderState{node: leader, holder: h}, nil
+}
+
+// WatchLeader returns a channel which receives information about the leader of `id` within the local operating region
+// whenever it changes, starting with the current leader. Nil is sent when there is no leader. The channel is closed
+// once the context is done. WithZookeeper may be used to watch elsewhere.
+func WatchLeader(ctx context.Context, id string, opts ...LockOption) <-chan *HolderInfo {
+	c := newLockOptions(0, opts...).client
+	path := fmt.Sprintf(regionLeaderPath, id)
+	ch := make(chan *HolderInfo)
 
-	var ttl time.Time
-	lowestSeq = seq
-	prevSeq := 0
-	prevSeqPath = ""
-	for _, p := range children {
-		// Check if this lock has timed out
-		data, _, _ := zookeeper.Get(path + "/" + p)
-		if len(data) > 0 {
-			ttl.GobDecode(data)
-			if ttl.Before(time.Now()) {
-				log.Tracef("[RegionLock] Deleting expired lock '%s'", path+"/"+p)
-				zookeeper.Delete(path+"/"+p, -1)
+	go func() {
+		defer close(ch)
+		last := "-"
+		for {
+			var dataWatch, childWatch <-chan gozk.Event
+			leader, err := currentLeader(c, path, &dataWatch, &childWatch)
+			if err != nil && err != ErrNoLeader {
+				log.Warnf("[Sync:RegionLeader] Failed to watch leader of '%v' (will retry): %v", id, err)
+				select {
+				case <-time.After(backoffInitialInterval):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			current := ""
+			var holder *HolderInfo
+			if leader != nil {
+				current, holder = leader.node, leader.holder
+			}
+			if current != last {
+				select {
+				case ch <- holder:
+					last = current
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// without an election path there is nothing to watch, so poll
+			if dataWatch == nil {
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+					return
+				}
 				continue
 			}
-		}
 
-		s, err := parseSeq(p)
-		if err != nil {
-			return -1, "", err
-		}
-		if s < lowestSeq {
-			lowestSeq = s
-		}
-		if s < seq && s > prevSeq {
-			prevSeq = s
-			prevSeqPath = p
+			select {
+			case <-dataWatch:
+			case <-childWatch:
+			case <-ctx.Done():
+				return
+			}
 		}
-	}
+	}()
+
+	return ch
+}
 
-	return lowestSeq, prevSeqPath, err
+func parseSeq(path string) (int, error) {
+	parts := strings.Split(path, "-")
+	return strconv.Atoi(parts[len(parts)-1])
 }
@@ -0,0 +1,186 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+func TestElectedNode(t *testing.T) {
+	nodes := sequenceNodes{
+		{name: "_c_a-lock-0000000001", seq: 1},
+		{name: "_c_b-lock-0000000002", seq: 2},
+		{name: "_c_c-lock-0000000003", seq: 3},
+	}
+
+	testCases := []struct {
+		desc     string
+		nodes    sequenceNodes
+		rec      *handoverRecord
+		expected string
+	}{
+		{"no candidates", sequenceNodes{}, nil, ""},
+		{"lowest wins", nodes, nil, "_c_a-lock-0000000001"},
+		{"handover in progress", nodes, &handoverRecord{From: "_c_a-lock-0000000001", Nominee: "_c_c-lock-0000000003"}, "_c_a-lock-0000000001"},
+		{"handover complete", nodes[1:], &handoverRecord{From: "_c_a-lock-0000000001", Nominee: "_c_c-lock-0000000003"}, "_c_c-lock-0000000003"},
+		{"nominee gone", nodes[:2], &handoverRecord{From: "_c_x-lock-0000000000", Nominee: "_c_c-lock-0000000003"}, "_c_a-lock-0000000001"},
+	}
+
+	for _, tc := range testCases {
+		if got := electedNode(tc.nodes, tc.rec); got != tc.expected {
+			t.Errorf("%s: Want %q, Got %q", tc.desc, tc.expected, got)
+		}
+	}
+}
+
+func TestDecodeHandover(t *testing.T) {
+	if decodeHandover([]byte{}) != nil {
+		t.Error("Expected empty data not to decode")
+	}
+	if decodeHandover([]byte(`{"hostname":"foo"}`)) != nil {
+		t.Error("Expected holder record not to decode as a handover")
+	}
+	rec := decodeHandover([]byte(`{"from":"a","nominee":"b"}`))
+	if rec == nil || rec.From != "a" || rec.Nominee != "b" {
+		t.Errorf("Unexpected handover record %v", rec)
+	}
+}
+
+func TestRegionLeaderElection(t *testing.T) {
+	setupFakeZookeeper()
+
+	l1, err := TryRegionLeader("foo", WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+	if _, err := TryRegionLeader("foo"); err != ErrNotLeader {
+		t.Fatalf("Want %v, Got %v", ErrNotLeader, err)
+	}
+	if h, err := CurrentLeader("foo"); err != nil || h.Id != "first" {
+		t.Errorf("Expected 'first' to be leader, got %v (%v)", h, err)
+	}
+
+	l1.Rescind()
+	l2, err := TryRegionLeader("foo")
+	if err != nil {
+		t.Fatalf("Expected to be elected once leadership rescinded, got %v", err)
+	}
+	l2.Rescind()
+}
+
+func TestRegionLeaderSessionExpiry(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	l, err := TryRegionLeader("bar")
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+
+	fake.ExpireSession()
+	select {
+	case <-l.Rescinded():
+	case <-time.After(time.Second):
+		t.Fatal("Expected leadership to be rescinded when session expired")
+	}
+}
+
+func TestRegionLeaderWithZookeeper(t *testing.T) {
+	setupFakeZookeeper()
+	other := zk.NewClient("other", "hailo", "service", "zookeeper", "clusters", "other")
+	other.Connector = zk.NewFakeZookeeperClient().Connector
+	defer other.TearDown()
+
+	l1, err := TryRegionLeader("baz")
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+	defer l1.Rescind()
+
+	// a separate ensemble holds a separate election
+	l2, err := TryRegionLeader("baz", WithZookeeper(other), WithHolderId("other"))
+	if err != nil {
+		t.Fatalf("Expected to be elected on another ensemble, got %v", err)
+	}
+	defer l2.Rescind()
+
+	if h, err := CurrentLeader("baz", WithZookeeper(other)); err != nil || h.Id != "other" {
+		t.Errorf("Expected 'other' to be leader, got %v (%v)", h, err)
+	}
+}
+
+func TestRegionLeaderNodesCompatible(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	l, err := TryRegionLeader("compat", WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+
+	// older versions delete candidate nodes holding anything other than an expiry time, so ours hold nothing
+	children, _, err := fake.Children("/sync/regionleader/compat")
+	if err != nil || len(children) != 1 {
+		t.Fatalf("Expected one candidate node, got %v (%v)", children, err)
+	}
+	if data, _, _ := fake.Get("/sync/regionleader/compat/" + children[0]); len(data) != 0 {
+		t.Errorf("Expected candidate node to be empty, got %q", data)
+	}
+	if h, err := CurrentLeader("compat"); err != nil || h.Id != "first" {
+		t.Errorf("Expected 'first' to be leader, got %v (%v)", h, err)
+	}
+
+	l.Rescind()
+	if exists, _, _ := fake.Exists(holderInfoPath("/sync/regionleader/compat", children[0])); exists {
+		t.Error("Expected candidate information to be deleted once rescinded")
+	}
+}
+
+func TestRegionLeaderHandover(t *testing.T) {
+	setupFakeZookeeper()
+
+	l1, err := TryRegionLeader("handover", WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Expected to be elected, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	elected := make(chan Leader, 2)
+	for _, id := range []string{"second", "third"} {
+		go func(id string) {
+			l, err := RegionLeaderWithin(ctx, "handover", WithHolderId(id))
+			if err == nil {
+				elected <- l
+			}
+		}(id)
+	}
+	// wait for both candidates to stand
+	for i := 0; i < 100; i++ {
+		if err := l1.Handover("third"); err != ErrNoCandidate {
+			if err != nil {
+				t.Fatalf("Failed to hand over: %v", err)
+			}
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case l := <-elected:
+		defer l.Rescind()
+		if h, err := CurrentLeader("handover"); err != nil || h.Id != "third" {
+			t.Errorf("Expected 'third' to lead after handover, got %v (%v)", h, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected nominee to be elected")
+	}
+
+	// the other candidate keeps waiting behind the nominee
+	select {
+	case l := <-elected:
+		t.Errorf("Expected only the nominee to lead, but %v was also elected", l)
+	default:
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
 
 	inst "github.com/HailoOSS/service/instrumentation"
 	zk "github.com/HailoOSS/service/zookeeper"
@@ -22,12 +23,14 @@ var (
 
 	// @todo cruft - move this into the lock registry, or something with a mutex
 	regionLockNamespace = ""
+	// regionZookeeper is the ensemble used for coordination within the region, unless overridden via WithZookeeper
+	regionZookeeper = zk.DefaultClient
 )
 
 var (
 	ErrRegionHoldFor error = errors.New(fmt.Sprintf("Error locking - holdFor duration must be %v or greater", minRegionHoldFor))
-	defaultReaper    *reaper
-	once             sy.Once
+	reapers                = make(map[*zk.Client]*reaper)
+	reapersMtx       sy.Mutex
 )
 
 const (
@@ -35,21 +38,41 @@ const (
 )
 
 type regionLock struct {
-	zkLock gozk.Locker
+	client      *zk.Client
+	path        string
+	node        string
+	holdFor     time.Duration
+	autoRefresh bool
+	lost        *lostNotifier
+	exit        chan struct{}
+	once        sy.Once
 }
 
 // reaper periodically sweeps ZK and deletes nodes. Based on Netflix Curator Reaper
 type reaper struct {
-	paths    map[string]int // the paths to reap to count of how many times in a row they've been seen with no children
+	client   *zk.Client
+	paths    map[string]int      // the paths to reap to count of how many times in a row they've been seen with no children
+	expiring map[string]struct{} // paths whose children are persistent, but expire (see sequenceChildren)
 	pathsMtx sy.RWMutex
 }
 
-func startReaper() {
-	log.Infof("[Sync:RegionLock] Initialising RegionLock reaper")
-	defaultReaper = &reaper{
-		paths: make(map[string]int),
+// reaperFor returns the reaper for paths on the given ensemble, starting it if required
+func reaperFor(c *zk.Client) *reaper {
+	reapersMtx.Lock()
+	defer reapersMtx.Unlock()
+
+	r, ok := reapers[c]
+	if !ok {
+		log.Infof("[Sync:RegionLock] Initialising RegionLock reaper for ZooKeeper (%s)", c.Name)
+		r = &reaper{
+			client:   c,
+			paths:    make(map[string]int),
+			expiring: make(map[string]struct{}),
+		}
+		reapers[c] = r
+		go r.reapLoop()
 	}
-	go defaultReaper.reapLoop()
+	return r
 }
 
 // Utility methods
@@ -81,6 +104,18 @@ func SetRegionLockNamespace(ns string) {
 	regionLockNamespace = ns
 }
 
+// SetRegionZookeeper sets the ZooKeeper ensemble used for coordination within the region (by default that of the
+// zookeeper package's DefaultClient). It should be called on startup, before any coordination takes place.
+func SetRegionZookeeper(c *zk.Client) {
+	regionZookeeper = c
+}
+
+// syncACL returns the ACL applied to lock, leader and reservation nodes: creator-only if we authenticate with ZooKeeper,
+// unless overridden in config for our namespace (see zookeeper.Client.NamespaceACL)
+func syncACL(c *zk.Client) []gozk.ACL {
+	return c.NamespaceACL(regionLockNamespace)
+}
+
 // RegionLock attempts to achieve a lock using default timing values
 func RegionLock(id []byte) (Lock, error) {
 	return RegionTimedLock(id, defaultRegionWaitFor, defaultRegionHoldFor)
@@ -90,10 +125,25 @@ func RegionLock(id []byte) (Lock, error) {
 // case of contention (before giving up) and reserving the lock for a maximum `holdFor`
 // in the event of failing to Unlock()
 func RegionTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
-	// Ensure we are reaping
-	once.Do(startReaper)
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+
+	lock, err := RegionLockContext(ctx, id, HoldFor(holdFor))
+	if err != nil && err != ErrRegionHoldFor {
+		// we have always returned a lock which is safe to Unlock, even on failure
+		failed := &regionLock{lost: newLostNotifier()}
+		failed.lost.lose()
+		return failed, err
+	}
+	return lock, err
+}
 
-	if int64(holdFor) < int64(minRegionHoldFor) {
+// RegionLockContext attempts to achieve a regional lock on `id`, waiting until the context is done in case of
+// contention. If the context deadline is exceeded a *ContendedError is returned which identifies the current holder.
+// The lock is held for a maximum of 2 seconds in the event of failing to Unlock(), unless overridden via options.
+func RegionLockContext(ctx context.Context, id []byte, opts ...LockOption) (Lock, error) {
+	o := newLockOptions(defaultRegionHoldFor, opts...)
+	if int64(o.holdFor) < int64(minRegionHoldFor) {
 		return nil, ErrRegionHoldFor
 	}
 
@@ -104,42 +154,195 @@ func RegionTimedLock(id []byte, waitFor, holdFor time.Duration) (Lock, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Tracef("[Sync:RegionTimedLock] Attempting to acquire '%s'; held for %v", path, holdFor)
+	log.Tracef("[Sync:RegionLock] Attempting to acquire '%s'; held for %v", path, o.holdFor)
 
-	// Create new lock which we will be lock()ed
-	lock := &regionLock{
-		zkLock: zk.NewLock(path, gozk.WorldACL(gozk.PermAll)),
-	}
-	lock.zkLock.SetTTL(holdFor)
-	lock.zkLock.SetTimeout(waitFor)
 	// Acquire a lock
 	startTime := time.Now()
-	err = lock.zkLock.Lock()
+	lock, err := acquireRegionLock(ctx, path, o)
 	inst.Timing(1.0, "sync.regionlock.acquire", time.Since(startTime))
-	defaultReaper.addPath(path) // only add path to reaper AFTER we've acquired the lock (or not)
+	reaperFor(o.client).addPath(path) // only add path to reaper AFTER we've acquired the lock (or not)
 
-	if err == nil {
-		log.Tracef("[Sync:RegionTimedLock] Successfully acquired '%s'", path)
-		inst.Counter(1.0, "sync.regionlock.acquire.success")
-	} else {
-		log.Errorf("[Sync:RegionTimedLock] Failed to acquire '%s': %s", path, err.Error())
+	if err != nil {
+		log.Errorf("[Sync:RegionLock] Failed to acquire '%s': %s", path, err.Error())
 		inst.Counter(1.0, "sync.regionlock.acquire.failure")
+		return nil, err
 	}
 
-	return lock, err
+	log.Tracef("[Sync:RegionLock] Successfully acquired '%s'", path)
+	inst.Counter(1.0, "sync.regionlock.acquire.success")
+	go lock.monitor()
+
+	return lock, nil
+}
+
+// acquireRegionLock creates our lock node under `path` and then waits until it is the lowest in the sequence
+func acquireRegionLock(ctx context.Context, path string, o *lockOptions) (*regionLock, error) {
+	return acquireSequenceLock(ctx, path, lockNodePrefix, o, holdsExclusive)
+}
+
+// acquireSequenceLock creates our node under `path` and then waits until `holds` decides that it holds the lock
+func acquireSequenceLock(ctx context.Context, path, prefix string, o *lockOptions, holds holdsFunc) (*regionLock, error) {
+	node, err := createSequenceNode(o.client, path, prefix, encodeTTL(time.Now().Add(o.holdFor)))
+	if err != nil {
+		return nil, err
+	}
+	rl := &regionLock{
+		client:      o.client,
+		path:        path,
+		node:        node,
+		holdFor:     o.holdFor,
+		autoRefresh: o.autoRefresh,
+		lost:        newLostNotifier(),
+		exit:        make(chan struct{}),
+	}
+
+	for {
+		children, err := sequenceChildren(o.client, path, "")
+		if err != nil {
+			rl.release()
+			return nil, err
+		}
+
+		i := children.indexOf(nodeName(node))
+		if i < 0 {
+			// most likely expired by another contender
+			return nil, ErrNodeVanished
+		}
+		ok, waitOn := holds(children, i)
+		if ok {
+			break
+		}
+
+		// wait for something to change before checking again
+		if waitOn != "" {
+			err = waitForDeletion(ctx, o.client, path+"/"+waitOn)
+		} else {
+			err = waitForChildren(ctx, o.client, path)
+		}
+		if err == context.DeadlineExceeded {
+			rl.release()
+			return nil, &ContendedError{Holder: regionLockHolder(o.client, path)}
+		} else if err != nil {
+			rl.release()
+			return nil, err
+		}
+	}
+
+	// let other contenders know who we are
+	holder := o.holder
+	holder.Since = time.Now()
+	if err := setHolderInfo(o.client, path, nodeName(node), encodeHolder(holder), true); err != nil {
+		log.Warnf("[Sync:RegionLock] Failed to record holder of '%s': %v", path, err)
+	}
+	reaperFor(o.client).addPath(holderInfoRoot + path)
+
+	return rl, nil
+}
+
+// regionLockHolder returns information about the longest standing holder of the lock at `path`, if known
+func regionLockHolder(c *zk.Client, path string) *HolderInfo {
+	nodes, err := sequenceChildren(c, path, "")
+	if err != nil {
+		return nil
+	}
+	for _, n := range nodes {
+		if h := decodeHolder(getHolderInfo(c, path, n.name)); h != nil {
+			return h
+		}
+	}
+	return nil
 }
 
 // Unlock releases this regional lock
 func (rl *regionLock) Unlock() {
-	if rl == nil || rl.zkLock == nil {
+	if rl == nil || rl.node == "" {
 		return
 	}
 
+	rl.once.Do(func() {
+		close(rl.exit)
+	})
+	rl.lost.lose()
+	rl.release()
+}
+
+// release deletes our lock node
+func (rl *regionLock) release() {
 	// This should check for a ZK connection, and also report errors to the caller. But as Matt Heath designed this to
 	// match the interface of global locks, which cannot return an error, we don't return any error here.
-	if err := rl.zkLock.Unlock(); err != nil {
+	if err := rl.client.Delete(rl.node, -1); err != nil && err != gozk.ErrNoNode {
 		log.Errorf("[Sync:RegionLock] Failed to release ZooKeeper lock with: %s", err.Error())
 	}
+	deleteHolderInfo(rl.client, rl.path, nodeName(rl.node))
+}
+
+// Lost returns a channel that is closed if our lock node is deleted, we lose our ZooKeeper session, or once our
+// `holdFor` has elapsed without a refresh (at which point other contenders will consider our lock node expired). It
+// is also closed once the lock has been released.
+func (rl *regionLock) Lost() <-chan struct{} {
+	return rl.lost.Lost()
+}
+
+// monitor watches for conditions under which we can no longer guarantee exclusivity, until we are unlocked
+func (rl *regionLock) monitor() {
+	var expired, refresh <-chan time.Time
+	if rl.autoRefresh {
+		t := time.NewTicker(time.Duration(float64(rl.holdFor) * 0.75))
+		defer t.Stop()
+		refresh = t.C
+	} else {
+		t := time.NewTimer(rl.holdFor)
+		defer t.Stop()
+		expired = t.C
+	}
+	sessions := rl.client.SubscribeSession()
+	defer rl.client.UnsubscribeSession(sessions)
+	if st := rl.client.State(); st != gozk.StateHasSession {
+		rl.loseWith("ZooKeeper session state is %v", st)
+		return
+	}
+
+	_, _, watch, err := rl.client.GetW(rl.node)
+	for {
+		if err != nil {
+			rl.loseWith("failed to watch lock node: %v", err)
+			return
+		}
+
+		select {
+		case <-rl.exit:
+			return
+		case ev := <-watch:
+			if ev.Err != nil || ev.Type == gozk.EventNodeDeleted {
+				rl.loseWith("lock node event %v", ev.Type)
+				return
+			}
+			// data changed (eg: our own refresh) - re-establish our watch
+			_, _, watch, err = rl.client.GetW(rl.node)
+		case <-expired:
+			rl.loseWith("held beyond %v", rl.holdFor)
+			return
+		case <-refresh:
+			// 1.5 is because we renew the lock earlier than the timeout, so we need to cover that extra bit
+			expires := time.Now().Add(time.Duration(float64(rl.holdFor) * 1.5))
+			if _, err := rl.client.Set(rl.node, encodeTTL(expires), -1); err != nil {
+				rl.loseWith("failed to refresh: %v", err)
+				return
+			}
+		case ev := <-sessions:
+			// whilst disconnected our session (and therefore our node) may expire without us knowing
+			if ev == zk.SessionDisconnected || ev == zk.SessionExpired {
+				rl.loseWith("ZooKeeper session %v", ev)
+				return
+			}
+		}
+	}
+}
+
+func (rl *regionLock) loseWith(format string, args ...interface{}) {
+	log.Warnf("[Sync:RegionLock] Lock '%s' %s .. cannot guarantee exclusivity", rl.path, fmt.Sprintf(format, args...))
+	inst.Counter(1.0, "sync.regionlock.lost")
+	rl.lost.lose()
 }
 
 func (r *reaper) reap() {
@@ -153,7 +356,11 @@ func (r *reaper) reap() {
 	}
 	r.pathsMtx.RUnlock()
 	for _, path := range keys {
-		exists, stat, err := zk.Exists(path)
+		if r.isExpiring(path) {
+			// listing the children deletes any which have expired
+			sequenceChildren(r.client, path, "")
+		}
+		exists, stat, err := r.client.Exists(path)
 		if !exists {
 			if err != nil && err != gozk.ErrNoNode {
 				log.Errorf("[Sync:RegionLock] Error checking path %s %v", path, err)
@@ -173,7 +380,7 @@ func (r *reaper) reap() {
 		n := r.incrementPath(path)
 		if n >= reaperThreshold {
 			// reaped enough times and it's come out as empty. Delete it
-			if err := zk.Delete(path, -1); err == nil || err == gozk.ErrNoNode {
+			if err := r.client.Delete(path, -1); err == nil || err == gozk.ErrNoNode {
 				// success
 				r.removePath(path)
 			} else {
@@ -219,6 +426,21 @@ func (r *reaper) addPath(path string) {
 	r.resetPath(path)
 }
 
+// addExpiringPath adds this path, whose children will be deleted once they expire
+func (r *reaper) addExpiringPath(path string) {
+	r.pathsMtx.Lock()
+	r.paths[path] = 0
+	r.expiring[path] = struct{}{}
+	r.pathsMtx.Unlock()
+}
+
+func (r *reaper) isExpiring(path string) bool {
+	r.pathsMtx.RLock()
+	defer r.pathsMtx.RUnlock()
+	_, ok := r.expiring[path]
+	return ok
+}
+
 // resetPath resets the reap count for this to 0
 func (r *reaper) resetPath(path string) {
 	r.pathsMtx.Lock()
@@ -232,6 +454,7 @@ func (r *reaper) removePath(path string) {
 	// last check in case we've added the path back while we were reaping it
 	if cnt, ok := r.paths[path]; ok && cnt >= reaperThreshold {
 		delete(r.paths, path)
+		delete(r.expiring, path)
 	}
 	r.pathsMtx.Unlock()
 }
@@ -1,9 +1,44 @@
 package sync
 
 import (
+	"bytes"
+	sy "sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	"github.com/HailoOSS/service/config"
+	zk "github.com/HailoOSS/service/zookeeper"
 )
 
+var (
+	fakeZookeeper     *zk.FakeZookeeperClient
+	fakeZookeeperOnce sy.Once
+)
+
+// setupFakeZookeeper connects the zookeeper package to an in-memory fake, so recipes can be tested against realistic
+// ZooKeeper behaviour. The fake is shared by all tests (recipes leave goroutines behind which may still be using it),
+// so each test should use its own lock IDs.
+func setupFakeZookeeper() *zk.FakeZookeeperClient {
+	fakeZookeeperOnce.Do(func() {
+		config.Load(bytes.NewBufferString(`{"hailo": {"service": {"zookeeper": {"hosts": ["localhost:2181"]}}}}`))
+		fakeZookeeper = zk.NewFakeZookeeperClient()
+		zk.Connector = fakeZookeeper.Connector
+		SetRegionLockNamespace("test")
+	})
+	return fakeZookeeper
+}
+
+// newFakeSession returns a client with a session of its own on the fake ZooKeeper, eg: to act as another process
+func newFakeSession(name string) (*zk.Client, *zk.FakeZookeeperClient) {
+	fake := setupFakeZookeeper().NewSession()
+	c := zk.NewClient(name, "hailo", "service", "zookeeper")
+	c.Connector = fake.Connector
+	return c, fake
+}
+
 func TestConstructLockPath(t *testing.T) {
 	// Cases where we don't expect an error
 	validCases := []struct {
@@ -42,3 +77,213 @@ func TestConstructLockPath(t *testing.T) {
 		}
 	}
 }
+
+func TestHoldsFuncs(t *testing.T) {
+	nodes := sequenceNodes{
+		{name: "_c_a-read-0000000001", seq: 1},
+		{name: "_c_b-write-0000000002", seq: 2},
+		{name: "_c_c-read-0000000003", seq: 3},
+		{name: "_c_d-read-0000000004", seq: 4},
+	}
+
+	testCases := []struct {
+		desc   string
+		holds  holdsFunc
+		i      int
+		held   bool
+		waitOn string
+	}{
+		{"exclusive lowest", holdsExclusive, 0, true, ""},
+		{"exclusive waits on predecessor", holdsExclusive, 2, false, "_c_b-write-0000000002"},
+		{"read with no writer ahead", holdsRead, 0, true, ""},
+		{"read waits on writer", holdsRead, 3, false, "_c_b-write-0000000002"},
+		{"semaphore within limit", (&regionSemaphore{n: 2}).holds, 1, true, ""},
+		{"semaphore over limit", (&regionSemaphore{n: 2}).holds, 2, false, ""},
+	}
+
+	for _, tc := range testCases {
+		held, waitOn := tc.holds(nodes, tc.i)
+		if held != tc.held || waitOn != tc.waitOn {
+			t.Errorf("%s: Want (%v, %q), Got (%v, %q)", tc.desc, tc.held, tc.waitOn, held, waitOn)
+		}
+	}
+}
+
+func TestRegionLockContention(t *testing.T) {
+	setupFakeZookeeper()
+
+	l1, err := RegionLockContext(context.Background(), []byte("foo"), WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = RegionLockContext(ctx, []byte("foo"), WithHolderId("second"))
+	if ce, ok := err.(*ContendedError); !ok || ce.Holder == nil || ce.Holder.Id != "first" {
+		t.Fatalf("Expected lock to be contended by 'first', got %v", err)
+	}
+
+	l1.Unlock()
+	select {
+	case <-l1.Lost():
+	default:
+		t.Error("Expected released lock to be lost")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l2, err := RegionLockContext(ctx, []byte("foo"), WithHolderId("second"))
+	if err != nil {
+		t.Fatalf("Failed to acquire released lock: %v", err)
+	}
+	l2.Unlock()
+}
+
+func TestRegionLockWaitsForRelease(t *testing.T) {
+	setupFakeZookeeper()
+
+	l1, err := RegionLockContext(context.Background(), []byte("bar"))
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, l1.Unlock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l2, err := RegionLockContext(ctx, []byte("bar"))
+	if err != nil {
+		t.Fatalf("Expected to acquire lock once released, got %v", err)
+	}
+	l2.Unlock()
+}
+
+func TestRegionLockWaitsForExpiry(t *testing.T) {
+	setupFakeZookeeper()
+
+	// never unlocked, so only expires
+	if _, err := RegionLockContext(context.Background(), []byte("expiry"), HoldFor(time.Second)); err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	l2, err := RegionLockContext(ctx, []byte("expiry"))
+	if err != nil {
+		t.Fatalf("Expected to acquire lock once expired, got %v", err)
+	}
+	l2.Unlock()
+}
+
+// refreshOnGet refreshes nodes as soon as they are read, as if their holder got in just before they were deleted
+type refreshOnGet struct {
+	*zk.FakeZookeeperClient
+}
+
+func (r refreshOnGet) Get(path string) ([]byte, *gozk.Stat, error) {
+	data, stat, err := r.FakeZookeeperClient.Get(path)
+	if err == nil {
+		r.FakeZookeeperClient.Set(path, encodeTTL(time.Now().Add(time.Minute)), stat.Version)
+	}
+	return data, stat, err
+}
+
+func TestSequenceChildrenKeepsRefreshedNodes(t *testing.T) {
+	c, fake := newFakeSession("refreshing")
+	c.Connector = func(servers []string, recvTimeout time.Duration) (zk.ZookeeperClient, <-chan gozk.Event, error) {
+		_, events, err := fake.Connector(servers, recvTimeout)
+		return refreshOnGet{fake}, events, err
+	}
+	defer c.TearDown()
+
+	path := "/sync/regionlock/test/refreshed"
+	c.CreateParents(path)
+	expired := encodeTTL(time.Now().Add(-time.Second))
+	if _, err := c.Create(path+"/"+lockNodePrefix, expired, gozk.FlagSequence, gozk.WorldACL(gozk.PermAll)); err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	nodes, err := sequenceChildren(c, path, lockNodePrefix)
+	if err != nil || len(nodes) != 1 {
+		t.Errorf("Expected the refreshed node to be kept, got %v (%v)", nodes, err)
+	}
+}
+
+func TestRegionLockLostOnSessionExpiry(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	l1, err := RegionLockContext(context.Background(), []byte("baz"), HoldFor(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	defer l1.Unlock()
+
+	fake.ExpireSession()
+	select {
+	case <-l1.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("Expected lock to be lost when session expired")
+	}
+
+	// our lock node went with the session, so the lock is free
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l2, err := RegionLockContext(ctx, []byte("baz"))
+	if err != nil {
+		t.Fatalf("Expected to acquire lock after session expiry, got %v", err)
+	}
+	l2.Unlock()
+}
+
+func TestRegionRWLockHolders(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	rw, err := RegionRWLock([]byte("holders"))
+	if err != nil {
+		t.Fatalf("Failed to create lock: %v", err)
+	}
+	r1, err := RegionRWLock([]byte("holders"), WithHolderId("first"))
+	if err != nil {
+		t.Fatalf("Failed to create lock: %v", err)
+	}
+	r2, err := RegionRWLock([]byte("holders"), WithHolderId("second"))
+	if err != nil {
+		t.Fatalf("Failed to create lock: %v", err)
+	}
+	l1, err := r1.RLock(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire read lock: %v", err)
+	}
+	l2, err := r2.RLock(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire read lock: %v", err)
+	}
+	defer l2.Unlock()
+
+	// each holder is recorded separately, so the second reader doesn't hide the first
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rw.Lock(ctx)
+	if ce, ok := err.(*ContendedError); !ok || ce.Holder == nil || ce.Holder.Id != "first" {
+		t.Fatalf("Expected lock to be contended by 'first', got %v", err)
+	}
+
+	l1.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = rw.Lock(ctx)
+	if ce, ok := err.(*ContendedError); !ok || ce.Holder == nil || ce.Holder.Id != "second" {
+		t.Fatalf("Expected lock to be contended by 'second', got %v", err)
+	}
+
+	// lock nodes themselves only hold an expiry time, which older versions understand
+	path, _ := constructRecipePath("rwlock", "holders")
+	children, _, err := fake.Children(path)
+	if err != nil || len(children) != 1 {
+		t.Fatalf("Expected one lock node, got %v (%v)", children, err)
+	}
+	data, _, _ := fake.Get(path + "/" + children[0])
+	if _, ok := decodeTTL(data); !ok {
+		t.Errorf("Expected lock node to hold an expiry time, got %q", data)
+	}
+}
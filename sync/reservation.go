@@ -1,18 +1,27 @@
 package sync
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
 
+	inst "github.com/HailoOSS/service/instrumentation"
 	"github.com/HailoOSS/service/zookeeper"
 	gozk "github.com/HailoOSS/go-zookeeper/zk"
 )
 
+const (
+	reservationPrefix = "reserve-"
+)
+
 var (
-	ErrReserved = errors.New("[Reservation] Item already reserved")
+	ErrReserved    = errors.New("[Reservation] Item already reserved")
+	ErrNotReserved = errors.New("[Reservation] Item is not reserved by us")
 )
 
 // Reservation will reserve an item given an id.  The reservation must expire and may be released
@@ -20,89 +29,310 @@ var (
 type Reservation interface {
 	Reserve(time.Duration) error
 	Release() error
+	// Renew extends our reservation, returning ErrNotReserved if we no longer hold it
+	Renew(time.Duration) error
+	// Holder returns details of the current (unexpired) reservation, or nil if the item is not reserved
+	Holder() (*ReservationData, error)
 }
 
 type DefaultReservation struct {
-	Ttl  time.Duration
-	path string
-	id   string
-	acl  []gozk.ACL
+	sync.Mutex
+	Ttl       time.Duration
+	client    *zookeeper.Client
+	path      string
+	id        string
+	acl       []gozk.ACL
+	ephemeral bool
+	owner     HolderInfo
+	version   int32
+	// czxid identifies the node we created, as one which replaces it starts from the same version
+	czxid int64
 }
 
+// ReservationData describes a reservation. The reservation node holds only the (gob encoded) expiry, which is the
+// format older versions read, with the owner recorded alongside it under /sync/holders.
 type ReservationData struct {
-	Expires time.Time
+	Expires time.Time  `json:"expires"`
+	Owner   HolderInfo `json:"owner"`
 }
 
-// NewReservation creates a default reservation
-func NewReservation(path, id string, acl []gozk.ACL) Reservation {
+// NewReservation creates a default reservation. Holder related options (WithHolderId, WithMetadata) may be used to
+// describe the owner of the reservation, and WithZookeeper to make it on another ensemble.
+func NewReservation(path, id string, acl []gozk.ACL, opts ...LockOption) Reservation {
+	o := newLockOptions(0, opts...)
 	return &DefaultReservation{
-		path: path,
-		acl:  acl,
-		id:   id,
+		client:  o.client,
+		path:    path,
+		acl:     acl,
+		id:      id,
+		owner:   o.holder,
+		version: -1,
 	}
 }
 
+// NewEphemeralReservation creates a reservation which, as well as expiring, is released automatically if our
+// ZooKeeper session is lost (eg: we crash)
+func NewEphemeralReservation(path, id string, acl []gozk.ACL, opts ...LockOption) Reservation {
+	dr := NewReservation(path, id, acl, opts...).(*DefaultReservation)
+	dr.ephemeral = true
+	return dr
+}
+
 // Reserve will reserve an item with the id in the DefaultReservation for the given amount of
 // time.
 func (dr *DefaultReservation) Reserve(d time.Duration) error {
 	log.Debugf("[Sync:Reservation] Attempting to reserve '%s' for %s...", dr.id, d)
 
+	dr.Lock()
+	defer dr.Unlock()
+
 	lockpath := constructPath(dr.path, dr.id)
+	expires := time.Now().Add(d)
+	data := encodeTTL(expires)
+	var flags int32
+	if dr.ephemeral {
+		flags = gozk.FlagEphemeral
+	}
 
-	// Check if the reservation already exists
-	b, _, err := zookeeper.Get(lockpath)
-	if err == nil {
+	for attempt := 0; attempt < maxCreateAttempts; attempt++ {
+		// Check if the reservation already exists
+		b, stat, err := dr.client.Get(lockpath)
+		if err == gozk.ErrNoNode {
+			_, err = dr.client.Create(lockpath, data, flags, dr.acl)
+			if err == gozk.ErrNoNode {
+				dr.client.CreateParents(dr.path)
+				continue
+			} else if err == gozk.ErrNodeExists {
+				// someone beat us to it
+				inst.Counter(1.0, "sync.reservation.contended")
+				return ErrReserved
+			} else if err != nil {
+				log.Warnf("[Reservation] ZK error creating lock node for reservation: %v", err)
+				return err
+			}
+			dr.version = 0
+			if _, stat, err := dr.client.Exists(lockpath); err == nil && stat != nil {
+				dr.czxid = stat.Czxid
+			}
+			dr.recordOwner(expires)
+			log.Debugf("[Sync:Reservation] Created lock node for '%s', expires at %s", dr.id, expires)
+			return nil
+		} else if err != nil {
+			return err
+		}
 
 		// It exists, check if expired
-		var expired time.Time
-		expired.GobDecode(b)
-
-		log.Debugf("[Sync:Reservation] Read existing node for '%s', expires at %s", dr.id, expired)
-
-		if expired.Before(time.Now()) {
-			log.Debugf("[Sync:Reservation] Deleting expired lock '%s'", dr.id)
+		existing, _ := decodeTTL(b)
+		log.Debugf("[Sync:Reservation] Read existing node for '%s', expires at %s", dr.id, existing)
+		if existing.After(time.Now()) {
+			return ErrReserved
+		}
 
-			// It has expired, delete the node and get the reservation as usual
-			zookeeper.Delete(lockpath, -1)
-		} else {
+		// It has expired, so delete it - as long as it hasn't been renewed or replaced since we read it - and create our
+		// own in its place, so that ours has our flags and (if ephemeral) belongs to our session rather than theirs. This
+		// cannot be a single multi-op, as MultiOps applies creates before deletes; if someone else creates theirs in
+		// between, they have the reservation instead.
+		log.Debugf("[Sync:Reservation] Replacing expired lock '%s'", dr.id)
+		err = dr.client.Delete(lockpath, stat.Version)
+		if err == gozk.ErrBadVersion {
+			inst.Counter(1.0, "sync.reservation.contended")
 			return ErrReserved
+		} else if err != nil && err != gozk.ErrNoNode {
+			log.Warnf("[Reservation] ZK error deleting expired reservation: %v", err)
+			return err
 		}
 	}
 
-	expires := time.Now().Add(d)
-	expiresBytes, err := expires.GobEncode()
-	if err != nil {
-		return err
+	return fmt.Errorf("Failed to create reservation '%s' after %d attempts", lockpath, maxCreateAttempts)
+}
+
+// Renew extends our reservation so that it expires after the given amount of time
+func (dr *DefaultReservation) Renew(d time.Duration) error {
+	dr.Lock()
+	defer dr.Unlock()
+
+	if dr.version < 0 {
+		return ErrNotReserved
 	}
 
-	for {
-		_, err = zookeeper.Create(lockpath, expiresBytes, 0, dr.acl)
-		if err == gozk.ErrNoNode {
-			createParents(dr.path)
-		} else if err == nil {
-			break
-		} else {
-			log.Warnf("[Reservation] ZK error creating ephemeral lock node for reservation: %v", err)
+	lockpath := constructPath(dr.path, dr.id)
+	if dr.czxid != 0 {
+		exists, stat, err := dr.client.Exists(lockpath)
+		if err != nil {
 			return err
+		} else if !exists || stat.Czxid != dr.czxid {
+			// expired and replaced by another actor
+			dr.version = -1
+			return ErrNotReserved
 		}
 	}
 
-	log.Debugf("[Sync:Reservation] Created lock node for '%s', expires at %s", dr.id, expires)
+	expires := time.Now().Add(d)
+	stat, err := dr.client.Set(lockpath, encodeTTL(expires), dr.version)
+	if err == gozk.ErrBadVersion || err == gozk.ErrNoNode {
+		// released (or expired and taken) by another actor
+		dr.version = -1
+		return ErrNotReserved
+	} else if err != nil {
+		return err
+	}
+	dr.version = stat.Version
+	dr.recordOwner(expires)
 
 	return nil
+}
 
+// recordOwner records who holds the reservation, and until when. This is informational only (see Holder), so failure
+// to record it does not fail the reservation.
+func (dr *DefaultReservation) recordOwner(expires time.Time) {
+	data := encodeReservationData(&ReservationData{
+		Expires: expires,
+		Owner:   dr.owner,
+	})
+	if err := setHolderInfo(dr.client, dr.path, reservationPrefix+dr.id, data, dr.ephemeral); err != nil {
+		log.Warnf("[Sync:Reservation] Failed to record owner of '%s': %v", dr.id, err)
+	}
+}
+
+// Holder returns details of the current reservation, or nil if the item is not reserved (or it has expired)
+func (dr *DefaultReservation) Holder() (*ReservationData, error) {
+	b, _, err := dr.client.Get(constructPath(dr.path, dr.id))
+	if err == gozk.ErrNoNode {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rd := decodeReservationData(b, getHolderInfo(dr.client, dr.path, reservationPrefix+dr.id))
+	if rd.Expires.Before(time.Now()) {
+		return nil, nil
+	}
+	return rd, nil
 }
 
 // Release will release the reservation in the DefaultReservation
 func (dr *DefaultReservation) Release() error {
-	return zookeeper.Delete(constructPath(dr.path, dr.id), -1)
+	dr.Lock()
+	dr.version, dr.czxid = -1, 0
+	dr.Unlock()
+
+	if err := dr.client.Delete(constructPath(dr.path, dr.id), -1); err != nil {
+		return err
+	}
+	deleteHolderInfo(dr.client, dr.path, reservationPrefix+dr.id)
+	return nil
+}
+
+// AnonymousRelease will  release the reservation of the item with the given id and path (within the region, see
+// SetRegionZookeeper, unless another ensemble is given via WithZookeeper)
+func AnonymousRelease(path, id string, opts ...LockOption) error {
+	c := newLockOptions(0, opts...).client
+	if err := c.Delete(constructPath(path, id), -1); err != nil {
+		return err
+	}
+	deleteHolderInfo(c, path, reservationPrefix+id)
+	return nil
+}
+
+// SweepReservations deletes any expired reservations under the given path (within the region, see
+// SetRegionZookeeper, unless another ensemble is given via WithZookeeper), returning how many were deleted
+func SweepReservations(path string, opts ...LockOption) (int, error) {
+	client := newLockOptions(0, opts...).client
+	children, _, err := client.Children(path)
+	if err == gozk.ErrNoNode {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, c := range children {
+		if !strings.HasPrefix(c, reservationPrefix) {
+			continue
+		}
+		b, stat, err := client.Get(path + "/" + c)
+		if err != nil {
+			continue
+		}
+		if expires, _ := decodeTTL(b); expires.After(time.Now()) {
+			continue
+		}
+		// only delete it if it hasn't been renewed or replaced in the meantime
+		if err := client.Delete(path+"/"+c, stat.Version); err == nil {
+			deleteHolderInfo(client, path, c)
+			swept++
+		}
+	}
+	inst.Counter(1.0, "sync.reservation.swept", swept)
+
+	return swept, nil
 }
 
-// AnonymousRelease will  release the reservation of the item with the given id and path
-func AnonymousRelease(path, id string) error {
-	return zookeeper.Delete(constructPath(path, id), -1)
+// ReservationSweeper periodically deletes expired reservations under a path, so they do not linger until someone
+// next attempts to reserve them
+type ReservationSweeper struct {
+	path string
+	opts []LockOption
+	exit chan struct{}
+	once sync.Once
+}
+
+// StartReservationSweeper sweeps expired reservations under `path` every `interval` until stopped. WithZookeeper may
+// be used to sweep another ensemble.
+func StartReservationSweeper(path string, interval time.Duration, opts ...LockOption) *ReservationSweeper {
+	s := &ReservationSweeper{
+		path: path,
+		opts: opts,
+		exit: make(chan struct{}),
+	}
+	go s.sweepLoop(interval)
+	return s
+}
+
+// Stop the sweeper
+func (s *ReservationSweeper) Stop() {
+	s.once.Do(func() {
+		close(s.exit)
+	})
+}
+
+func (s *ReservationSweeper) sweepLoop(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.exit:
+			return
+		case <-tick.C:
+			n, err := SweepReservations(s.path, s.opts...)
+			if err != nil {
+				log.Warnf("[Sync:Reservation] Error sweeping reservations under %s: %v", s.path, err)
+				continue
+			}
+			log.Debugf("[Sync:Reservation] Swept %d expired reservations under %s", n, s.path)
+		}
+	}
 }
 
 func constructPath(path, id string) string {
-	return fmt.Sprintf("%s/reserve-%s", path, id)
+	return fmt.Sprintf("%s/%s%s", path, reservationPrefix, id)
+}
+
+func encodeReservationData(rd *ReservationData) []byte {
+	b, _ := json.Marshal(rd)
+	return b
+}
+
+// decodeReservationData reads the expiry from a reservation node, and the owner from its holder information. The
+// owner is only trusted if it was recorded for this expiry, as reservations made by older versions do not record one
+// (and so may have replaced a reservation which did). Unreadable node data is treated as having expired.
+func decodeReservationData(node, info []byte) *ReservationData {
+	rd := &ReservationData{}
+	rd.Expires, _ = decodeTTL(node)
+
+	owner := &ReservationData{}
+	if err := json.Unmarshal(info, owner); err == nil && owner.Expires.Equal(rd.Expires) {
+		rd.Owner = owner.Owner
+	}
+	return rd
 }
@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	zk "github.com/HailoOSS/service/zookeeper"
+)
+
+func TestDecodeReservationData(t *testing.T) {
+	expires := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	info := encodeReservationData(&ReservationData{
+		Expires: expires,
+		Owner:   HolderInfo{Id: "foo"},
+	})
+
+	rd := decodeReservationData(encodeTTL(expires), info)
+	if !rd.Expires.Equal(expires) || rd.Owner.Id != "foo" {
+		t.Errorf("Unexpected reservation data %v", rd)
+	}
+
+	// reservations made by older versions have no owner, and may have replaced one which did
+	rd = decodeReservationData(encodeTTL(expires.Add(time.Second)), info)
+	if !rd.Expires.Equal(expires.Add(time.Second)) || rd.Owner.Id != "" {
+		t.Errorf("Expected reservation without an owner, got %v", rd)
+	}
+	rd = decodeReservationData(encodeTTL(expires), nil)
+	if !rd.Expires.Equal(expires) || rd.Owner.Id != "" {
+		t.Errorf("Expected reservation without an owner, got %v", rd)
+	}
+
+	// garbage is treated as expired
+	rd = decodeReservationData([]byte("foo"), info)
+	if rd.Expires.After(time.Now()) {
+		t.Errorf("Expected unreadable reservation to have expired, expires %v", rd.Expires)
+	}
+}
+
+func TestReservationNodesCompatible(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	r := NewReservation("/test/reservations", "compat", gozk.WorldACL(gozk.PermAll), WithHolderId("first"))
+	if err := r.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	defer r.Release()
+
+	// older versions read the node as a gob encoded expiry, and delete it if that has passed
+	b, _, err := fake.Get("/test/reservations/reserve-compat")
+	if err != nil {
+		t.Fatalf("Failed to read reservation node: %v", err)
+	}
+	var expires time.Time
+	if err := expires.GobDecode(b); err != nil || !expires.After(time.Now()) {
+		t.Errorf("Expected reservation node to hold its expiry, got %v (%v)", expires, err)
+	}
+}
+
+func TestReservation(t *testing.T) {
+	setupFakeZookeeper()
+
+	r1 := NewReservation("/test/reservations", "foo", gozk.WorldACL(gozk.PermAll), WithHolderId("first"))
+	r2 := NewReservation("/test/reservations", "foo", gozk.WorldACL(gozk.PermAll), WithHolderId("second"))
+
+	if err := r1.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	if err := r2.Reserve(time.Minute); err != ErrReserved {
+		t.Fatalf("Want %v, Got %v", ErrReserved, err)
+	}
+	if h, err := r2.Holder(); err != nil || h == nil || h.Owner.Id != "first" {
+		t.Fatalf("Expected reservation to be held by 'first', got %v (%v)", h, err)
+	}
+
+	// once it expires, it may be replaced
+	if err := r1.Renew(time.Millisecond); err != nil {
+		t.Fatalf("Failed to renew: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := r2.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to replace expired reservation: %v", err)
+	}
+	if err := r1.Renew(time.Minute); err != ErrNotReserved {
+		t.Errorf("Want %v, Got %v", ErrNotReserved, err)
+	}
+
+	if err := r2.Release(); err != nil {
+		t.Fatalf("Failed to release: %v", err)
+	}
+	if h, err := r1.Holder(); err != nil || h != nil {
+		t.Errorf("Expected no holder after release, got %v (%v)", h, err)
+	}
+}
+
+func TestEphemeralReservationSessionExpiry(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	r1 := NewEphemeralReservation("/test/reservations", "bar", gozk.WorldACL(gozk.PermAll))
+	if err := r1.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+
+	fake.ExpireSession()
+	r2 := NewEphemeralReservation("/test/reservations", "bar", gozk.WorldACL(gozk.PermAll))
+	if err := r2.Reserve(time.Minute); err != nil {
+		t.Errorf("Expected reservation to be released with our session, got %v", err)
+	}
+}
+
+func TestReservationReplacesExpiredEphemeral(t *testing.T) {
+	setupFakeZookeeper()
+	first, firstSession := newFakeSession("first")
+	defer first.TearDown()
+	second, secondSession := newFakeSession("second")
+	defer second.TearDown()
+	acl := gozk.WorldACL(gozk.PermAll)
+
+	// an ephemeral reservation which expires without its holder going away
+	r1 := NewEphemeralReservation("/test/reservations", "ephemeral", acl, WithZookeeper(first))
+	if err := r1.Reserve(time.Millisecond); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	r2 := NewEphemeralReservation("/test/reservations", "ephemeral", acl, WithZookeeper(second))
+	if err := r2.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to replace expired reservation: %v", err)
+	}
+
+	// our replacement is ours, so survives the previous holder's session...
+	firstSession.ExpireSession()
+	r3 := NewReservation("/test/reservations", "ephemeral", acl)
+	if err := r3.Reserve(time.Minute); err != ErrReserved {
+		t.Fatalf("Expected replacement to outlive the previous holder's session, got %v", err)
+	}
+	if err := r2.Renew(time.Minute); err != nil {
+		t.Errorf("Failed to renew replacement: %v", err)
+	}
+
+	// ...but not our own
+	secondSession.ExpireSession()
+	if err := r3.Reserve(time.Minute); err != nil {
+		t.Errorf("Expected replacement to go with our session, got %v", err)
+	}
+	r3.Release()
+}
+
+func TestEphemeralReservationReplacesExpiredPersistent(t *testing.T) {
+	setupFakeZookeeper()
+	c, session := newFakeSession("ephemeral")
+	defer c.TearDown()
+	acl := gozk.WorldACL(gozk.PermAll)
+
+	r1 := NewReservation("/test/reservations", "persistent", acl)
+	if err := r1.Reserve(time.Millisecond); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	r2 := NewEphemeralReservation("/test/reservations", "persistent", acl, WithZookeeper(c))
+	if err := r2.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to replace expired reservation: %v", err)
+	}
+
+	// the replacement is ephemeral, so goes with our session
+	session.ExpireSession()
+	if err := r1.Reserve(time.Minute); err != nil {
+		t.Errorf("Expected ephemeral replacement to go with our session, got %v", err)
+	}
+	r1.Release()
+}
+
+func TestSweepAndReleaseReservationsOnAnotherEnsemble(t *testing.T) {
+	setupFakeZookeeper()
+	other := zk.NewClient("other", "hailo", "service", "zookeeper", "clusters", "other")
+	other.Connector = zk.NewFakeZookeeperClient().Connector
+	defer other.TearDown()
+
+	path := "/test/reservations-elsewhere"
+	r := NewReservation(path, "foo", gozk.WorldACL(gozk.PermAll), WithZookeeper(other))
+	if err := r.Reserve(time.Millisecond); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if n, err := SweepReservations(path); err != nil || n != 0 {
+		t.Errorf("Expected nothing to sweep within the region, got %d (%v)", n, err)
+	}
+	if n, err := SweepReservations(path, WithZookeeper(other)); err != nil || n != 1 {
+		t.Errorf("Expected to sweep the expired reservation, got %d (%v)", n, err)
+	}
+
+	if err := r.Reserve(time.Minute); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	if err := AnonymousRelease(path, "foo", WithZookeeper(other)); err != nil {
+		t.Fatalf("Failed to release: %v", err)
+	}
+	if h, err := r.Holder(); err != nil || h != nil {
+		t.Errorf("Expected no holder after release, got %v (%v)", h, err)
+	}
+}
@@ -0,0 +1,87 @@
+package sync
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	readNodePrefix  = "read-"
+	writeNodePrefix = "write-"
+)
+
+// RWLock is a distributed lock which can be held by many readers, or a single writer
+type RWLock interface {
+	// RLock acquires a shared lock, waiting until the context is done if there is a writer
+	RLock(ctx context.Context) (Lock, error)
+	// Lock acquires an exclusive lock, waiting until the context is done if there are any other holders
+	Lock(ctx context.Context) (Lock, error)
+}
+
+type regionRWLock struct {
+	path string
+	opts []LockOption
+}
+
+// RegionRWLock returns a read/write lock on `id` within the local operating region. Locks are namespaced per
+// service (see SetRegionLockNamespace) and held for a maximum of 2 seconds in the event of failing to Unlock(),
+// unless overridden via options.
+func RegionRWLock(id []byte, opts ...LockOption) (RWLock, error) {
+	path, err := constructRecipePath("rwlock", string(id))
+	if err != nil {
+		return nil, err
+	}
+	return &regionRWLock{
+		path: path,
+		opts: opts,
+	}, nil
+}
+
+// RLock acquires a shared lock
+func (rw *regionRWLock) RLock(ctx context.Context) (Lock, error) {
+	return rw.acquire(ctx, readNodePrefix, holdsRead, "sync.regionrwlock.read")
+}
+
+// Lock acquires an exclusive lock
+func (rw *regionRWLock) Lock(ctx context.Context) (Lock, error) {
+	return rw.acquire(ctx, writeNodePrefix, holdsExclusive, "sync.regionrwlock.write")
+}
+
+func (rw *regionRWLock) acquire(ctx context.Context, prefix string, holds holdsFunc, bucket string) (Lock, error) {
+	o := newLockOptions(defaultRegionHoldFor, rw.opts...)
+	if int64(o.holdFor) < int64(minRegionHoldFor) {
+		return nil, ErrRegionHoldFor
+	}
+	log.Tracef("[Sync:RegionRWLock] Attempting to acquire '%s' (%s); held for %v", rw.path, prefix, o.holdFor)
+
+	startTime := time.Now()
+	lock, err := acquireSequenceLock(ctx, rw.path, prefix, o, holds)
+	inst.Timing(1.0, bucket+".acquire", time.Since(startTime))
+	reaperFor(o.client).addPath(rw.path) // only add path to reaper AFTER we've acquired the lock (or not)
+
+	if err != nil {
+		log.Errorf("[Sync:RegionRWLock] Failed to acquire '%s' (%s): %v", rw.path, prefix, err)
+		inst.Counter(1.0, bucket+".acquire.failure")
+		return nil, err
+	}
+
+	inst.Counter(1.0, bucket+".acquire.success")
+	go lock.monitor()
+
+	return lock, nil
+}
+
+// holdsRead is held as long as there are no writers ahead of us, in which case we wait on the writer closest to us
+func holdsRead(nodes sequenceNodes, i int) (bool, string) {
+	for j := i - 1; j >= 0; j-- {
+		if strings.Contains(nodes[j].name, writeNodePrefix) {
+			return false, nodes[j].name
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// expectContended attempts to acquire briefly, expecting to fail due to contention
+func expectContended(t *testing.T, acquire func(ctx context.Context) (Lock, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if l, err := acquire(ctx); !IsContended(err) {
+		if l != nil {
+			l.Unlock()
+		}
+		t.Fatalf("Expected to be contended, got %v", err)
+	}
+}
+
+// acquireAsync acquires in the background, delivering the lock once held
+func acquireAsync(t *testing.T, acquire func(ctx context.Context) (Lock, error)) <-chan Lock {
+	ch := make(chan Lock, 1)
+	go func() {
+		l, err := acquire(context.Background())
+		if err != nil {
+			t.Errorf("Failed to acquire: %v", err)
+			return
+		}
+		ch <- l
+	}()
+	return ch
+}
+
+func TestRegionRWLock(t *testing.T) {
+	setupFakeZookeeper()
+
+	rw, err := RegionRWLock([]byte("rwlock"))
+	if err != nil {
+		t.Fatalf("Failed to create lock: %v", err)
+	}
+
+	// readers share the lock
+	r1, err := rw.RLock(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire read lock: %v", err)
+	}
+	r2, err := rw.RLock(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire second read lock: %v", err)
+	}
+
+	// a writer waits for all of them
+	written := acquireAsync(t, rw.Lock)
+	select {
+	case <-written:
+		t.Fatal("Expected writer to wait for readers")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and excludes readers which come after it
+	expectContended(t, rw.RLock)
+
+	r1.Unlock()
+	select {
+	case <-written:
+		t.Fatal("Expected writer to wait for the remaining reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r2.Unlock()
+
+	var w Lock
+	select {
+	case w = <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Expected writer to acquire once readers have gone")
+	}
+
+	// whilst held, nobody else may read or write
+	expectContended(t, rw.RLock)
+	expectContended(t, rw.Lock)
+
+	w.Unlock()
+	r3, err := rw.RLock(context.Background())
+	if err != nil {
+		t.Fatalf("Expected to read once the writer has gone, got %v", err)
+	}
+	r3.Unlock()
+}
@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+
+	inst "github.com/HailoOSS/service/instrumentation"
+)
+
+const (
+	leaseNodePrefix = "lease-"
+)
+
+// Semaphore is a distributed counting semaphore which allows up to N concurrent holders
+type Semaphore interface {
+	// Acquire obtains a lease, waiting until the context is done if there are already N holders
+	Acquire(ctx context.Context) (Lock, error)
+}
+
+type regionSemaphore struct {
+	path string
+	n    int
+	opts []LockOption
+}
+
+// RegionSemaphore returns a semaphore on `id` within the local operating region, which can be held by up to `n`
+// processes at once. All processes using the same ID must agree on `n`. Semaphores are namespaced per service (see
+// SetRegionLockNamespace) and leases are held for a maximum of 2 seconds in the event of failing to Unlock(), unless
+// overridden via options.
+func RegionSemaphore(id []byte, n int, opts ...LockOption) (Semaphore, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("Semaphore must allow at least one holder")
+	}
+	path, err := constructRecipePath("semaphore", string(id))
+	if err != nil {
+		return nil, err
+	}
+	return &regionSemaphore{
+		path: path,
+		n:    n,
+		opts: opts,
+	}, nil
+}
+
+// Acquire obtains a lease on the semaphore; Unlock the returned lock to give it up
+func (s *regionSemaphore) Acquire(ctx context.Context) (Lock, error) {
+	o := newLockOptions(defaultRegionHoldFor, s.opts...)
+	if int64(o.holdFor) < int64(minRegionHoldFor) {
+		return nil, ErrRegionHoldFor
+	}
+	log.Tracef("[Sync:RegionSemaphore] Attempting to acquire '%s' (%d holders); held for %v", s.path, s.n, o.holdFor)
+
+	startTime := time.Now()
+	lock, err := acquireSequenceLock(ctx, s.path, leaseNodePrefix, o, s.holds)
+	inst.Timing(1.0, "sync.regionsemaphore.acquire", time.Since(startTime))
+	reaperFor(o.client).addPath(s.path) // only add path to reaper AFTER we've acquired the lease (or not)
+
+	if err != nil {
+		log.Errorf("[Sync:RegionSemaphore] Failed to acquire '%s': %v", s.path, err)
+		inst.Counter(1.0, "sync.regionsemaphore.acquire.failure")
+		return nil, err
+	}
+
+	inst.Counter(1.0, "sync.regionsemaphore.acquire.success")
+	go lock.monitor()
+
+	return lock, nil
+}
+
+// holds is true for the lowest N nodes. As any one of these leaving will let us in, we wait for any change to the
+// children rather than a specific node.
+func (s *regionSemaphore) holds(nodes sequenceNodes, i int) (bool, string) {
+	return i < s.n, ""
+}
@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRegionSemaphore(t *testing.T) {
+	fake := setupFakeZookeeper()
+
+	if _, err := RegionSemaphore([]byte("semaphore"), 0); err == nil {
+		t.Error("Expected a semaphore without holders to be rejected")
+	}
+	s, err := RegionSemaphore([]byte("semaphore"), 2)
+	if err != nil {
+		t.Fatalf("Failed to create semaphore: %v", err)
+	}
+
+	// admits up to N holders
+	l1, err := s.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire: %v", err)
+	}
+	l2, err := s.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire second lease: %v", err)
+	}
+	defer l2.Unlock()
+
+	// but no more
+	expectContended(t, s.Acquire)
+	acquired := acquireAsync(t, s.Acquire)
+	select {
+	case <-acquired:
+		t.Fatal("Expected to wait whilst there are already N holders")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// until one of them lets go
+	l1.Unlock()
+	select {
+	case l3 := <-acquired:
+		defer l3.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("Expected to acquire once a holder has released")
+	}
+
+	path, _ := constructRecipePath("semaphore", "semaphore")
+	if children, _, err := fake.Children(path); err != nil || len(children) != 2 {
+		t.Errorf("Expected two leases, got %v (%v)", children, err)
+	}
+}
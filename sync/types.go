@@ -8,8 +8,18 @@ type Leader interface {
 	Rescind()
 }
 
+// HandoverLeader is a Leader which may nominate its successor
+type HandoverLeader interface {
+	Leader
+	// Handover nominates another candidate (by holder ID) to take over leadership, and then rescinds
+	Handover(candidateId string) error
+}
+
 // Lock is an interface used by return values on things that can achieve a lock
 type Lock interface {
 	// Unlock allows clients to release the lock
 	Unlock()
+	// Lost returns a channel that will be closed when exclusivity can no longer be guaranteed, eg: a failed
+	// refresh or loss of the ZooKeeper session. It is also closed when the lock is released via Unlock.
+	Lost() <-chan struct{}
 }
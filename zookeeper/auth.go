@@ -0,0 +1,131 @@
+package zookeeper
+
+import (
+	"strings"
+
+	log "github.com/cihub/seelog"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+const (
+	defaultAuthScheme = "digest"
+)
+
+// aclEntry is the config representation of an ACL, eg: {"scheme": "world", "id": "anyone", "perms": "r"}
+type aclEntry struct {
+	Scheme string `json:"scheme"`
+	Id     string `json:"id"`
+	Perms  string `json:"perms"`
+}
+
+// getAuth reads our credentials from config (at "auth" beneath the client's config path), which may be encrypted, eg:
+//
+//	{"scheme": "digest", "user": "foo", "password": "bar"}
+//
+// An empty scheme is returned if no credentials are configured.
+func (c *Client) getAuth() (string, []byte) {
+	auth := c.configAt("auth")
+	if encrypted := auth.AsString(""); encrypted != "" {
+		decrypted, err := auth.Decrypt()
+		if err != nil {
+			log.Errorf("[ZooKeeper] Failed to decrypt auth config: %v", err)
+			return "", nil
+		}
+		auth = decrypted
+	}
+
+	user := auth.AtPath("user").AsString("")
+	if user == "" {
+		return "", nil
+	}
+	password := auth.AtPath("password").AsString("")
+	return auth.AtPath("scheme").AsString(defaultAuthScheme), []byte(user + ":" + password)
+}
+
+// authenticate adds our credentials (if any) to the connection. It must be called whenever a session is established, as
+// credentials are not carried over to a new session.
+func (c *Client) authenticate(conn ZookeeperClient) {
+	scheme, auth := c.getAuth()
+	if scheme == "" || conn == nil {
+		return
+	}
+	if err := conn.AddAuth(scheme, auth); err != nil {
+		log.Errorf("[ZooKeeper] Failed to authenticate (%s) with scheme '%s': %v", c.Name, scheme, err)
+		return
+	}
+	log.Debugf("[ZooKeeper] Authenticated (%s) with scheme '%s'", c.Name, scheme)
+}
+
+// DefaultACL returns the ACL which should be applied to nodes created via the default client
+func DefaultACL() []gozk.ACL {
+	return DefaultClient.DefaultACL()
+}
+
+// NamespaceACL returns the ACL configured for nodes within a namespace, via the default client
+func NamespaceACL(namespace string) []gozk.ACL {
+	return DefaultClient.NamespaceACL(namespace)
+}
+
+// DefaultACL returns the ACL which should be applied to nodes we create: creator-only if we authenticate with ZooKeeper,
+// otherwise open to all
+func (c *Client) DefaultACL() []gozk.ACL {
+	if scheme, _ := c.getAuth(); scheme != "" {
+		return gozk.AuthACL(gozk.PermAll)
+	}
+	return gozk.WorldACL(gozk.PermAll)
+}
+
+// NamespaceACL returns the ACL configured for nodes within a namespace (at "acl.<namespace>" beneath the client's config
+// path), falling back to DefaultACL. This allows eg: other services to be granted read access to a namespace.
+func (c *Client) NamespaceACL(namespace string) []gozk.ACL {
+	if namespace == "" {
+		return c.DefaultACL()
+	}
+
+	var entries []aclEntry
+	if err := c.configAt("acl", namespace).AsStruct(&entries); err != nil {
+		log.Warnf("[ZooKeeper] Failed to read ACL config for namespace '%s': %v", namespace, err)
+	}
+	if acl := entriesToACL(entries); len(acl) > 0 {
+		return acl
+	}
+	return c.DefaultACL()
+}
+
+func entriesToACL(entries []aclEntry) []gozk.ACL {
+	acl := make([]gozk.ACL, 0, len(entries))
+	for _, e := range entries {
+		perms := parsePerms(e.Perms)
+		if e.Scheme == "" || perms == 0 {
+			log.Warnf("[ZooKeeper] Ignoring invalid ACL entry %+v", e)
+			continue
+		}
+		acl = append(acl, gozk.ACL{Scheme: e.Scheme, ID: e.Id, Perms: perms})
+	}
+	return acl
+}
+
+// parsePerms converts permissions in the form "rwcda" (or "all") to their bitmask
+func parsePerms(s string) int32 {
+	if strings.ToLower(s) == "all" {
+		return gozk.PermAll
+	}
+
+	var perms int32
+	for _, c := range strings.ToLower(s) {
+		switch c {
+		case 'r':
+			perms |= gozk.PermRead
+		case 'w':
+			perms |= gozk.PermWrite
+		case 'c':
+			perms |= gozk.PermCreate
+		case 'd':
+			perms |= gozk.PermDelete
+		case 'a':
+			perms |= gozk.PermAdmin
+		}
+	}
+	return perms
+}
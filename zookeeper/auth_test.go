@@ -0,0 +1,90 @@
+package zookeeper
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	"github.com/HailoOSS/service/config"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParsePerms(t *testing.T) {
+	testCases := map[string]int32{
+		"":      0,
+		"r":     gozk.PermRead,
+		"rw":    gozk.PermRead | gozk.PermWrite,
+		"CDA":   gozk.PermCreate | gozk.PermDelete | gozk.PermAdmin,
+		"rwcda": gozk.PermAll,
+		"all":   gozk.PermAll,
+	}
+	for s, want := range testCases {
+		if got := parsePerms(s); got != want {
+			t.Errorf("parsePerms(%q): want %d, got %d", s, want, got)
+		}
+	}
+}
+
+func TestEntriesToACL(t *testing.T) {
+	acl := entriesToACL([]aclEntry{
+		{Scheme: "world", Id: "anyone", Perms: "r"},
+		{Scheme: "auth", Perms: "all"},
+		{Scheme: "", Id: "anyone", Perms: "r"},
+		{Scheme: "world", Id: "anyone", Perms: ""},
+	})
+	want := []gozk.ACL{
+		{Scheme: "world", ID: "anyone", Perms: gozk.PermRead},
+		{Scheme: "auth", Perms: gozk.PermAll},
+	}
+	if len(acl) != len(want) {
+		t.Fatalf("Want %v, Got %v", want, acl)
+	}
+	for i := range want {
+		if acl[i] != want[i] {
+			t.Errorf("Want %v, Got %v", want[i], acl[i])
+		}
+	}
+}
+
+// addAuthCalls returns the arguments of each call to AddAuth
+func addAuthCalls(m *MockZookeeperClient) [][]interface{} {
+	var calls [][]interface{}
+	for _, c := range m.Calls {
+		if c.Method == "AddAuth" {
+			calls = append(calls, c.Arguments)
+		}
+	}
+	return calls
+}
+
+func TestAuthenticatesEachSession(t *testing.T) {
+	config.Load(bytes.NewBufferString(`{"hailo": {"service": {"zookeeper": {"clusters": {"auth": ` +
+		`{"auth": {"user": "foo", "password": "bar"}}}}}}}`))
+	defer config.Load(bytes.NewBufferString("{}"))
+
+	m := &MockZookeeperClient{}
+	m.On("AddAuth", mock.Anything, mock.Anything).Return(nil)
+	events := make(chan gozk.Event)
+	defer close(events)
+	c := NewClient("auth", "hailo", "service", "zookeeper", "clusters", "auth")
+	c.Connector = func(servers []string, recvTimeout time.Duration) (ZookeeperClient, <-chan gozk.Event, error) {
+		return m, events, nil
+	}
+	c.connect([]string{"localhost:2181"}, time.Second)
+
+	// credentials are added whenever a session is established, including once we have reconnected. Events are
+	// handled one at a time, so each one we send means the previous one has been handled.
+	for i := 1; i <= 2; i++ {
+		events <- gozk.Event{Type: gozk.EventSession, State: gozk.StateHasSession}
+		events <- gozk.Event{Type: gozk.EventSession, State: gozk.StateDisconnected}
+
+		calls := addAuthCalls(m)
+		if len(calls) != i {
+			t.Fatalf("Expected %d calls to AddAuth, got %d", i, len(calls))
+		}
+		if scheme, auth := calls[i-1][0], calls[i-1][1]; scheme != "digest" || string(auth.([]byte)) != "foo:bar" {
+			t.Errorf("Want digest 'foo:bar', Got %v '%s'", scheme, auth)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package zookeeper
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+// CacheEventType describes a change to a cached node
+type CacheEventType int
+
+const (
+	NodeAdded CacheEventType = iota
+	NodeUpdated
+	NodeRemoved
+)
+
+const (
+	cacheEventBuffer = 100
+)
+
+func (t CacheEventType) String() string {
+	switch t {
+	case NodeAdded:
+		return "added"
+	case NodeUpdated:
+		return "updated"
+	case NodeRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// ChildData is the cached state of a node
+type ChildData struct {
+	Path string
+	Data []byte
+	Stat *gozk.Stat
+}
+
+// CacheEvent is delivered whenever a cached node is added, updated or removed
+type CacheEvent struct {
+	Type CacheEventType
+	*ChildData
+}
+
+// watchKind identifies the kind of watch we have set on a path
+type watchKind int
+
+const (
+	dataWatch watchKind = iota
+	childrenWatch
+	existsWatch
+	retryWatch
+)
+
+type watchFired struct {
+	path string
+	kind watchKind
+}
+
+// treeCache mirrors a subtree of nodes (down to a maximum depth) in memory. It is the engine behind NodeCache,
+// PathChildrenCache and TreeCache.
+//
+// All changes happen on a single goroutine, which sets at most one watch of each kind per path and re-fetches a path
+// whenever one of its watches fires (including when watches are lost with our session).
+type treeCache struct {
+	sync.RWMutex
+	client      *Client
+	root        string
+	maxDepth    int
+	includeRoot bool
+	nodes       map[string]*ChildData
+	children    map[string][]string
+	armed       map[watchKind]map[string]bool
+
+	events  chan CacheEvent
+	pending []CacheEvent
+	fired   chan watchFired
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newTreeCache(client *Client, root string, maxDepth int, includeRoot bool) *treeCache {
+	c := &treeCache{
+		client:      client,
+		root:        strings.TrimSuffix(root, "/"),
+		maxDepth:    maxDepth,
+		includeRoot: includeRoot,
+		nodes:       make(map[string]*ChildData),
+		children:    make(map[string][]string),
+		armed: map[watchKind]map[string]bool{
+			dataWatch:     make(map[string]bool),
+			childrenWatch: make(map[string]bool),
+			existsWatch:   make(map[string]bool),
+		},
+		events: make(chan CacheEvent, cacheEventBuffer),
+		fired:  make(chan watchFired),
+		stop:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Events returns the channel on which changes are delivered. It must be drained, or the cache will stop updating.
+func (c *treeCache) Events() <-chan CacheEvent {
+	return c.events
+}
+
+// Close stops the cache
+func (c *treeCache) Close() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *treeCache) get(path string) *ChildData {
+	c.RLock()
+	defer c.RUnlock()
+	return c.nodes[path]
+}
+
+// childrenOf returns the cached children of a path, keyed by name
+func (c *treeCache) childrenOf(path string) map[string]*ChildData {
+	c.RLock()
+	defer c.RUnlock()
+
+	children := make(map[string]*ChildData, len(c.children[path]))
+	for _, name := range c.children[path] {
+		if cd, ok := c.nodes[path+"/"+name]; ok {
+			children[name] = cd
+		}
+	}
+	return children
+}
+
+func (c *treeCache) run() {
+	c.refreshNode(c.root)
+	if !c.deliver() {
+		return
+	}
+
+	for {
+		select {
+		case f := <-c.fired:
+			delete(c.armed[f.kind], f.path)
+			switch f.kind {
+			case dataWatch:
+				c.refreshData(f.path)
+			case childrenWatch:
+				c.refreshChildren(f.path)
+			default:
+				c.refreshNode(f.path)
+			}
+			if !c.deliver() {
+				return
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// deliver sends pending events, returning false if we have been closed
+func (c *treeCache) deliver() bool {
+	for _, ev := range c.pending {
+		select {
+		case c.events <- ev:
+		case <-c.stop:
+			return false
+		}
+	}
+	c.pending = nil
+	return true
+}
+
+// forward waits for a watch to fire, and queues the path to be refreshed
+func (c *treeCache) forward(path string, kind watchKind, watch <-chan gozk.Event) {
+	select {
+	case <-watch:
+	case <-c.stop:
+		return
+	}
+	select {
+	case c.fired <- watchFired{path, kind}:
+	case <-c.stop:
+	}
+}
+
+func (c *treeCache) arm(path string, kind watchKind, watch <-chan gozk.Event) {
+	c.armed[kind][path] = true
+	go c.forward(path, kind, watch)
+}
+
+// retry refreshes a path again later, after failing to read it
+func (c *treeCache) retry(path string, err error) {
+	log.Debugf("[ZooKeeper] Cache failed to read '%s', will retry: %v", path, err)
+	time.AfterFunc(watchRetryInterval, func() {
+		select {
+		case c.fired <- watchFired{path, retryWatch}:
+		case <-c.stop:
+		}
+	})
+}
+
+func (c *treeCache) depth(path string) int {
+	if path == c.root {
+		return 0
+	}
+	return strings.Count(path[len(c.root):], "/")
+}
+
+func (c *treeCache) includesData(path string) bool {
+	return path != c.root || c.includeRoot
+}
+
+func (c *treeCache) refreshNode(path string) {
+	if c.includesData(path) && !c.refreshData(path) {
+		return
+	}
+	c.refreshChildren(path)
+}
+
+// refreshData fetches the data of a path, returning whether it exists
+func (c *treeCache) refreshData(path string) bool {
+	var (
+		data  []byte
+		stat  *gozk.Stat
+		watch <-chan gozk.Event
+		err   error
+	)
+	if c.armed[dataWatch][path] {
+		data, stat, err = c.client.Get(path)
+	} else {
+		data, stat, watch, err = c.client.GetW(path)
+	}
+	if err == gozk.ErrNoNode {
+		c.removed(path)
+		return false
+	} else if err != nil {
+		c.retry(path, err)
+		return false
+	}
+	if watch != nil {
+		c.arm(path, dataWatch, watch)
+	}
+
+	cd := &ChildData{Path: path, Data: data, Stat: stat}
+	c.Lock()
+	prev, ok := c.nodes[path]
+	c.nodes[path] = cd
+	c.Unlock()
+
+	if !ok {
+		c.pending = append(c.pending, CacheEvent{NodeAdded, cd})
+	} else if prev.Stat == nil || stat == nil || prev.Stat.Mzxid != stat.Mzxid || string(prev.Data) != string(data) {
+		c.pending = append(c.pending, CacheEvent{NodeUpdated, cd})
+	}
+	return true
+}
+
+// refreshChildren lists the children of a path, adding and removing nodes as required
+func (c *treeCache) refreshChildren(path string) {
+	if c.maxDepth >= 0 && c.depth(path) >= c.maxDepth {
+		return
+	}
+	if path != c.root && c.get(path) == nil {
+		// removed since the watch was set
+		return
+	}
+
+	var (
+		children []string
+		watch    <-chan gozk.Event
+		err      error
+	)
+	if c.armed[childrenWatch][path] {
+		children, _, err = c.client.Children(path)
+	} else {
+		children, _, watch, err = c.client.ChildrenW(path)
+	}
+	if err == gozk.ErrNoNode {
+		c.removed(path)
+		return
+	} else if err != nil {
+		c.retry(path, err)
+		return
+	}
+	if watch != nil {
+		c.arm(path, childrenWatch, watch)
+	}
+
+	sort.Strings(children)
+	c.Lock()
+	prev := c.children[path]
+	c.children[path] = children
+	c.Unlock()
+
+	current := make(map[string]bool, len(children))
+	for _, name := range children {
+		current[name] = true
+	}
+	for _, name := range prev {
+		if !current[name] {
+			c.removed(path + "/" + name)
+		}
+	}
+	for _, name := range children {
+		if _, ok := c.nodes[path+"/"+name]; !ok {
+			c.refreshNode(path + "/" + name)
+		}
+	}
+}
+
+// removed forgets a path and everything beneath it, deepest first. If the root has gone, we wait for it to return.
+func (c *treeCache) removed(path string) {
+	c.Lock()
+	paths := make([]string, 0)
+	for p := range c.nodes {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	for _, p := range paths {
+		c.pending = append(c.pending, CacheEvent{NodeRemoved, c.nodes[p]})
+		delete(c.nodes, p)
+		delete(c.children, p)
+	}
+	delete(c.children, path)
+	c.Unlock()
+
+	if path == c.root && !c.armed[existsWatch][path] {
+		exists, _, watch, err := c.client.ExistsW(path)
+		if err != nil {
+			c.retry(path, err)
+			return
+		}
+		c.arm(path, existsWatch, watch)
+		if exists {
+			// created in the meantime
+			c.refreshNode(path)
+		}
+	}
+}
+
+// NodeCache keeps an in-memory mirror of a single node
+type NodeCache struct {
+	*treeCache
+}
+
+// NewNodeCache starts mirroring the node at `path` via the default client, see Client.NewNodeCache
+func NewNodeCache(path string) *NodeCache {
+	return DefaultClient.NewNodeCache(path)
+}
+
+// NewNodeCache starts mirroring the node at `path`, which need not exist yet
+func (c *Client) NewNodeCache(path string) *NodeCache {
+	return &NodeCache{newTreeCache(c, path, 0, true)}
+}
+
+// Current returns the current state of the node, or nil if it does not exist
+func (c *NodeCache) Current() *ChildData {
+	return c.get(c.root)
+}
+
+// PathChildrenCache keeps an in-memory mirror of the children of a node (but not their children)
+type PathChildrenCache struct {
+	*treeCache
+}
+
+// NewPathChildrenCache starts mirroring the children of the node at `path` via the default client, see
+// Client.NewPathChildrenCache
+func NewPathChildrenCache(path string) *PathChildrenCache {
+	return DefaultClient.NewPathChildrenCache(path)
+}
+
+// NewPathChildrenCache starts mirroring the children of the node at `path`, which need not exist yet
+func (c *Client) NewPathChildrenCache(path string) *PathChildrenCache {
+	return &PathChildrenCache{newTreeCache(c, path, 1, false)}
+}
+
+// Children returns the current state of each child, keyed by name
+func (c *PathChildrenCache) Children() map[string]*ChildData {
+	return c.childrenOf(c.root)
+}
+
+// Child returns the current state of the named child, or nil if it does not exist
+func (c *PathChildrenCache) Child(name string) *ChildData {
+	return c.get(c.root + "/" + name)
+}
+
+// TreeCache keeps an in-memory mirror of a node and all of its descendants
+type TreeCache struct {
+	*treeCache
+}
+
+// NewTreeCache starts mirroring the subtree at `path` via the default client, see Client.NewTreeCache
+func NewTreeCache(path string, maxDepth int) *TreeCache {
+	return DefaultClient.NewTreeCache(path, maxDepth)
+}
+
+// NewTreeCache starts mirroring the subtree at `path` to a maximum depth beneath it (or the whole subtree if maxDepth
+// is negative)
+func (c *Client) NewTreeCache(path string, maxDepth int) *TreeCache {
+	return &TreeCache{newTreeCache(c, path, maxDepth, true)}
+}
+
+// Get returns the current state of the node at `path`, or nil if it does not exist
+func (c *TreeCache) Get(path string) *ChildData {
+	return c.get(path)
+}
+
+// Children returns the current state of each child of the node at `path`, keyed by name
+func (c *TreeCache) Children(path string) map[string]*ChildData {
+	return c.childrenOf(path)
+}
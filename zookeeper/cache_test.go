@@ -0,0 +1,100 @@
+package zookeeper
+
+import (
+	"testing"
+	"time"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+// newMockClient returns a client of our own which is already connected to a mock, so that it neither reads config nor
+// subscribes to changes in it, and we needn't replace the package Connector (which other clients may be reading)
+func newMockClient() (*Client, *MockZookeeperClient) {
+	m := &MockZookeeperClient{}
+	m.On("Close").Return()
+	c := NewClient("mock")
+	c.once.Do(func() {
+		c.conn = m
+		c.didSetup = true
+	})
+	return c, m
+}
+
+func expectCacheEvent(t *testing.T, events <-chan CacheEvent, typ CacheEventType, path, data string) {
+	select {
+	case ev := <-events:
+		if ev.Type != typ || ev.Path != path || (typ != NodeRemoved && string(ev.Data) != data) {
+			t.Fatalf("Want %v %s '%s', Got %v %s '%s'", typ, path, data, ev.Type, ev.Path, ev.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for %v %s", typ, path)
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	zk, m := newMockClient()
+	defer zk.TearDown()
+
+	watch1, watch2, existsWatch := make(chan gozk.Event, 1), make(chan gozk.Event, 1), make(chan gozk.Event, 1)
+	m.On("GetW", "/foo").Return([]byte("a"), &gozk.Stat{Mzxid: 1}, (<-chan gozk.Event)(watch1), nil).Once()
+	m.On("GetW", "/foo").Return([]byte("b"), &gozk.Stat{Mzxid: 2}, (<-chan gozk.Event)(watch2), nil).Once()
+	m.On("GetW", "/foo").Return([]byte(nil), (*gozk.Stat)(nil), (<-chan gozk.Event)(nil), gozk.ErrNoNode).Once()
+	m.On("ExistsW", "/foo").Return(false, (*gozk.Stat)(nil), (<-chan gozk.Event)(existsWatch), nil)
+
+	c := zk.NewNodeCache("/foo")
+	defer c.Close()
+
+	expectCacheEvent(t, c.Events(), NodeAdded, "/foo", "a")
+	if cd := c.Current(); cd == nil || string(cd.Data) != "a" {
+		t.Errorf("Expected current data 'a', got %v", cd)
+	}
+
+	watch1 <- gozk.Event{Type: gozk.EventNodeDataChanged, Path: "/foo"}
+	expectCacheEvent(t, c.Events(), NodeUpdated, "/foo", "b")
+
+	watch2 <- gozk.Event{Type: gozk.EventNodeDeleted, Path: "/foo"}
+	expectCacheEvent(t, c.Events(), NodeRemoved, "/foo", "")
+	if cd := c.Current(); cd != nil {
+		t.Errorf("Expected node to have been removed, got %v", cd)
+	}
+}
+
+func TestPathChildrenCache(t *testing.T) {
+	zk, m := newMockClient()
+	defer zk.TearDown()
+
+	childWatch1, childWatch2 := make(chan gozk.Event, 1), make(chan gozk.Event, 1)
+	m.On("ChildrenW", "/foo").Return([]string{"b", "a"}, &gozk.Stat{}, (<-chan gozk.Event)(childWatch1), nil).Once()
+	m.On("ChildrenW", "/foo").Return([]string{"a"}, &gozk.Stat{}, (<-chan gozk.Event)(childWatch2), nil).Once()
+	m.On("GetW", "/foo/a").Return([]byte("1"), &gozk.Stat{Mzxid: 1}, (<-chan gozk.Event)(make(chan gozk.Event)), nil)
+	m.On("GetW", "/foo/b").Return([]byte("2"), &gozk.Stat{Mzxid: 2}, (<-chan gozk.Event)(make(chan gozk.Event)), nil)
+
+	c := zk.NewPathChildrenCache("/foo")
+	defer c.Close()
+
+	expectCacheEvent(t, c.Events(), NodeAdded, "/foo/a", "1")
+	expectCacheEvent(t, c.Events(), NodeAdded, "/foo/b", "2")
+	if children := c.Children(); len(children) != 2 || string(children["b"].Data) != "2" {
+		t.Errorf("Unexpected children %v", children)
+	}
+
+	childWatch1 <- gozk.Event{Type: gozk.EventNodeChildrenChanged, Path: "/foo"}
+	expectCacheEvent(t, c.Events(), NodeRemoved, "/foo/b", "")
+	if c.Child("b") != nil || c.Child("a") == nil {
+		t.Errorf("Unexpected children %v", c.Children())
+	}
+}
+
+func TestTreeCacheDepth(t *testing.T) {
+	c := &treeCache{root: "/foo"}
+	testCases := map[string]int{
+		"/foo":         0,
+		"/foo/bar":     1,
+		"/foo/bar/baz": 2,
+	}
+	for path, want := range testCases {
+		if got := c.depth(path); got != want {
+			t.Errorf("depth(%s): want %d, got %d", path, want, got)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package zookeeper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+	"github.com/HailoOSS/platform/util"
+	"github.com/HailoOSS/service/config"
+	"github.com/HailoOSS/service/dns"
+)
+
+// Client is a connection to a ZooKeeper ensemble, configured from its own config path. It connects lazily on first
+// use, and reconnects whenever its config changes. Config beneath the path is:
+//
+//	hosts       - the ensemble, else found via DNS as "zookeeper-<tier>"
+//	tier        - the tier of ensemble to use (default "general"); hosts are then read from hosts.<tier>
+//	recvTimeout - the session timeout (default "100ms")
+//	auth        - credentials, see DefaultACL
+//	acl         - ACLs per namespace, see NamespaceACL
+//
+// For example, a global coordination ensemble could be configured at hailo.service.zookeeper.clusters.global:
+//
+//	global := zookeeper.NewClient("global", "hailo", "service", "zookeeper", "clusters", "global")
+type Client struct {
+	Name string
+	// Connector is used to connect, if set (otherwise the package Connector is used)
+	Connector  func(servers []string, recvTimeout time.Duration) (ZookeeperClient, <-chan gozk.Event, error)
+	configPath []string
+
+	mtx        sync.RWMutex
+	once       syncOnce
+	didSetup   bool
+	conn       ZookeeperClient
+	timeout    time.Duration
+	configHash string
+	session    *session
+}
+
+// NewClient returns a client for the ensemble configured at `configPath`
+func NewClient(name string, configPath ...string) *Client {
+	return &Client{
+		Name:       name,
+		configPath: configPath,
+		session:    newSession(),
+	}
+}
+
+func (c *Client) configAt(path ...string) config.ConfigElement {
+	return config.AtPath(append(append([]string{}, c.configPath...), path...)...)
+}
+
+// Try to connect, then kick off listener for config changes
+func (c *Client) setup() {
+	ch := config.SubscribeChanges()
+	go func() {
+		for _ = range ch {
+			c.reconnect()
+		}
+	}()
+	c.reconnect()
+	c.didSetup = true
+}
+
+func (c *Client) hasConfigChanged(hostsSlice []string, duration time.Duration) bool {
+	thisBytes := make([]byte, 0)
+	for _, h := range hostsSlice {
+		thisBytes = append(thisBytes, []byte(h)...)
+	}
+	durBytes := make([]byte, binary.Size(duration))
+	binary.PutVarint(durBytes, int64(duration))
+	thisBytes = append(thisBytes, durBytes...)
+	hash := util.GetMD5Hash(thisBytes)
+
+	c.mtx.Lock()
+	changed := c.configHash != hash
+	if changed {
+		c.configHash = hash
+	}
+	c.mtx.Unlock()
+	return changed
+}
+
+func (c *Client) connect(hosts []string, recvTimeout time.Duration) {
+	log.Infof("Attempting to connect to ZK (%s) on %v with timeout %v", c.Name, hosts, recvTimeout)
+	var err error
+	var eventChan <-chan gozk.Event
+
+	connector := c.Connector
+	if connector == nil {
+		connector = Connector
+	}
+
+	var conn ZookeeperClient
+	c.mtx.Lock()
+	conn, eventChan, err = connector(hosts, recvTimeout)
+	c.conn = conn
+	c.mtx.Unlock()
+
+	if err != nil {
+		log.Warnf("Failed to connect to ZK (%s): %v", c.Name, err)
+	}
+
+	go func() {
+		for ev := range eventChan {
+			log.Tracef("Received zk (%s) connection event: %v", c.Name, ev)
+			if ev.Type == gozk.EventSession && ev.State == gozk.StateHasSession {
+				// credentials must be added to every new session, before anyone finds out it exists
+				c.authenticate(conn)
+			}
+			c.session.handle(ev)
+		}
+
+		log.Warnf("ZK (%s) connection event loop has closed", c.Name)
+	}()
+}
+
+func (c *Client) getHosts() []string {
+	hostsConfigPath := []string{"hosts"}
+	tier := c.configAt("tier").AsString("general")
+	if tier != "general" {
+		hostsConfigPath = append(hostsConfigPath, tier)
+	}
+
+	if hosts := c.configAt(hostsConfigPath...).AsHostnameArray(2181); len(hosts) > 0 {
+		return hosts
+	}
+
+	// no hosts returned so try dns
+	hosts, err := dns.Hosts("zookeeper-" + tier)
+	if err != nil {
+		log.Errorf("Failed to load ZK hosts from dns: %v", err)
+		return []string{"localhost:2181"}
+	}
+
+	// for safety fall back to localhost
+	if len(hosts) == 0 {
+		return []string{"localhost:2181"}
+	}
+
+	// append port
+	for i, host := range hosts {
+		hosts[i] = host + ":2181"
+	}
+
+	return hosts
+}
+
+func (c *Client) reconnect() {
+	hosts := c.getHosts()
+	recvTimeout := c.configAt("recvTimeout").AsDuration("100ms")
+	if !c.hasConfigChanged(hosts, recvTimeout) {
+		log.Infof("ZooKeeper (%s) config has not changed", c.Name)
+		return
+	}
+
+	if c.conn != nil {
+		if recvTimeout != c.timeout {
+			// cannot gracefully set timeout so close it
+			c.timeout = recvTimeout
+			c.conn.Close()
+		} else {
+			// update the hosts only
+			log.Tracef("Setting ZK (%s) hosts to %v", c.Name, hosts)
+			c.conn.UpdateAddrs(hosts)
+			return
+		}
+	}
+
+	c.connect(hosts, recvTimeout)
+}
+
+// WaitForConnect will wait until we are connected to ZK successfully for duration N
+func (c *Client) WaitForConnect(d time.Duration) error {
+	c.once.Do(c.setup)
+
+	timeout := time.Now().Add(d)
+	for {
+		c.mtx.RLock()
+		st := c.conn.State()
+		c.mtx.RUnlock()
+
+		if st == gozk.StateHasSession {
+			return nil
+		}
+		if time.Now().After(timeout) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return fmt.Errorf("Failed to achieve ZooKeeper (%s) connection within %v", c.Name, d)
+}
+
+// CloseConnection closes the underlying network connection to zookeeper
+// This will trigger both the send and recv loops to exit and requests to flush
+// and then we will automatically attempt to reconnect
+//
+// Needless to say, this is the nuclear option, and should only be used
+// as a part of higher level constructs in the event of a near fatal error
+func (c *Client) CloseConnection() error {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	return c.conn.Reconnect()
+}
+
+// Close and remove the connection, WITHOUT attempting to automatically reconnect
+func (c *Client) TearDown() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.didSetup {
+		c.conn.Close()
+		c.conn = nil
+		c.once.Reset()
+		c.didSetup = false
+		c.configHash = ""
+	}
+}
+
+func (c *Client) Children(path string) ([]string, *gozk.Stat, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	children, stat, err := c.conn.Children(path)
+	return children, stat, err
+}
+
+func (c *Client) ChildrenW(path string) ([]string, *gozk.Stat, <-chan gozk.Event, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	children, stat, ch, err := c.conn.ChildrenW(path)
+	return children, stat, ch, err
+}
+
+func (c *Client) Create(path string, data []byte, flags int32, acl []gozk.ACL) (string, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	path, err := c.conn.Create(path, data, flags, acl)
+	return path, err
+}
+
+func (c *Client) CreateProtectedEphemeralSequential(path string, data []byte, acl []gozk.ACL) (string, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	path, err := c.conn.CreateProtectedEphemeralSequential(path, data, acl)
+	return path, err
+}
+
+func (c *Client) Delete(path string, version int32) error {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	err := c.conn.Delete(path, version)
+	return err
+}
+
+func (c *Client) Exists(path string) (bool, *gozk.Stat, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	ex, stat, err := c.conn.Exists(path)
+	return ex, stat, err
+}
+
+func (c *Client) ExistsW(path string) (bool, *gozk.Stat, <-chan gozk.Event, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	ex, stat, ch, err := c.conn.ExistsW(path)
+	return ex, stat, ch, err
+}
+
+func (c *Client) Get(path string) ([]byte, *gozk.Stat, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	data, stat, err := c.conn.Get(path)
+	return data, stat, err
+}
+
+func (c *Client) GetACL(path string) ([]gozk.ACL, *gozk.Stat, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	acls, stat, err := c.conn.GetACL(path)
+	return acls, stat, err
+}
+
+func (c *Client) GetW(path string) ([]byte, *gozk.Stat, <-chan gozk.Event, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	data, stat, ch, err := c.conn.GetW(path)
+	return data, stat, ch, err
+}
+
+func (c *Client) Multi(ops gozk.MultiOps) error {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	err := c.conn.Multi(ops)
+	return err
+}
+
+func (c *Client) Set(path string, data []byte, version int32) (*gozk.Stat, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	stat, err := c.conn.Set(path, data, version)
+	return stat, err
+}
+
+func (c *Client) SetACL(path string, acl []gozk.ACL, version int32) (*gozk.Stat, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	stat, err := c.conn.SetACL(path, acl, version)
+	return stat, err
+}
+
+func (c *Client) State() gozk.State {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	state := c.conn.State()
+	return state
+}
+
+func (c *Client) Sync(path string) (string, error) {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	s, err := c.conn.Sync(path)
+	return s, err
+}
+
+func (c *Client) NewLock(path string, acl []gozk.ACL) gozk.Locker {
+	c.once.Do(c.setup)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	return c.conn.NewLock(path, acl)
+}
+
+// CreateParents creates any parent nodes for the given path if required. If all
+// the parent nodes already exist then no error is returned.
+func (c *Client) CreateParents(path string) error {
+	parts := strings.Split(path, "/")
+	pth := ""
+	for _, p := range parts[1:] {
+		pth += "/" + p
+		// parents are left open, as they may be shared by other services
+		_, err := c.Create(pth, []byte{}, 0, gozk.WorldACL(gozk.PermAll))
+		if err != nil && err != gozk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
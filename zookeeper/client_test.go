@@ -0,0 +1,36 @@
+package zookeeper
+
+import (
+	"testing"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+func TestClientsAreIndependent(t *testing.T) {
+	a := NewClient("a", "hailo", "service", "zookeeper", "clusters", "a")
+	a.Connector = NewFakeZookeeperClient().Connector
+	defer a.TearDown()
+	b := NewClient("b", "hailo", "service", "zookeeper", "clusters", "b")
+	b.Connector = NewFakeZookeeperClient().Connector
+	defer b.TearDown()
+
+	if _, err := a.Create("/foo", []byte("a"), 0, gozk.WorldACL(gozk.PermAll)); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if exists, _, err := b.Exists("/foo"); err != nil || exists {
+		t.Errorf("Expected node not to exist on another ensemble (%v)", err)
+	}
+	if data, _, err := a.Get("/foo"); err != nil || string(data) != "a" {
+		t.Errorf("Want 'a', Got %q (%v)", data, err)
+	}
+}
+
+func TestClientHealthCheckIds(t *testing.T) {
+	if id := DefaultClient.HealthCheckId(); id != HealthCheckId {
+		t.Errorf("Want %s, Got %s", HealthCheckId, id)
+	}
+	c := NewClient("global", "hailo", "service", "zookeeper", "clusters", "global")
+	if id := c.HealthCheckId(); id != HealthCheckId+".global" {
+		t.Errorf("Want %s, Got %s", HealthCheckId+".global", id)
+	}
+}
@@ -0,0 +1,796 @@
+package zookeeper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+var (
+	ErrFakeLockTimeout = errors.New("zk: timed out acquiring lock")
+)
+
+const (
+	fakeEventBuffer = 100
+)
+
+// fakeServer holds the node tree shared by fake sessions
+type fakeServer struct {
+	sync.Mutex
+	root         *fakeNode
+	zxid         int64
+	nextSession  int64
+	dataWatches  map[string][]*fakeWatch
+	childWatches map[string][]*fakeWatch
+	pending      []fakeFiring
+}
+
+type fakeNode struct {
+	data     []byte
+	acl      []gozk.ACL
+	stat     gozk.Stat
+	children map[string]*fakeNode
+}
+
+type fakeWatch struct {
+	session *FakeZookeeperClient
+	ch      chan gozk.Event
+}
+
+type fakeFiring struct {
+	w  *fakeWatch
+	ev gozk.Event
+}
+
+// FakeZookeeperClient is a behavioural in-memory implementation of ZookeeperClient, for use in unit tests. It supports
+// versions, ephemeral and sequential nodes, watches, Multi and simulated disconnection and session expiry. To use it
+// in place of a real connection:
+//
+//	fake := zookeeper.NewFakeZookeeperClient()
+//	zookeeper.Connector = fake.Connector
+//	defer func() {
+//		zookeeper.TearDown()
+//		zookeeper.Connector = zookeeper.DefaultConnector
+//	}()
+//
+// Further sessions sharing the same tree (eg: to simulate other processes) may be created with NewSession.
+type FakeZookeeperClient struct {
+	s         *fakeServer
+	sessionId int64
+	state     gozk.State
+	events    chan gozk.Event
+	auth      []string
+	closed    bool
+}
+
+// NewFakeZookeeperClient returns a connected session on a new, empty tree
+func NewFakeZookeeperClient() *FakeZookeeperClient {
+	s := &fakeServer{
+		root:         &fakeNode{children: make(map[string]*fakeNode)},
+		dataWatches:  make(map[string][]*fakeWatch),
+		childWatches: make(map[string][]*fakeWatch),
+	}
+	return s.newSession()
+}
+
+// NewSession returns another connected session on the same tree
+func (c *FakeZookeeperClient) NewSession() *FakeZookeeperClient {
+	return c.s.newSession()
+}
+
+func (s *fakeServer) newSession() *FakeZookeeperClient {
+	s.Lock()
+	defer s.Unlock()
+
+	s.nextSession++
+	c := &FakeZookeeperClient{
+		s:         s,
+		sessionId: s.nextSession,
+		events:    make(chan gozk.Event, fakeEventBuffer),
+	}
+	c.setState(gozk.StateConnecting)
+	c.setState(gozk.StateConnected)
+	c.setState(gozk.StateHasSession)
+	return c
+}
+
+// Connector may be used as the zookeeper package's Connector, returning this session
+func (c *FakeZookeeperClient) Connector(servers []string, recvTimeout time.Duration) (ZookeeperClient, <-chan gozk.Event, error) {
+	return c, c.events, nil
+}
+
+// SessionId returns the ID of the current session, which is the owner of any ephemeral nodes it creates
+func (c *FakeZookeeperClient) SessionId() int64 {
+	c.s.Lock()
+	defer c.s.Unlock()
+	return c.sessionId
+}
+
+// setState must be called with the server lock held
+func (c *FakeZookeeperClient) setState(st gozk.State) {
+	c.state = st
+	if c.closed {
+		return
+	}
+	select {
+	case c.events <- gozk.Event{Type: gozk.EventSession, State: st}:
+	default:
+	}
+}
+
+// Disconnect simulates losing our connection; operations fail until Reconnect is called
+func (c *FakeZookeeperClient) Disconnect() {
+	c.s.Lock()
+	defer c.s.Unlock()
+	c.setState(gozk.StateDisconnected)
+}
+
+// ExpireSession simulates our session expiring: our ephemeral nodes are deleted and our watches are lost. We are
+// then reconnected with a new session.
+func (c *FakeZookeeperClient) ExpireSession() {
+	c.s.Lock()
+	c.expire()
+	c.setState(gozk.StateExpired)
+	c.auth = nil
+	c.s.nextSession++
+	c.sessionId = c.s.nextSession
+	c.setState(gozk.StateConnecting)
+	c.setState(gozk.StateConnected)
+	c.setState(gozk.StateHasSession)
+	c.s.Unlock()
+
+	c.s.fire()
+}
+
+// expire deletes our ephemeral nodes and notifies our watches that they are no longer watching. It must be called with
+// the server lock held.
+func (c *FakeZookeeperClient) expire() {
+	var ephemerals []string
+	c.s.walk("", c.s.root, func(path string, n *fakeNode) {
+		if n.stat.EphemeralOwner == c.sessionId {
+			ephemerals = append(ephemerals, path)
+		}
+	})
+	for _, path := range ephemerals {
+		c.s.delete(path, -1)
+	}
+
+	for _, watches := range []map[string][]*fakeWatch{c.s.dataWatches, c.s.childWatches} {
+		for path, ws := range watches {
+			remaining := ws[:0]
+			for _, w := range ws {
+				if w.session != c {
+					remaining = append(remaining, w)
+					continue
+				}
+				c.s.pending = append(c.s.pending, fakeFiring{w, gozk.Event{
+					Type:  gozk.EventNotWatching,
+					State: gozk.StateDisconnected,
+					Path:  path,
+					Err:   gozk.ErrSessionExpired,
+				}})
+			}
+			watches[path] = remaining
+		}
+	}
+}
+
+// check returns an error if this session cannot currently be used. It must be called with the server lock held.
+func (c *FakeZookeeperClient) check() error {
+	if c.closed {
+		return gozk.ErrClosing
+	}
+	if c.state != gozk.StateHasSession {
+		return gozk.ErrConnectionClosed
+	}
+	return nil
+}
+
+// AddAuth records the credentials, which are lost if the session expires (see Auth). ACLs are not enforced.
+func (c *FakeZookeeperClient) AddAuth(scheme string, auth []byte) error {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return err
+	}
+	c.auth = append(c.auth, scheme+":"+string(auth))
+	return nil
+}
+
+// Auth returns the credentials added to the current session, as "scheme:auth"
+func (c *FakeZookeeperClient) Auth() []string {
+	c.s.Lock()
+	defer c.s.Unlock()
+	return append([]string(nil), c.auth...)
+}
+
+func (c *FakeZookeeperClient) Children(path string) ([]string, *gozk.Stat, error) {
+	children, stat, _, err := c.children(path, false)
+	return children, stat, err
+}
+
+func (c *FakeZookeeperClient) ChildrenW(path string) ([]string, *gozk.Stat, <-chan gozk.Event, error) {
+	return c.children(path, true)
+}
+
+func (c *FakeZookeeperClient) children(path string, watch bool) ([]string, *gozk.Stat, <-chan gozk.Event, error) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	n := c.s.node(path)
+	if n == nil {
+		return nil, nil, nil, gozk.ErrNoNode
+	}
+
+	children := make([]string, 0, len(n.children))
+	for name := range n.children {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+	stat := n.stat
+
+	var ch <-chan gozk.Event
+	if watch {
+		ch = c.s.watch(c.s.childWatches, path, c)
+	}
+	return children, &stat, ch, nil
+}
+
+// Close ends the session, deleting its ephemeral nodes
+func (c *FakeZookeeperClient) Close() {
+	c.s.Lock()
+	if c.closed {
+		c.s.Unlock()
+		return
+	}
+	c.expire()
+	c.setState(gozk.StateDisconnected)
+	c.closed = true
+	close(c.events)
+	c.s.Unlock()
+
+	c.s.fire()
+}
+
+func (c *FakeZookeeperClient) Create(path string, data []byte, flags int32, acl []gozk.ACL) (string, error) {
+	c.s.Lock()
+	if err := c.check(); err != nil {
+		c.s.Unlock()
+		return "", err
+	}
+	created, err := c.s.create(path, data, flags, acl, c.sessionId)
+	c.s.Unlock()
+
+	c.s.fire()
+	return created, err
+}
+
+func (c *FakeZookeeperClient) CreateProtectedEphemeralSequential(path string, data []byte, acl []gozk.ACL) (string, error) {
+	guid := make([]byte, 16)
+	rand.Read(guid)
+
+	i := strings.LastIndex(path, "/")
+	protected := fmt.Sprintf("%s/_c_%s-%s", path[:i], hex.EncodeToString(guid), path[i+1:])
+	return c.Create(protected, data, gozk.FlagEphemeral|gozk.FlagSequence, acl)
+}
+
+func (c *FakeZookeeperClient) Delete(path string, version int32) error {
+	c.s.Lock()
+	if err := c.check(); err != nil {
+		c.s.Unlock()
+		return err
+	}
+	err := c.s.delete(path, version)
+	c.s.Unlock()
+
+	c.s.fire()
+	return err
+}
+
+func (c *FakeZookeeperClient) Exists(path string) (bool, *gozk.Stat, error) {
+	exists, stat, _, err := c.exists(path, false)
+	return exists, stat, err
+}
+
+func (c *FakeZookeeperClient) ExistsW(path string) (bool, *gozk.Stat, <-chan gozk.Event, error) {
+	return c.exists(path, true)
+}
+
+func (c *FakeZookeeperClient) exists(path string, watch bool) (bool, *gozk.Stat, <-chan gozk.Event, error) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return false, nil, nil, err
+	}
+	var ch <-chan gozk.Event
+	if watch {
+		// unlike other watches, this is set even if the node doesn't exist (to find out when it is created)
+		ch = c.s.watch(c.s.dataWatches, path, c)
+	}
+	n := c.s.node(path)
+	if n == nil {
+		return false, nil, ch, nil
+	}
+	stat := n.stat
+	return true, &stat, ch, nil
+}
+
+func (c *FakeZookeeperClient) Get(path string) ([]byte, *gozk.Stat, error) {
+	data, stat, _, err := c.get(path, false)
+	return data, stat, err
+}
+
+func (c *FakeZookeeperClient) GetW(path string) ([]byte, *gozk.Stat, <-chan gozk.Event, error) {
+	return c.get(path, true)
+}
+
+func (c *FakeZookeeperClient) get(path string, watch bool) ([]byte, *gozk.Stat, <-chan gozk.Event, error) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	n := c.s.node(path)
+	if n == nil {
+		return nil, nil, nil, gozk.ErrNoNode
+	}
+
+	data := make([]byte, len(n.data))
+	copy(data, n.data)
+	stat := n.stat
+
+	var ch <-chan gozk.Event
+	if watch {
+		ch = c.s.watch(c.s.dataWatches, path, c)
+	}
+	return data, &stat, ch, nil
+}
+
+func (c *FakeZookeeperClient) GetACL(path string) ([]gozk.ACL, *gozk.Stat, error) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, nil, err
+	}
+	n := c.s.node(path)
+	if n == nil {
+		return nil, nil, gozk.ErrNoNode
+	}
+	stat := n.stat
+	return n.acl, &stat, nil
+}
+
+// Multi applies the operations atomically: if any fails, none are applied. As with the real client, creates are applied
+// first, then sets, then deletes, then checks.
+func (c *FakeZookeeperClient) Multi(ops gozk.MultiOps) error {
+	c.s.Lock()
+	if err := c.check(); err != nil {
+		c.s.Unlock()
+		return err
+	}
+
+	// apply the operations to a copy of the tree, so we can throw it away if any fail
+	root, zxid, pending := c.s.root, c.s.zxid, c.s.pending
+	dataWatches, childWatches := copyWatches(c.s.dataWatches), copyWatches(c.s.childWatches)
+	c.s.root = root.clone()
+	err := c.s.multi(ops, c.sessionId)
+	if err != nil {
+		c.s.root, c.s.zxid, c.s.pending = root, zxid, pending
+		c.s.dataWatches, c.s.childWatches = dataWatches, childWatches
+	}
+	c.s.Unlock()
+
+	c.s.fire()
+	return err
+}
+
+func (s *fakeServer) multi(ops gozk.MultiOps, sessionId int64) error {
+	for _, op := range ops.Create {
+		if _, err := s.create(op.Path, op.Data, op.Flags, op.Acl, sessionId); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops.SetData {
+		if _, err := s.set(op.Path, op.Data, op.Version); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops.Delete {
+		if err := s.delete(op.Path, op.Version); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops.Check {
+		n := s.node(op.Path)
+		if n == nil {
+			return gozk.ErrNoNode
+		}
+		if op.Version != -1 && op.Version != n.stat.Version {
+			return gozk.ErrBadVersion
+		}
+	}
+	return nil
+}
+
+// Reconnect simulates re-establishing our connection, without losing our session
+func (c *FakeZookeeperClient) Reconnect() error {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if c.closed {
+		return gozk.ErrClosing
+	}
+	if c.state == gozk.StateHasSession {
+		c.setState(gozk.StateDisconnected)
+	}
+	c.setState(gozk.StateConnecting)
+	c.setState(gozk.StateConnected)
+	c.setState(gozk.StateHasSession)
+	return nil
+}
+
+func (c *FakeZookeeperClient) Set(path string, data []byte, version int32) (*gozk.Stat, error) {
+	c.s.Lock()
+	if err := c.check(); err != nil {
+		c.s.Unlock()
+		return nil, err
+	}
+	stat, err := c.s.set(path, data, version)
+	c.s.Unlock()
+
+	c.s.fire()
+	return stat, err
+}
+
+func (c *FakeZookeeperClient) SetACL(path string, acl []gozk.ACL, version int32) (*gozk.Stat, error) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	n := c.s.node(path)
+	if n == nil {
+		return nil, gozk.ErrNoNode
+	}
+	if version != -1 && version != n.stat.Aversion {
+		return nil, gozk.ErrBadVersion
+	}
+	n.acl = acl
+	n.stat.Aversion++
+	stat := n.stat
+	return &stat, nil
+}
+
+func (c *FakeZookeeperClient) State() gozk.State {
+	c.s.Lock()
+	defer c.s.Unlock()
+	return c.state
+}
+
+func (c *FakeZookeeperClient) Sync(path string) (string, error) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	if err := c.check(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (c *FakeZookeeperClient) UpdateAddrs(addrs []string) error {
+	return nil
+}
+
+// NewLock returns a lock following the standard ZooKeeper recipe, using this session
+func (c *FakeZookeeperClient) NewLock(path string, acl []gozk.ACL) gozk.Locker {
+	return &fakeLock{
+		c:    c,
+		path: path,
+		acl:  acl,
+	}
+}
+
+// node returns the node at `path`, or nil if there is none
+func (s *fakeServer) node(path string) *fakeNode {
+	if path == "/" {
+		return s.root
+	}
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return nil
+	}
+	n := s.root
+	for _, name := range strings.Split(path[1:], "/") {
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/", path[i+1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+func (s *fakeServer) create(path string, data []byte, flags int32, acl []gozk.ACL, sessionId int64) (string, error) {
+	if !strings.HasPrefix(path, "/") || path == "/" || strings.HasSuffix(path, "/") {
+		return "", gozk.ErrAPIError
+	}
+	parentPath, name := splitPath(path)
+	parent := s.node(parentPath)
+	if parent == nil {
+		return "", gozk.ErrNoNode
+	}
+	if parent.stat.EphemeralOwner != 0 {
+		return "", gozk.ErrNoChildrenForEphemerals
+	}
+	if flags&gozk.FlagSequence != 0 {
+		name = fmt.Sprintf("%s%010d", name, parent.stat.Cversion)
+		path = strings.TrimSuffix(parentPath, "/") + "/" + name
+	}
+	if _, ok := parent.children[name]; ok {
+		return "", gozk.ErrNodeExists
+	}
+
+	s.zxid++
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	n := &fakeNode{
+		data:     data,
+		acl:      acl,
+		children: make(map[string]*fakeNode),
+		stat: gozk.Stat{
+			Czxid:      s.zxid,
+			Mzxid:      s.zxid,
+			Pzxid:      s.zxid,
+			Ctime:      now,
+			Mtime:      now,
+			DataLength: int32(len(data)),
+		},
+	}
+	if flags&gozk.FlagEphemeral != 0 {
+		n.stat.EphemeralOwner = sessionId
+	}
+	parent.children[name] = n
+	parent.stat.Cversion++
+	parent.stat.NumChildren++
+	parent.stat.Pzxid = s.zxid
+
+	s.trigger(s.dataWatches, path, gozk.EventNodeCreated)
+	s.trigger(s.childWatches, parentPath, gozk.EventNodeChildrenChanged)
+	return path, nil
+}
+
+func (s *fakeServer) delete(path string, version int32) error {
+	if path == "/" {
+		return gozk.ErrAPIError
+	}
+	n := s.node(path)
+	if n == nil {
+		return gozk.ErrNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return gozk.ErrBadVersion
+	}
+	if len(n.children) > 0 {
+		return gozk.ErrNotEmpty
+	}
+
+	parentPath, name := splitPath(path)
+	parent := s.node(parentPath)
+	s.zxid++
+	delete(parent.children, name)
+	parent.stat.Cversion++
+	parent.stat.NumChildren--
+	parent.stat.Pzxid = s.zxid
+
+	s.trigger(s.dataWatches, path, gozk.EventNodeDeleted)
+	s.trigger(s.childWatches, path, gozk.EventNodeDeleted)
+	s.trigger(s.childWatches, parentPath, gozk.EventNodeChildrenChanged)
+	return nil
+}
+
+func (s *fakeServer) set(path string, data []byte, version int32) (*gozk.Stat, error) {
+	n := s.node(path)
+	if n == nil {
+		return nil, gozk.ErrNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return nil, gozk.ErrBadVersion
+	}
+
+	s.zxid++
+	n.data = data
+	n.stat.Version++
+	n.stat.Mzxid = s.zxid
+	n.stat.Mtime = time.Now().UnixNano() / int64(time.Millisecond)
+	n.stat.DataLength = int32(len(data))
+
+	s.trigger(s.dataWatches, path, gozk.EventNodeDataChanged)
+	stat := n.stat
+	return &stat, nil
+}
+
+// walk calls f for every node in the tree, children first
+func (s *fakeServer) walk(path string, n *fakeNode, f func(string, *fakeNode)) {
+	for name, child := range n.children {
+		s.walk(path+"/"+name, child, f)
+	}
+	if path != "" {
+		f(path, n)
+	}
+}
+
+// watch sets a one-off watch on `path`, which must be called with the server lock held
+func (s *fakeServer) watch(watches map[string][]*fakeWatch, path string, c *FakeZookeeperClient) <-chan gozk.Event {
+	w := &fakeWatch{
+		session: c,
+		ch:      make(chan gozk.Event, 1),
+	}
+	watches[path] = append(watches[path], w)
+	return w.ch
+}
+
+// trigger queues the watches on `path` to be fired once the current operation has completed
+func (s *fakeServer) trigger(watches map[string][]*fakeWatch, path string, typ gozk.EventType) {
+	for _, w := range watches[path] {
+		s.pending = append(s.pending, fakeFiring{w, gozk.Event{
+			Type:  typ,
+			State: gozk.StateHasSession,
+			Path:  path,
+		}})
+	}
+	delete(watches, path)
+}
+
+// fire delivers pending watch events, which must be called without the server lock held
+func (s *fakeServer) fire() {
+	s.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.Unlock()
+
+	for _, f := range pending {
+		f.w.ch <- f.ev
+		close(f.w.ch)
+	}
+}
+
+func copyWatches(watches map[string][]*fakeWatch) map[string][]*fakeWatch {
+	c := make(map[string][]*fakeWatch, len(watches))
+	for path, ws := range watches {
+		c[path] = ws
+	}
+	return c
+}
+
+func (n *fakeNode) clone() *fakeNode {
+	c := &fakeNode{
+		data:     n.data,
+		acl:      n.acl,
+		stat:     n.stat,
+		children: make(map[string]*fakeNode, len(n.children)),
+	}
+	for name, child := range n.children {
+		c.children[name] = child.clone()
+	}
+	return c
+}
+
+// fakeLock implements the standard ZooKeeper lock recipe on a fake session
+type fakeLock struct {
+	c       *FakeZookeeperClient
+	path    string
+	acl     []gozk.ACL
+	node    string
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+func (l *fakeLock) Lock() error {
+	if l.node != "" {
+		return gozk.ErrDeadlock
+	}
+
+	node, err := l.c.CreateProtectedEphemeralSequential(l.path+"/lock-", []byte{}, l.acl)
+	if err == gozk.ErrNoNode {
+		if err := l.createParents(); err != nil {
+			return err
+		}
+		node, err = l.c.CreateProtectedEphemeralSequential(l.path+"/lock-", []byte{}, l.acl)
+	}
+	if err != nil {
+		return err
+	}
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timeout = time.After(l.timeout)
+	}
+	for {
+		children, _, err := l.c.Children(l.path)
+		if err != nil {
+			return err
+		}
+		sort.Sort(bySequence(children))
+
+		_, name := splitPath(node)
+		prev := ""
+		for _, child := range children {
+			if child == name {
+				break
+			}
+			prev = child
+		}
+		if prev == "" {
+			l.node = node
+			return nil
+		}
+
+		exists, _, watch, err := l.c.ExistsW(l.path + "/" + prev)
+		if err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		select {
+		case <-watch:
+		case <-timeout:
+			l.c.Delete(node, -1)
+			return ErrFakeLockTimeout
+		}
+	}
+}
+
+func (l *fakeLock) createParents() error {
+	parts := strings.Split(l.path, "/")
+	pth := ""
+	for _, p := range parts[1:] {
+		pth += "/" + p
+		if _, err := l.c.Create(pth, []byte{}, 0, l.acl); err != nil && err != gozk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *fakeLock) Unlock() error {
+	if l.node == "" {
+		return gozk.ErrNotLocked
+	}
+	err := l.c.Delete(l.node, -1)
+	l.node = ""
+	return err
+}
+
+func (l *fakeLock) SetTTL(d time.Duration) {
+	l.ttl = d
+}
+
+func (l *fakeLock) SetTimeout(d time.Duration) {
+	l.timeout = d
+}
+
+// bySequence sorts sequential node names by their 10 digit sequence suffix
+type bySequence []string
+
+func (s bySequence) Len() int           { return len(s) }
+func (s bySequence) Less(i, j int) bool { return s[i][len(s[i])-10:] < s[j][len(s[j])-10:] }
+func (s bySequence) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
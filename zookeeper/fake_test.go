@@ -0,0 +1,110 @@
+package zookeeper
+
+import (
+	"testing"
+	"time"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+func expectWatch(t *testing.T, watch <-chan gozk.Event, typ gozk.EventType) {
+	select {
+	case ev := <-watch:
+		if ev.Type != typ {
+			t.Errorf("Want %v, Got %v", typ, ev.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for %v", typ)
+	}
+}
+
+func TestFakeCreateAndVersions(t *testing.T) {
+	c := NewFakeZookeeperClient()
+	defer c.Close()
+
+	if _, err := c.Create("/foo/bar", []byte{}, 0, nil); err != gozk.ErrNoNode {
+		t.Errorf("Want %v creating without parent, Got %v", gozk.ErrNoNode, err)
+	}
+	if _, err := c.Create("/foo", []byte("a"), 0, nil); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := c.Create("/foo", []byte("a"), 0, nil); err != gozk.ErrNodeExists {
+		t.Errorf("Want %v, Got %v", gozk.ErrNodeExists, err)
+	}
+
+	for i, want := range []string{"/foo/item-0000000000", "/foo/item-0000000001"} {
+		if path, err := c.Create("/foo/item-", []byte{}, gozk.FlagSequence, nil); err != nil || path != want {
+			t.Errorf("Case %d: Want %s, Got %s (%v)", i, want, path, err)
+		}
+	}
+
+	if _, err := c.Set("/foo", []byte("b"), 1); err != gozk.ErrBadVersion {
+		t.Errorf("Want %v, Got %v", gozk.ErrBadVersion, err)
+	}
+	stat, err := c.Set("/foo", []byte("b"), 0)
+	if err != nil || stat.Version != 1 || stat.NumChildren != 2 {
+		t.Errorf("Unexpected stat %+v (%v)", stat, err)
+	}
+	if err := c.Delete("/foo", -1); err != gozk.ErrNotEmpty {
+		t.Errorf("Want %v, Got %v", gozk.ErrNotEmpty, err)
+	}
+}
+
+func TestFakeWatches(t *testing.T) {
+	c := NewFakeZookeeperClient()
+	defer c.Close()
+
+	_, _, existsWatch, _ := c.ExistsW("/foo")
+	_, _, childWatch, _ := c.ChildrenW("/")
+	c.Create("/foo", []byte{}, 0, nil)
+	expectWatch(t, existsWatch, gozk.EventNodeCreated)
+	expectWatch(t, childWatch, gozk.EventNodeChildrenChanged)
+
+	_, _, dataWatch, _ := c.GetW("/foo")
+	c.Set("/foo", []byte("a"), -1)
+	expectWatch(t, dataWatch, gozk.EventNodeDataChanged)
+
+	_, _, dataWatch, _ = c.GetW("/foo")
+	c.Delete("/foo", -1)
+	expectWatch(t, dataWatch, gozk.EventNodeDeleted)
+}
+
+func TestFakeMultiIsAtomic(t *testing.T) {
+	c := NewFakeZookeeperClient()
+	defer c.Close()
+
+	c.Create("/foo", []byte{}, 0, nil)
+	err := c.Multi(gozk.MultiOps{
+		Create: []gozk.CreateRequest{{Path: "/bar", Data: []byte{}}},
+		Delete: []gozk.DeleteRequest{{Path: "/foo", Version: 1}},
+	})
+	if err != gozk.ErrBadVersion {
+		t.Fatalf("Want %v, Got %v", gozk.ErrBadVersion, err)
+	}
+	if exists, _, _ := c.Exists("/bar"); exists {
+		t.Error("Expected failed Multi not to have created a node")
+	}
+}
+
+func TestFakeSessionExpiry(t *testing.T) {
+	c := NewFakeZookeeperClient()
+	defer c.Close()
+	other := c.NewSession()
+	defer other.Close()
+
+	c.Create("/foo", []byte{}, gozk.FlagEphemeral, nil)
+	if _, err := c.Create("/foo/bar", []byte{}, 0, nil); err != gozk.ErrNoChildrenForEphemerals {
+		t.Errorf("Want %v, Got %v", gozk.ErrNoChildrenForEphemerals, err)
+	}
+	_, _, ourWatch, _ := c.GetW("/foo")
+	_, _, otherWatch, _ := other.GetW("/foo")
+	_, _, lostWatch, _ := c.ExistsW("/bar")
+
+	c.ExpireSession()
+	expectWatch(t, ourWatch, gozk.EventNodeDeleted)
+	expectWatch(t, otherWatch, gozk.EventNodeDeleted)
+	expectWatch(t, lostWatch, gozk.EventNotWatching)
+	if c.State() != gozk.StateHasSession {
+		t.Errorf("Expected a new session, state is %v", c.State())
+	}
+}
@@ -2,7 +2,6 @@ package zookeeper
 
 import (
 	"fmt"
-	"github.com/HailoOSS/service/config"
 	"github.com/HailoOSS/service/connhealthcheck"
 	"github.com/HailoOSS/service/healthcheck"
 )
@@ -14,20 +13,47 @@ const (
 
 // HealthCheck asserts we can talk to ZK
 func HealthCheck() healthcheck.Checker {
+	return DefaultClient.HealthCheck()
+}
+
+// MaxConnHealthCheck asserts that the total number of established connections to all zookeeper nodes
+// falls below a given max threshold.
+func MaxConnHealthCheck(maxconns int) healthcheck.Checker {
+	return DefaultClient.MaxConnHealthCheck(maxconns)
+}
+
+// HealthCheckId returns the ID under which this client's HealthCheck should be registered
+func (c *Client) HealthCheckId() string {
+	if c == DefaultClient {
+		return HealthCheckId
+	}
+	return HealthCheckId + "." + c.Name
+}
+
+// MaxConnCheckId returns the ID under which this client's MaxConnHealthCheck should be registered
+func (c *Client) MaxConnCheckId() string {
+	if c == DefaultClient {
+		return MaxConnCheckId
+	}
+	return MaxConnCheckId + "." + c.Name
+}
+
+// HealthCheck asserts we can talk to this client's ensemble
+func (c *Client) HealthCheck() healthcheck.Checker {
 	return func() (map[string]string, error) {
-		_, _, err := Exists("/healthcheck")
+		_, _, err := c.Exists("/healthcheck")
 		if err != nil {
-			return nil, fmt.Errorf("Zookeeper operation failed: %v", err)
+			return nil, fmt.Errorf("Zookeeper (%s) operation failed: %v", c.Name, err)
 		}
 		return nil, nil
 	}
 }
 
-// MaxConnHealthCheck asserts that the total number of established connections to all zookeeper nodes
+// MaxConnHealthCheck asserts that the total number of established connections to all nodes of this client's ensemble
 // falls below a given max threshold.
-func MaxConnHealthCheck(maxconns int) healthcheck.Checker {
+func (c *Client) MaxConnHealthCheck(maxconns int) healthcheck.Checker {
 	return func() (map[string]string, error) {
-		nodes := config.AtPath("hailo", "service", "zookeeper", "hosts").AsHostnameArray(2181)
+		nodes := c.configAt("hosts").AsHostnameArray(2181)
 		return connhealthcheck.MaxTcpConnections(nodes, maxconns)()
 	}
 }
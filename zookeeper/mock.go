@@ -24,6 +24,12 @@ func MockConnector(servers []string, recvTimeout time.Duration) (ZookeeperClient
 	return ActiveMockZookeeperClient, nil, nil
 }
 
+func (c *MockZookeeperClient) AddAuth(scheme string, auth []byte) error {
+	log.Tracef("[ZooKeeper mock] AddAuth(scheme=%s) called", scheme)
+	returnArgs := c.Mock.Called(scheme, auth)
+	return returnArgs.Error(0)
+}
+
 func (c *MockZookeeperClient) Children(path string) ([]string, *gozk.Stat, error) {
 	log.Tracef("[ZooKeeper mock] Children(path=%s) called", path)
 	returnArgs := c.Mock.Called(path)
@@ -75,7 +81,7 @@ func (c *MockZookeeperClient) Exists(path string) (bool, *gozk.Stat, error) {
 
 func (c *MockZookeeperClient) ExistsW(path string) (bool, *gozk.Stat, <-chan gozk.Event, error) {
 	log.Tracef("[ZooKeeper mock] ExistsW(path=%s) called", path)
-	returnArgs := c.Mock.Called(ExistsW)
+	returnArgs := c.Mock.Called(path)
 	return returnArgs.Bool(0),
 		returnArgs.Get(1).(*gozk.Stat),
 		returnArgs.Get(2).(<-chan gozk.Event),
@@ -0,0 +1,346 @@
+package zookeeper
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+// SessionEvent describes a change in the state of our ZooKeeper session
+type SessionEvent int
+
+const (
+	// SessionConnected is sent when we first establish a session
+	SessionConnected SessionEvent = iota
+	// SessionDisconnected is sent when we lose our connection. The session may survive if we reconnect in time, but
+	// until then we cannot know whether our ephemeral nodes still exist.
+	SessionDisconnected
+	// SessionExpired is sent when our session has expired, meaning our ephemeral nodes and watches have gone
+	SessionExpired
+	// SessionReconnected is sent when we have a session again after being disconnected, or after expiry (in which
+	// case it is a new session)
+	SessionReconnected
+)
+
+const (
+	sessionEventBuffer = 10
+	watchRetryInterval = time.Second
+)
+
+func (e SessionEvent) String() string {
+	switch e {
+	case SessionConnected:
+		return "connected"
+	case SessionDisconnected:
+		return "disconnected"
+	case SessionExpired:
+		return "expired"
+	case SessionReconnected:
+		return "reconnected"
+	}
+	return "unknown"
+}
+
+// session tracks the state of a ZooKeeper session from the connection's event stream, notifying subscribers and
+// re-creating registered ephemeral nodes after expiry
+type session struct {
+	sync.Mutex
+	connected     bool
+	everConnected bool
+	expired       bool
+	subscribers   []chan SessionEvent
+	ephemerals    map[*EphemeralNode]struct{}
+}
+
+func newSession() *session {
+	return &session{
+		ephemerals: make(map[*EphemeralNode]struct{}),
+	}
+}
+
+// handle processes an event from the connection's event channel
+func (s *session) handle(ev gozk.Event) {
+	if ev.Type != gozk.EventSession {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch ev.State {
+	case gozk.StateHasSession:
+		if s.connected {
+			return
+		}
+		s.connected = true
+		if !s.everConnected {
+			s.everConnected = true
+			s.publish(SessionConnected)
+			return
+		}
+		s.publish(SessionReconnected)
+		if s.expired {
+			s.expired = false
+			go s.reestablish()
+		}
+	case gozk.StateDisconnected, gozk.StateConnecting:
+		if !s.connected {
+			return
+		}
+		s.connected = false
+		s.publish(SessionDisconnected)
+	case gozk.StateExpired:
+		s.connected = false
+		s.expired = true
+		s.publish(SessionExpired)
+	}
+}
+
+// publish must be called with the lock held. Subscribers which aren't keeping up miss events rather than block us.
+func (s *session) publish(ev SessionEvent) {
+	log.Infof("[ZooKeeper] Session %v", ev)
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (s *session) subscribe() <-chan SessionEvent {
+	s.Lock()
+	defer s.Unlock()
+
+	ch := make(chan SessionEvent, sessionEventBuffer)
+	s.subscribers = append(s.subscribers, ch)
+	return ch
+}
+
+func (s *session) unsubscribe(ch <-chan SessionEvent) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, sub := range s.subscribers {
+		if sub == ch {
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// reestablish re-creates registered ephemeral nodes, which were deleted when our previous session expired
+func (s *session) reestablish() {
+	s.Lock()
+	nodes := make([]*EphemeralNode, 0, len(s.ephemerals))
+	for e := range s.ephemerals {
+		nodes = append(nodes, e)
+	}
+	s.Unlock()
+
+	for _, e := range nodes {
+		if err := e.create(); err != nil {
+			log.Warnf("[ZooKeeper] Failed to re-create ephemeral node '%s' after session expiry: %v", e.Path, err)
+			s.Lock()
+			delete(s.ephemerals, e)
+			s.Unlock()
+			continue
+		}
+		log.Infof("[ZooKeeper] Re-created ephemeral node '%s' after session expiry", e.Path)
+	}
+}
+
+// SubscribeSession returns a channel which receives session events of the default client. Subscribers which do not
+// keep up will miss events.
+func SubscribeSession() <-chan SessionEvent {
+	return DefaultClient.SubscribeSession()
+}
+
+// UnsubscribeSession stops sending session events of the default client to the channel
+func UnsubscribeSession(ch <-chan SessionEvent) {
+	DefaultClient.UnsubscribeSession(ch)
+}
+
+// SubscribeSession returns a channel which receives session events. Subscribers which do not keep up will miss events.
+func (c *Client) SubscribeSession() <-chan SessionEvent {
+	return c.session.subscribe()
+}
+
+// UnsubscribeSession stops sending session events to the channel
+func (c *Client) UnsubscribeSession(ch <-chan SessionEvent) {
+	c.session.unsubscribe(ch)
+}
+
+// EphemeralNode is an ephemeral node which is re-created if our session expires, until it is removed
+type EphemeralNode struct {
+	sync.Mutex
+	Path string
+	data []byte
+	acl  []gozk.ACL
+	c    *Client
+}
+
+// CreateEphemeral creates an ephemeral node via the default client, see Client.CreateEphemeral
+func CreateEphemeral(path string, data []byte, acl []gozk.ACL) (*EphemeralNode, error) {
+	return DefaultClient.CreateEphemeral(path, data, acl)
+}
+
+// CreateEphemeral creates an ephemeral node (and any parents it requires) which will be re-created after session
+// expiry, until Remove is called
+func (c *Client) CreateEphemeral(path string, data []byte, acl []gozk.ACL) (*EphemeralNode, error) {
+	e := &EphemeralNode{
+		Path: path,
+		data: data,
+		acl:  acl,
+		c:    c,
+	}
+	if err := e.create(); err != nil {
+		return nil, err
+	}
+
+	c.session.Lock()
+	c.session.ephemerals[e] = struct{}{}
+	c.session.Unlock()
+
+	return e, nil
+}
+
+func (e *EphemeralNode) create() error {
+	e.Lock()
+	data := e.data
+	e.Unlock()
+
+	_, err := e.c.Create(e.Path, data, gozk.FlagEphemeral, e.acl)
+	if err == gozk.ErrNoNode {
+		if err := e.c.CreateParents(e.Path[:strings.LastIndex(e.Path, "/")]); err != nil {
+			return err
+		}
+		_, err = e.c.Create(e.Path, data, gozk.FlagEphemeral, e.acl)
+	}
+	return err
+}
+
+// Set updates the data of the node, which is also used if it has to be re-created
+func (e *EphemeralNode) Set(data []byte) error {
+	e.Lock()
+	e.data = data
+	e.Unlock()
+
+	_, err := e.c.Set(e.Path, data, -1)
+	return err
+}
+
+// Remove deletes the node, and stops it being re-created
+func (e *EphemeralNode) Remove() error {
+	e.c.session.Lock()
+	delete(e.c.session.ephemerals, e)
+	e.c.session.Unlock()
+
+	if err := e.c.Delete(e.Path, -1); err != nil && err != gozk.ErrNoNode {
+		return err
+	}
+	return nil
+}
+
+// Watcher calls a function for every event on a path, re-establishing its watch after each event and after session
+// expiry
+type Watcher struct {
+	c        *Client
+	path     string
+	children bool
+	fn       func(gozk.Event)
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// WatchData watches a node via the default client, see Client.WatchData
+func WatchData(path string, fn func(gozk.Event)) *Watcher {
+	return DefaultClient.WatchData(path, fn)
+}
+
+// WatchChildren watches the children of a node via the default client, see Client.WatchChildren
+func WatchChildren(path string, fn func(gozk.Event)) *Watcher {
+	return DefaultClient.WatchChildren(path, fn)
+}
+
+// WatchData calls `fn` whenever the node at `path` is created, deleted or has its data changed, until stopped
+func (c *Client) WatchData(path string, fn func(gozk.Event)) *Watcher {
+	return newWatcher(c, path, false, fn)
+}
+
+// WatchChildren calls `fn` whenever the children of the node at `path` change, until stopped
+func (c *Client) WatchChildren(path string, fn func(gozk.Event)) *Watcher {
+	return newWatcher(c, path, true, fn)
+}
+
+func newWatcher(c *Client, path string, children bool, fn func(gozk.Event)) *Watcher {
+	w := &Watcher{
+		c:        c,
+		path:     path,
+		children: children,
+		fn:       fn,
+		stop:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Stop watching
+func (w *Watcher) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watcher) run() {
+	sessions := w.c.SubscribeSession()
+	defer w.c.UnsubscribeSession(sessions)
+
+	resumed := false
+	for {
+		watch, err := w.watch()
+		if err != nil {
+			// we're probably disconnected, so try again once we have a session
+			log.Debugf("[ZooKeeper] Failed to watch '%s', will retry: %v", w.path, err)
+			select {
+			case <-sessions:
+			case <-time.After(watchRetryInterval):
+			case <-w.stop:
+				return
+			}
+			continue
+		}
+
+		if resumed {
+			// we may have missed changes while our session was gone
+			resumed = false
+			w.fn(gozk.Event{Type: gozk.EventSession, State: gozk.StateHasSession, Path: w.path})
+		}
+
+		select {
+		case ev := <-watch:
+			if ev.Type == gozk.EventNotWatching {
+				resumed = true
+				continue
+			}
+			w.fn(ev)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *Watcher) watch() (<-chan gozk.Event, error) {
+	if w.children {
+		_, _, watch, err := w.c.ChildrenW(w.path)
+		if err != gozk.ErrNoNode {
+			return watch, err
+		}
+		// wait for it to be created
+	}
+	_, _, watch, err := w.c.ExistsW(w.path)
+	return watch, err
+}
@@ -0,0 +1,58 @@
+package zookeeper
+
+import (
+	"testing"
+
+	gozk "github.com/HailoOSS/go-zookeeper/zk"
+)
+
+func TestSessionEvents(t *testing.T) {
+	s := newSession()
+	ch := s.subscribe()
+
+	states := []gozk.State{
+		gozk.StateConnecting,
+		gozk.StateConnected,
+		gozk.StateHasSession,
+		gozk.StateHasSession,
+		gozk.StateDisconnected,
+		gozk.StateConnecting,
+		gozk.StateHasSession,
+		gozk.StateExpired,
+		gozk.StateDisconnected,
+		gozk.StateHasSession,
+	}
+	for _, st := range states {
+		s.handle(gozk.Event{Type: gozk.EventSession, State: st})
+	}
+	// other events are ignored
+	s.handle(gozk.Event{Type: gozk.EventNodeDeleted, State: gozk.StateDisconnected})
+
+	want := []SessionEvent{
+		SessionConnected,
+		SessionDisconnected,
+		SessionReconnected,
+		SessionExpired,
+		SessionReconnected,
+	}
+	for _, w := range want {
+		select {
+		case ev := <-ch:
+			if ev != w {
+				t.Errorf("Want %v, Got %v", w, ev)
+			}
+		default:
+			t.Fatalf("Want %v, Got nothing", w)
+		}
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("Unexpected event %v", ev)
+	default:
+	}
+
+	s.unsubscribe(ch)
+	if len(s.subscribers) != 0 {
+		t.Errorf("Expected no subscribers, got %d", len(s.subscribers))
+	}
+}